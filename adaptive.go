@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+ * adaptive scheduling: the delay between two runs follows the review velocity of an app.
+ * After each successful run, the share of new reviews among the crawled ones of the recent runs decides:
+ *  - at least busyRatio new: the delay is halved (e.g. right after a release)
+ *  - at most dormantRatio new: the delay is doubled
+ *  - otherwise the delay is kept
+ * The delay always stays within the min and max interval of the observable.
+ */
+
+const (
+	intervalAdaptive = "adaptive"
+
+	defaultMinInterval = time.Hour
+	defaultMaxInterval = 7 * 24 * time.Hour
+	initialDelay       = 24 * time.Hour
+
+	adaptiveWindow = 3
+	busyRatio      = 0.5
+	dormantRatio   = 0.1
+)
+
+// pollSchedule fires every minute. Adaptive observables decide on each fire time whether a run is due
+type pollSchedule struct{}
+
+func (pollSchedule) Next(t time.Time) time.Time {
+	return t.Truncate(time.Minute).Add(time.Minute)
+}
+
+func isAdaptive(observable ObservableGooglePlay) bool {
+	return observable.Interval == intervalAdaptive
+}
+
+// adaptiveBounds returns the min and max interval of an adaptive observable
+func adaptiveBounds(observable ObservableGooglePlay) (time.Duration, time.Duration, error) {
+	min, max := defaultMinInterval, defaultMaxInterval
+	var err error
+	if observable.MinInterval != "" {
+		if min, err = time.ParseDuration(observable.MinInterval); err != nil || min < time.Minute {
+			return 0, 0, fmt.Errorf("invalid min_interval %q: use a duration of at least 1m like 2h", observable.MinInterval)
+		}
+	}
+	if observable.MaxInterval != "" {
+		if max, err = time.ParseDuration(observable.MaxInterval); err != nil {
+			return 0, 0, fmt.Errorf("invalid max_interval %q: use a duration like 168h", observable.MaxInterval)
+		}
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("min_interval %v must not be larger than max_interval %v", min, max)
+	}
+	return min, max, nil
+}
+
+func clampDuration(d time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// adaptiveDelay returns the current delay between two runs of an adaptive observable
+func adaptiveDelay(observable ObservableGooglePlay) time.Duration {
+	min, max, err := adaptiveBounds(observable)
+	if err != nil {
+		return initialDelay
+	}
+	if observable.Adaptive != nil {
+		if delay, err := time.ParseDuration(observable.Adaptive.Delay); err == nil {
+			return clampDuration(delay, min, max)
+		}
+	}
+	return clampDuration(initialDelay, min, max)
+}
+
+// AdaptiveDue returns the time the next run of an adaptive observable is due, zero if it never ran and has no observation start.
+// Failed runs do not count: an app whose last run failed is retried after the min interval
+func AdaptiveDue(observable ObservableGooglePlay) time.Time {
+	reference := observable.LastRunAt
+	if reference == nil {
+		reference = observable.ObservedSince
+	}
+	if reference == nil {
+		return time.Time{}
+	}
+	due := reference.Add(adaptiveDelay(observable))
+	if letter, ok := DeadLetterOf(observable.Tenant, observable.PackageName); ok && letter.FailedAt != nil {
+		if min, _, err := adaptiveBounds(observable); err == nil && letter.FailedAt.Add(min).After(due) {
+			due = letter.FailedAt.Add(min)
+		}
+	}
+	return due
+}
+
+// AdjustAdaptiveDelay derives the next delay of an adaptive observable from its recent successful runs
+func AdjustAdaptiveDelay(observable *ObservableGooglePlay, recent []Run, now time.Time) {
+	min, max, err := adaptiveBounds(*observable)
+	if err != nil {
+		return
+	}
+
+	crawled, new := 0, 0
+	for _, run := range recent {
+		crawled += run.CrawledReviews
+		new += run.NewReviews
+	}
+	ratio := 0.0
+	if crawled > 0 {
+		ratio = float64(new) / float64(crawled)
+	}
+
+	delay := adaptiveDelay(*observable)
+	var reason string
+	switch {
+	case crawled > 0 && ratio >= busyRatio:
+		delay = clampDuration(delay/2, min, max)
+		reason = fmt.Sprintf("%d of %d crawled reviews of the last %d runs were new (%.0f%%, at least %.0f%%), shortened the delay to %v", new, crawled, len(recent), ratio*100, busyRatio*100, delay)
+	case ratio <= dormantRatio:
+		delay = clampDuration(delay*2, min, max)
+		reason = fmt.Sprintf("%d of %d crawled reviews of the last %d runs were new (%.0f%%, at most %.0f%%), lengthened the delay to %v", new, crawled, len(recent), ratio*100, dormantRatio*100, delay)
+	default:
+		reason = fmt.Sprintf("%d of %d crawled reviews of the last %d runs were new (%.0f%%), kept the delay of %v", new, crawled, len(recent), ratio*100, delay)
+	}
+	if delay == min || delay == max {
+		reason += fmt.Sprintf(" (bounds %v - %v)", min, max)
+	}
+
+	observable.Adaptive = &AdaptiveState{Delay: delay.String(), NewReviewRatio: ratio, Reason: reason, AdjustedAt: now}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdjustAdaptiveDelay(t *testing.T) {
+	now := time.Now()
+	observable := ObservableGooglePlay{PackageName: "eu.openreq", Interval: intervalAdaptive, MinInterval: "2h", MaxInterval: "48h"}
+
+	busy := []Run{{RunResult: RunResult{CrawledReviews: 100, NewReviews: 80}}, {RunResult: RunResult{CrawledReviews: 100, NewReviews: 40}}}
+	AdjustAdaptiveDelay(&observable, busy, now)
+	if observable.Adaptive.Delay != "12h0m0s" || !strings.Contains(observable.Adaptive.Reason, "shortened") {
+		t.Errorf("Expected the delay to be halved. Got %+v instead", observable.Adaptive)
+	}
+
+	dormant := []Run{{RunResult: RunResult{CrawledReviews: 100, NewReviews: 2}}}
+	AdjustAdaptiveDelay(&observable, dormant, now)
+	AdjustAdaptiveDelay(&observable, dormant, now)
+	AdjustAdaptiveDelay(&observable, dormant, now)
+	if observable.Adaptive.Delay != "48h0m0s" || !strings.Contains(observable.Adaptive.Reason, "bounds") {
+		t.Errorf("Expected the delay to be capped by the max interval. Got %+v instead", observable.Adaptive)
+	}
+
+	steady := []Run{{RunResult: RunResult{CrawledReviews: 100, NewReviews: 30}}}
+	AdjustAdaptiveDelay(&observable, steady, now)
+	if observable.Adaptive.Delay != "48h0m0s" || !strings.Contains(observable.Adaptive.Reason, "kept") {
+		t.Errorf("Expected the delay to be kept. Got %+v instead", observable.Adaptive)
+	}
+
+	lastRun := now.Add(-47 * time.Hour)
+	observable.LastRunAt = &lastRun
+	if due := AdaptiveDue(observable); !due.Equal(lastRun.Add(48 * time.Hour)) {
+		t.Errorf("Expected the next run to be due 48h after the last one. Got %v instead", due)
+	}
+
+	observable.PackageName = "com.adaptive.failing"
+	failedAt := now.Add(-time.Hour)
+	RecordDeadLetter(Run{PackageName: observable.PackageName, Status: runFailed, FinishedAt: &failedAt})
+	defer ResolveDeadLetter(defaultTenant, observable.PackageName)
+	if due := AdaptiveDue(observable); !due.Equal(failedAt.Add(2 * time.Hour)) {
+		t.Errorf("Expected a failed run to be retried after the min interval. Got %v instead", due)
+	}
+	observable.LastRunAt = nil
+	if due := AdaptiveDue(observable); !due.IsZero() {
+		t.Errorf("Expected an observable that never ran to be due. Got %v instead", due)
+	}
+}
+
+func TestObserveAdaptive(t *testing.T) {
+	induceServerError = false
+	observe := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.adaptive.app/interval/adaptive%s"}
+	assertStatus(t, http.StatusBadRequest, observe.withVars("?min_interval=10h&max_interval=1h").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, observe.withVars("?min_interval=10s").mustExecuteRequest(nil))
+	assertSuccess(t, observe.withVars("?min_interval=1h&max_interval=72h").mustExecuteRequest(nil))
+
+	rr := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.adaptive.app/run"}.mustExecuteRequest(nil)
+	var run Run
+	json.NewDecoder(rr.Body).Decode(&run)
+	waitForRun(t, run.ID)
+
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play/package-name/com.adaptive.app"}.mustExecuteRequest(nil)
+	var status ObservableStatus
+	json.NewDecoder(rr.Body).Decode(&status)
+	if status.Adaptive == nil || status.Adaptive.Delay != "48h0m0s" || status.Adaptive.Reason == "" {
+		t.Errorf("Expected the delay of a dormant app to be lengthened with a reason. Got %+v instead", status.Adaptive)
+	}
+	if status.Schedule.Delay != "48h0m0s" || status.Schedule.NextRun == nil {
+		t.Errorf("Expected the adaptive schedule to be shown. Got %+v instead", status.Schedule)
+	}
+
+	assertStatus(t, http.StatusBadRequest, endpoint{method: "GET", url: "/hitec/orchestration/app/observe/interval/preview?interval=adaptive"}.mustExecuteRequest(nil))
+}
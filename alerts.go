@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * alert rules on the signals of an observable or of all apps of a project. The rules of an app are evaluated over its
+ * run history after each successful run:
+ *   bug_reports, feature_requests, new_reviews  sum over the window is above the threshold
+ *   one_star_share                               share of 1-star reviews (percent) among the reviews classified within the window is above the threshold
+ *   rating_drop                                  the rating of the app page dropped by more than the threshold compared to the window before
+ * An alert fires once and is resolved once its value is no longer above the threshold. Firing and resolved alerts are
+ * POSTed to the webhook of the rule (signed like webhooks) and mailed to its emails via SMTP (SMTP_ADDR, SMTP_FROM and
+ * optionally SMTP_USERNAME and SMTP_PASSWORD). A silenced rule is evaluated but does not notify; an alert that fired
+ * while its rule was silenced is notified once the silence ends. A failed notification is sent again with the next evaluation,
+ * only to the sinks that did not receive it.
+ */
+
+const (
+	bucketAlertRules = "alert_rules"
+	bucketAlerts     = "alerts"
+
+	metricBugReports      = "bug_reports"
+	metricFeatureRequests = "feature_requests"
+	metricNewReviews      = "new_reviews"
+	metricOneStarShare    = "one_star_share"
+	metricRatingDrop      = "rating_drop"
+
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+
+	alertSinkWebhook = "webhook"
+	alertSinkEmails  = "emails"
+
+	defaultAlertWindow      = "24h"
+	defaultRatingDropWindow = "168h"
+	maxAlertWindow          = 30 * 24 * time.Hour
+)
+
+var metrics = []string{metricBugReports, metricFeatureRequests, metricNewReviews, metricOneStarShare, metricRatingDrop}
+
+var smtpAddr = os.Getenv("SMTP_ADDR")
+var smtpFrom = os.Getenv("SMTP_FROM")
+var smtpUsername = os.Getenv("SMTP_USERNAME")
+var smtpPassword = os.Getenv("SMTP_PASSWORD")
+
+var errUnknownAlertRule = errors.New("unknown alert rule")
+
+// alertsMutex serializes the evaluation of alerts, so an alert is notified only once
+var alertsMutex sync.Mutex
+
+// ValidateAlertRule checks an alert rule and sets its defaults
+func ValidateAlertRule(rule *AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("an alert rule needs a name")
+	}
+	if strings.IndexFunc(rule.Name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid name %q: must not contain control characters", rule.Name)
+	}
+	if (rule.PackageName == "") == (rule.Project == "") {
+		return fmt.Errorf("an alert rule needs either a package_name or a project")
+	}
+	if rule.PackageName != "" {
+		if err := ValidatePackageName(rule.PackageName); err != nil {
+			return err
+		}
+	}
+	if !containsString(metrics, rule.Metric) {
+		return fmt.Errorf("invalid metric %q: use one of %s", rule.Metric, strings.Join(metrics, ", "))
+	}
+	if rule.Threshold < 0 || (rule.Metric == metricOneStarShare && rule.Threshold > 100) {
+		return fmt.Errorf("invalid threshold %v", rule.Threshold)
+	}
+	if rule.Window == "" {
+		rule.Window = defaultAlertWindow
+		if rule.Metric == metricRatingDrop {
+			rule.Window = defaultRatingDropWindow
+		}
+	}
+	if window, err := time.ParseDuration(rule.Window); err != nil || window <= 0 || window > maxAlertWindow {
+		return fmt.Errorf("invalid window %q: use a duration up to %s", rule.Window, maxAlertWindow)
+	}
+	if rule.WebhookURL == "" && len(rule.Emails) == 0 {
+		return fmt.Errorf("an alert rule needs a webhook_url or emails")
+	}
+	if rule.WebhookURL != "" {
+		if err := validateReceiverURL(rule.WebhookURL); err != nil {
+			return err
+		}
+		if rule.Secret == "" {
+			secret, err := newSecret()
+			if err != nil {
+				return err
+			}
+			rule.Secret = secret
+		}
+	}
+	if len(rule.Emails) > 0 && smtpAddr == "" {
+		return fmt.Errorf("emails require SMTP_ADDR")
+	}
+	for _, email := range rule.Emails {
+		if err := validateEmail(email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	if _, err := mail.ParseAddress(email); err != nil {
+		return fmt.Errorf("invalid email %q", email)
+	}
+	return nil
+}
+
+func (rule AlertRule) window() time.Duration {
+	window, _ := time.ParseDuration(rule.Window)
+	return window
+}
+
+func (rule AlertRule) silenced(now time.Time) bool {
+	return rule.SilencedUntil != nil && now.Before(*rule.SilencedUntil)
+}
+
+// appliesTo returns true if the rule is defined for the observable or one of its projects
+func (rule AlertRule) appliesTo(observable ObservableGooglePlay) bool {
+	return rule.PackageName == observable.PackageName || (rule.Project != "" && containsString(observable.Projects, rule.Project))
+}
+
+// EvaluateAlerts evaluates the alert rules of an app over its run history after a successful run and notifies alerts that fired or resolved
+func EvaluateAlerts(tenant string, packageName string, now time.Time) {
+	if db == nil {
+		return
+	}
+	observable, ok := ObservableOf(tenant, packageName)
+	if !ok {
+		return
+	}
+	runs := Runs(RunFilter{Tenant: tenant, PackageName: packageName, Status: runSucceeded})
+
+	var pending []pendingAlert
+	alertsMutex.Lock()
+	for _, rule := range AlertRules(tenant) {
+		if !rule.appliesTo(observable) {
+			continue
+		}
+		value, ok := evaluateMetric(rule, runs, now)
+		alert, known := AlertOf(rule, packageName)
+		if !known {
+			alert = Alert{RuleID: rule.ID, Tenant: tenant, PackageName: packageName, Status: alertResolved}
+		}
+		alert.EvaluatedAt = now
+		alert.Value = value
+
+		// Notified changes only once a notification was sent, failed notifications are sent again with the next run
+		firing := ok && value > rule.Threshold
+		notify := false
+		switch {
+		case firing && alert.Status != alertFiring:
+			alert.Status = alertFiring
+			alert.FiredAt = &now
+			alert.ResolvedAt = nil
+			alert.Notified = false
+			alert.NotifiedSinks = nil
+			notify = true
+		case firing && !alert.Notified:
+			notify = true
+		case !firing && alert.Status == alertFiring:
+			alert.Status = alertResolved
+			alert.ResolvedAt = &now
+			alert.NotifiedSinks = nil
+			notify = alert.Notified
+		case !firing && alert.Notified:
+			notify = true
+		}
+		if notify && !rule.silenced(now) {
+			pending = append(pending, pendingAlert{rule: rule, alert: alert})
+		}
+		if known || alert.Status == alertFiring {
+			SaveAlert(alert)
+		}
+	}
+	alertsMutex.Unlock()
+
+	// the sinks are called without holding the lock
+	for _, p := range pending {
+		sinks, err := notifyAlert(p.rule, p.alert)
+		if err != nil {
+			log.Printf("ERR could not notify alert %s of %s: %v\n", p.rule.Name, observableKey(tenant, packageName), err)
+		}
+		markNotified(p.rule, p.alert, sinks, err)
+	}
+}
+
+// pendingAlert is an alert to notify to the sinks of its rule
+type pendingAlert struct {
+	rule  AlertRule
+	alert Alert
+}
+
+// markNotified records the result of a notification of an alert and the sinks it was sent to, unless the alert was evaluated again meanwhile
+func markNotified(rule AlertRule, sent Alert, sinks []string, err error) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	alert, ok := AlertOf(rule, sent.PackageName)
+	if !ok || alert.Status != sent.Status || !alert.EvaluatedAt.Equal(sent.EvaluatedAt) {
+		return
+	}
+	alert.NotifiedSinks = append(alert.NotifiedSinks, sinks...)
+	alert.Error = ""
+	if err != nil {
+		alert.Error = err.Error()
+	} else {
+		alert.Notified = alert.Status == alertFiring
+	}
+	SaveAlert(alert)
+}
+
+// evaluateMetric returns the value of the metric of a rule over the successful runs of an app, newest first. Returns false if there is not enough data
+func evaluateMetric(rule AlertRule, runs []Run, now time.Time) (float64, bool) {
+	since := now.Add(-rule.window())
+
+	if rule.Metric == metricRatingDrop {
+		var latest, before float64
+		for _, run := range runs {
+			if run.PageRating == 0 || run.FinishedAt == nil {
+				continue
+			}
+			if latest == 0 {
+				latest = run.PageRating
+			}
+			if !run.FinishedAt.After(since) {
+				before = run.PageRating
+				break
+			}
+		}
+		return before - latest, latest != 0 && before != 0
+	}
+
+	var bugReports, featureRequests, newReviews, oneStar, classified int
+	for _, run := range runs {
+		if run.FinishedAt == nil || run.FinishedAt.Before(since) {
+			continue
+		}
+		bugReports += run.BugReports
+		featureRequests += run.FeatureRequests
+		newReviews += run.NewReviews
+		oneStar += run.OneStarReviews
+		classified += run.ClassifiedReviews
+	}
+	switch rule.Metric {
+	case metricBugReports:
+		return float64(bugReports), true
+	case metricFeatureRequests:
+		return float64(featureRequests), true
+	case metricNewReviews:
+		return float64(newReviews), true
+	case metricOneStarShare:
+		if classified == 0 {
+			return 0, false
+		}
+		return 100 * float64(oneStar) / float64(classified), true
+	}
+	return 0, false
+}
+
+// notifyAlert sends a firing or resolved alert to the webhook and the emails of its rule, unless they already received it.
+// Returns the sinks it was sent to
+func notifyAlert(rule AlertRule, alert Alert) ([]string, error) {
+	var sinks, errs []string
+	if rule.WebhookURL != "" && !containsString(alert.NotifiedSinks, alertSinkWebhook) {
+		if err := postAlert(rule, alert); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			sinks = append(sinks, alertSinkWebhook)
+		}
+	}
+	if len(rule.Emails) > 0 && !containsString(alert.NotifiedSinks, alertSinkEmails) {
+		if err := mailAlert(rule, alert); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			sinks = append(sinks, alertSinkEmails)
+		}
+	}
+	if len(errs) > 0 {
+		return sinks, errors.New(strings.Join(errs, "; "))
+	}
+	return sinks, nil
+}
+
+func postAlert(rule AlertRule, alert Alert) error {
+	secret := rule.Secret
+	rule.Secret = ""
+	payload, _ := json.Marshal(AlertNotification{Rule: rule, Alert: alert})
+	return postSigned(rule.WebhookURL, secret, payload)
+}
+
+func mailAlert(rule AlertRule, alert Alert) error {
+	subject := fmt.Sprintf("[%s] %s: %s of %s is %.2f (threshold %.2f)", strings.ToUpper(alert.Status), rule.Name, rule.Metric, alert.PackageName, alert.Value, rule.Threshold)
+	body := fmt.Sprintf("Rule: %s\r\nApp: %s\r\nMetric: %s over %s\r\nValue: %.2f\r\nThreshold: %.2f\r\nStatus: %s\r\n", rule.Name, alert.PackageName, rule.Metric, rule.Window, alert.Value, rule.Threshold, alert.Status)
+	return sendMail(rule.Emails, subject, "text/plain", []byte(body))
+}
+
+// sendMail sends a mail via SMTP_ADDR
+func sendMail(to []string, subject string, contentType string, body []byte) error {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", smtpFrom)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Content-Type: %s; charset=utf-8\r\n\r\n", contentType)
+	message.Write(body)
+
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, strings.Split(smtpAddr, ":")[0])
+	}
+	return smtp.SendMail(smtpAddr, auth, smtpFrom, to, message.Bytes())
+}
+
+// SaveAlertRule adds or updates an alert rule
+func SaveAlertRule(rule AlertRule) error {
+	return storePut(bucketAlertRules, observableKey(rule.Tenant, rule.ID), rule)
+}
+
+// AlertRuleOf returns an alert rule of a tenant
+func AlertRuleOf(tenant string, id string) (AlertRule, bool) {
+	var rule AlertRule
+	ok, err := storeGet(bucketAlertRules, observableKey(tenant, id), &rule)
+	if err != nil {
+		log.Printf("ERR could not load alert rule %s: %v\n", id, err)
+	}
+	return rule, ok && rule.Tenant == tenant
+}
+
+// AlertRules returns all alert rules of a tenant
+func AlertRules(tenant string) []AlertRule {
+	rules := []AlertRule{}
+	if db == nil {
+		return rules
+	}
+	err := storeForEach(bucketAlertRules, func(key string, data []byte) error {
+		var rule AlertRule
+		if err := json.Unmarshal(data, &rule); err != nil {
+			return err
+		}
+		if rule.Tenant == tenant {
+			rules = append(rules, rule)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the alert rules: %v\n", err)
+	}
+	return rules
+}
+
+// SilenceAlertRule silences the notifications of a rule until the given time, nil ends the silence
+func SilenceAlertRule(tenant string, id string, until *time.Time) (AlertRule, error) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+	rule, ok := AlertRuleOf(tenant, id)
+	if !ok {
+		return rule, errUnknownAlertRule
+	}
+	rule.SilencedUntil = until
+	return rule, SaveAlertRule(rule)
+}
+
+func alertKey(tenant string, ruleID string, packageName string) string {
+	return observableKey(tenant, ruleID+"/"+packageName)
+}
+
+// SaveAlert adds or updates the alert of a rule for an app
+func SaveAlert(alert Alert) {
+	if err := storePut(bucketAlerts, alertKey(alert.Tenant, alert.RuleID, alert.PackageName), alert); err != nil {
+		log.Printf("ERR could not save alert %s of %s: %v\n", alert.RuleID, alert.PackageName, err)
+	}
+}
+
+// AlertOf returns the alert of a rule for an app
+func AlertOf(rule AlertRule, packageName string) (Alert, bool) {
+	var alert Alert
+	ok, err := storeGet(bucketAlerts, alertKey(rule.Tenant, rule.ID, packageName), &alert)
+	if err != nil {
+		log.Printf("ERR could not load alert %s: %v\n", alertKey(rule.Tenant, rule.ID, packageName), err)
+	}
+	return alert, ok
+}
+
+// Alerts returns the alerts of a tenant, optionally only those of a rule or with a status
+func Alerts(tenant string, ruleID string, status string) []Alert {
+	alerts := []Alert{}
+	if db == nil {
+		return alerts
+	}
+	err := storeForEach(bucketAlerts, func(key string, data []byte) error {
+		var alert Alert
+		if err := json.Unmarshal(data, &alert); err != nil {
+			return err
+		}
+		if alert.Tenant == tenant && (ruleID == "" || alert.RuleID == ruleID) && (status == "" || alert.Status == status) {
+			alerts = append(alerts, alert)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the alerts: %v\n", err)
+	}
+	return alerts
+}
+
+// postAlertRule creates an alert rule. The response contains the secret of its webhook, which is not shown again
+func postAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var rule AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondBadRequest(w, fmt.Errorf("invalid alert rule: %v", err))
+		return
+	}
+	rule.SilencedUntil = nil
+	if err := ValidateAlertRule(&rule); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	now := time.Now()
+	rule.ID = newRunID(now)
+	rule.Tenant = tenantOf(r)
+	rule.CreatedAt = now
+	if err := SaveAlertRule(rule); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// getAlertRules returns all alert rules without their secrets
+func getAlertRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rules := AlertRules(tenantOf(r))
+	for i := range rules {
+		rules[i].Secret = ""
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rules)
+}
+
+// getAlertRule returns a single alert rule without its secret
+func getAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rule, ok := AlertRuleOf(tenantOf(r), mux.Vars(r)["rule_id"])
+	if !ok {
+		respondUnknownAlertRule(w)
+		return
+	}
+	rule.Secret = ""
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// deleteAlertRule deletes an alert rule and its alerts
+func deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rule, ok := AlertRuleOf(tenantOf(r), mux.Vars(r)["rule_id"])
+	if !ok {
+		respondUnknownAlertRule(w)
+		return
+	}
+	for _, alert := range Alerts(rule.Tenant, rule.ID, "") {
+		if err := storeDelete(bucketAlerts, alertKey(rule.Tenant, rule.ID, alert.PackageName)); err != nil {
+			log.Printf("ERR could not delete alert %s: %v\n", alertKey(rule.Tenant, rule.ID, alert.PackageName), err)
+		}
+	}
+	if err := storeDelete(bucketAlertRules, observableKey(rule.Tenant, rule.ID)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{Status: true, Message: "alert rule deleted"})
+}
+
+// postSilenceAlertRule silences the notifications of a rule. Query parameter: for (duration, e.g. 2h) or until (RFC 3339)
+func postSilenceAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	var until time.Time
+	switch {
+	case query.Get("for") != "":
+		duration, err := time.ParseDuration(query.Get("for"))
+		if err != nil || duration <= 0 {
+			respondBadRequest(w, fmt.Errorf("invalid for %q: use a positive duration", query.Get("for")))
+			return
+		}
+		until = time.Now().Add(duration)
+	case query.Get("until") != "":
+		t, err := time.Parse(time.RFC3339, query.Get("until"))
+		if err != nil || !t.After(time.Now()) {
+			respondBadRequest(w, fmt.Errorf("invalid until %q: use a future time in RFC 3339", query.Get("until")))
+			return
+		}
+		until = t
+	default:
+		respondBadRequest(w, fmt.Errorf("query parameter for or until is required"))
+		return
+	}
+	silenceAlertRule(w, r, &until)
+}
+
+// deleteSilenceAlertRule ends the silence of a rule. Alerts that fired meanwhile are notified with the next evaluation
+func deleteSilenceAlertRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	silenceAlertRule(w, r, nil)
+}
+
+func silenceAlertRule(w http.ResponseWriter, r *http.Request, until *time.Time) {
+	rule, err := SilenceAlertRule(tenantOf(r), mux.Vars(r)["rule_id"], until)
+	switch err {
+	case nil:
+		rule.Secret = ""
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rule)
+	case errUnknownAlertRule:
+		respondUnknownAlertRule(w)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+	}
+}
+
+// getAlerts returns the alerts of the tenant. Query parameters: rule_id, status (firing or resolved), project, tag
+func getAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	packageNames := packageNamesOf(observableFilterOf(r))
+	alerts := []Alert{}
+	for _, alert := range Alerts(tenantOf(r), r.URL.Query().Get("rule_id"), r.URL.Query().Get("status")) {
+		if matchesPackageNames(packageNames, alert.PackageName) {
+			alerts = append(alerts, alert)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func respondUnknownAlertRule(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(Response{Status: false, Message: errUnknownAlertRule.Error()})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpStub is a local SMTP server that accepts every mail
+type smtpStub struct {
+	sync.Mutex
+	listener net.Listener
+	mails    []string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &smtpStub{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost stub")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.mails = append(s.mails, string(data))
+			s.Unlock()
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *smtpStub) received() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.mails...)
+}
+
+func TestAlerts(t *testing.T) {
+	induceServerError = false
+	stub := newSMTPStub(t)
+	defer stub.listener.Close()
+	defer func(addr string, from string) { smtpAddr, smtpFrom = addr, from }(smtpAddr, smtpFrom)
+	smtpAddr, smtpFrom = stub.listener.Addr().String(), "orchestrator@example.com"
+
+	var rule AlertRule
+	var notifications []AlertNotification
+	var notificationsMutex sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification AlertNotification
+		json.NewDecoder(bufio.NewReader(r.Body)).Decode(&notification)
+		notificationsMutex.Lock()
+		notifications = append(notifications, notification)
+		notificationsMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	rules := endpoint{method: "POST", url: "/hitec/orchestration/app/alerts/rules"}
+	assertStatus(t, http.StatusBadRequest, rules.mustExecuteRequest(AlertRule{Name: "crashes", PackageName: "com.alerts.app", Metric: "crashes", Emails: []string{"team@example.com"}}))
+	assertStatus(t, http.StatusBadRequest, rules.mustExecuteRequest(AlertRule{Name: "crashes", PackageName: "com.alerts.app", Project: "alerting", Metric: metricBugReports, Emails: []string{"team@example.com"}}))
+	assertStatus(t, http.StatusBadRequest, rules.mustExecuteRequest(AlertRule{Name: "crashes", PackageName: "com.alerts.app", Metric: metricBugReports}))
+	assertStatus(t, http.StatusBadRequest, rules.mustExecuteRequest(AlertRule{Name: "crashes", PackageName: "com.alerts.app", Metric: metricBugReports, Window: "forever", Emails: []string{"team@example.com"}}))
+
+	rr := rules.mustExecuteRequest(AlertRule{Name: "crashes", PackageName: "com.alerts.app", Metric: metricBugReports, Threshold: 1, WebhookURL: receiver.URL, Emails: []string{"team@example.com"}})
+	assertStatus(t, http.StatusCreated, rr)
+	json.NewDecoder(rr.Body).Decode(&rule)
+	var silencedRule AlertRule
+	rr = rules.mustExecuteRequest(AlertRule{Name: "unhappy", Project: "alerting", Metric: metricOneStarShare, Threshold: 10, Emails: []string{"team@example.com"}})
+	assertStatus(t, http.StatusCreated, rr)
+	json.NewDecoder(rr.Body).Decode(&silencedRule)
+	silence := endpoint{method: "POST", url: "/hitec/orchestration/app/alerts/rules/" + silencedRule.ID + "/silence?%s"}
+	assertStatus(t, http.StatusBadRequest, silence.withVars("for=-1h").mustExecuteRequest(nil))
+	assertSuccess(t, silence.withVars("for=1h").mustExecuteRequest(nil))
+
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.alerts.app/interval/daily?project=alerting"}.mustExecuteRequest(nil))
+	if run := runNow(t, "com.alerts.app"); run.BugReports != 2 || run.OneStarReviews != 1 {
+		t.Errorf("Expected the signals of the run. Got %+v instead", run)
+	}
+	runNow(t, "com.alerts.app")
+	if mails := stub.received(); len(mails) != 1 || !strings.Contains(mails[0], "Subject: [FIRING] crashes: bug_reports of com.alerts.app is 2.00") {
+		t.Errorf("Expected a single mail of the firing alert. Got %v instead", mails)
+	}
+	notificationsMutex.Lock()
+	if len(notifications) != 1 || notifications[0].Alert.Status != alertFiring || notifications[0].Rule.Secret != "" {
+		t.Errorf("Expected a single notification of the firing alert. Got %+v instead", notifications)
+	}
+	notificationsMutex.Unlock()
+
+	assertSuccess(t, endpoint{method: "DELETE", url: "/hitec/orchestration/app/alerts/rules/" + silencedRule.ID + "/silence"}.mustExecuteRequest(nil))
+	runNow(t, "com.alerts.app")
+	if mails := stub.received(); len(mails) != 2 || !strings.Contains(mails[1], "[FIRING] unhappy") {
+		t.Errorf("Expected the alert of the silenced rule to be mailed after the silence. Got %v instead", mails)
+	}
+
+	var alerts []Alert
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/alerts?status=firing"}.mustExecuteRequest(nil).Body).Decode(&alerts)
+	if len(alerts) != 2 || !alerts[0].Notified || !alerts[1].Notified {
+		t.Errorf("Expected both alerts to fire. Got %+v instead", alerts)
+	}
+
+	assertSuccess(t, endpoint{method: "DELETE", url: "/hitec/orchestration/app/alerts/rules/" + rule.ID}.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/alerts/rules/" + rule.ID}.mustExecuteRequest(nil))
+}
+
+func TestAlertNotificationRetry(t *testing.T) {
+	induceServerError = false
+	var deliveries int
+	var deliveriesMutex sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveriesMutex.Lock()
+		defer deliveriesMutex.Unlock()
+		if deliveries++; deliveries == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	assertStatus(t, http.StatusCreated, endpoint{method: "POST", url: "/hitec/orchestration/app/alerts/rules"}.mustExecuteRequest(AlertRule{Name: "retry", PackageName: "com.alerts.retry", Metric: metricBugReports, Threshold: 0, WebhookURL: receiver.URL}))
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.alerts.retry/interval/daily"}.mustExecuteRequest(nil))
+
+	alertOf := func() Alert {
+		var alerts []Alert
+		json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/alerts?status=firing"}.mustExecuteRequest(nil).Body).Decode(&alerts)
+		for _, alert := range alerts {
+			if alert.PackageName == "com.alerts.retry" {
+				return alert
+			}
+		}
+		return Alert{}
+	}
+	runNow(t, "com.alerts.retry")
+	if alert := alertOf(); alert.Notified || alert.Error == "" {
+		t.Errorf("Expected the failed notification to be recorded. Got %+v instead", alert)
+	}
+	runNow(t, "com.alerts.retry")
+	if alert := alertOf(); !alert.Notified || alert.Error != "" {
+		t.Errorf("Expected the notification to be retried with the next run. Got %+v instead", alert)
+	}
+	deliveriesMutex.Lock()
+	defer deliveriesMutex.Unlock()
+	if deliveries != 2 {
+		t.Errorf("Expected 2 deliveries. Got %d instead", deliveries)
+	}
+}
+
+func TestAlertNotificationPerSink(t *testing.T) {
+	induceServerError = false
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable.Close()
+	defer func(addr string, from string) { smtpAddr, smtpFrom = addr, from }(smtpAddr, smtpFrom)
+	smtpAddr, smtpFrom = unreachable.Addr().String(), "orchestrator@example.com"
+
+	var deliveries int
+	var deliveriesMutex sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveriesMutex.Lock()
+		deliveries++
+		deliveriesMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	rules := endpoint{method: "POST", url: "/hitec/orchestration/app/alerts/rules"}
+	assertStatus(t, http.StatusBadRequest, rules.mustExecuteRequest(AlertRule{Name: "sinks\r\nBcc: attacker@example.com", PackageName: "com.alerts.sinks", Metric: metricBugReports, Emails: []string{"team@example.com"}}))
+	assertStatus(t, http.StatusCreated, rules.mustExecuteRequest(AlertRule{Name: "sinks", PackageName: "com.alerts.sinks", Metric: metricBugReports, Threshold: 0, WebhookURL: receiver.URL, Emails: []string{"team@example.com"}}))
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.alerts.sinks/interval/daily"}.mustExecuteRequest(nil))
+
+	runNow(t, "com.alerts.sinks")
+	stub := newSMTPStub(t)
+	defer stub.listener.Close()
+	smtpAddr = stub.listener.Addr().String()
+	runNow(t, "com.alerts.sinks")
+
+	var alerts []Alert
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/alerts?status=firing"}.mustExecuteRequest(nil).Body).Decode(&alerts)
+	for _, alert := range alerts {
+		if alert.PackageName == "com.alerts.sinks" && (!alert.Notified || len(alert.NotifiedSinks) != 2) {
+			t.Errorf("Expected the alert to be notified to both sinks. Got %+v instead", alert)
+		}
+	}
+	if mails := stub.received(); len(mails) != 1 {
+		t.Errorf("Expected the failed mail to be sent again. Got %v instead", mails)
+	}
+	deliveriesMutex.Lock()
+	defer deliveriesMutex.Unlock()
+	if deliveries != 1 {
+		t.Errorf("Expected the webhook to be notified once. Got %d deliveries instead", deliveries)
+	}
+}
+
+func TestEvaluateRatingDrop(t *testing.T) {
+	now := time.Now()
+	for i, snapshot := range []struct {
+		age    time.Duration
+		rating float64
+	}{{8 * 24 * time.Hour, 4.5}, {24 * time.Hour, 4.4}, {0, 4.2}} {
+		finishedAt := now.Add(-snapshot.age)
+		SaveRun(Run{ID: newRunID(finishedAt), PackageName: "com.alerts.rating", Status: runSucceeded, FinishedAt: &finishedAt, RunResult: RunResult{PageRating: snapshot.rating}})
+		if i == 0 {
+			if _, ok := evaluateMetric(AlertRule{Metric: metricRatingDrop, Window: "168h"}, Runs(RunFilter{PackageName: "com.alerts.rating"}), now.Add(-snapshot.age)); ok {
+				t.Error("Expected no rating drop without a rating of the week before")
+			}
+		}
+	}
+	drop, ok := evaluateMetric(AlertRule{Metric: metricRatingDrop, Window: "168h"}, Runs(RunFilter{PackageName: "com.alerts.rating"}), now)
+	if !ok || drop < 0.29 || drop > 0.31 {
+		t.Errorf("Expected a drop of 0.3 week over week. Got %v", drop)
+	}
+}
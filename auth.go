@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * Authentication and authorization of inbound requests.
+ *
+ * Clients authenticate either with an API key (header X-API-Key) or a JWT bearer token that is validated against
+ * a local JWKS file. Every identity has one of the roles viewer, operator (can trigger runs) or admin (can manage observables)
+ * and belongs to a tenant if multi-tenancy is enabled (see tenant.go).
+ * Authentication is disabled if neither API_KEYS_FILE nor JWKS_FILE is set.
+ */
+
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+
+	headerAPIKey = "X-API-Key"
+)
+
+var roleLevels = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+	roleAdmin:    3,
+}
+
+// Identity of an authenticated client
+type Identity struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// APIKey model of the API_KEYS_FILE
+type APIKey struct {
+	Name   string `json:"name"`
+	Key    string `json:"key"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// JWK model of a single key of the JWKS_FILE
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Authenticator validates the credentials of inbound requests
+type Authenticator struct {
+	apiKeys  []APIKey
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// authenticator is nil if authentication is disabled
+var authenticator *Authenticator
+
+type contextKey string
+
+const identityContextKey = contextKey("identity")
+
+// LoadAuthenticator configures the authentication from the environment (API_KEYS_FILE, JWKS_FILE, JWT_ISSUER, JWT_AUDIENCE)
+func LoadAuthenticator() error {
+	apiKeysFile := os.Getenv("API_KEYS_FILE")
+	jwksFile := os.Getenv("JWKS_FILE")
+	if apiKeysFile == "" && jwksFile == "" {
+		fmt.Println("WARNING authentication is disabled, set API_KEYS_FILE or JWKS_FILE to enable it")
+		return nil
+	}
+
+	a, err := NewAuthenticator(apiKeysFile, jwksFile, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+	if err != nil {
+		return err
+	}
+	authenticator = a
+	return nil
+}
+
+// NewAuthenticator reads the API keys and the JWKS. Both files are optional
+func NewAuthenticator(apiKeysFile string, jwksFile string, issuer string, audience string) (*Authenticator, error) {
+	a := &Authenticator{keys: map[string]crypto.PublicKey{}, issuer: issuer, audience: audience}
+
+	if apiKeysFile != "" {
+		data, err := ioutil.ReadFile(apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &a.apiKeys); err != nil {
+			return nil, fmt.Errorf("invalid API keys file: %v", err)
+		}
+		for _, apiKey := range a.apiKeys {
+			if _, ok := roleLevels[apiKey.Role]; !ok || apiKey.Key == "" {
+				return nil, fmt.Errorf("invalid API key %q: needs a key and one of the roles viewer, operator, admin", apiKey.Name)
+			}
+		}
+	}
+
+	if jwksFile != "" {
+		data, err := ioutil.ReadFile(jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		var jwks struct {
+			Keys []JWK `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &jwks); err != nil {
+			return nil, fmt.Errorf("invalid JWKS file: %v", err)
+		}
+		for _, jwk := range jwks.Keys {
+			key, err := jwk.publicKey()
+			if err != nil {
+				return nil, fmt.Errorf("invalid JWK %q: %v", jwk.Kid, err)
+			}
+			a.keys[jwk.Kid] = key
+		}
+	}
+
+	return a, nil
+}
+
+func (jwk JWK) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Authenticate returns the identity of the request, nil if it carries no credentials
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if key := r.Header.Get(headerAPIKey); key != "" {
+		return a.authenticateAPIKey(key)
+	}
+
+	authorization := r.Header.Get(AUTHORIZATION)
+	if authorization == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, errors.New("unsupported authorization scheme")
+	}
+	return a.authenticateJWT(strings.TrimPrefix(authorization, "Bearer "))
+}
+
+func (a *Authenticator) authenticateAPIKey(key string) (*Identity, error) {
+	for _, apiKey := range a.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(apiKey.Key), []byte(key)) == 1 {
+			return &Identity{Name: apiKey.Name, Role: apiKey.Role, Tenant: apiKey.Tenant}, nil
+		}
+	}
+	return nil, errors.New("invalid API key")
+}
+
+func (a *Authenticator) authenticateJWT(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	key, ok := a.keys[header.Kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("invalid token signature")
+		}
+	}
+
+	var claims struct {
+		Subject   string          `json:"sub"`
+		Issuer    string          `json:"iss"`
+		Audience  json.RawMessage `json:"aud"`
+		ExpiresAt int64           `json:"exp"`
+		NotBefore int64           `json:"nbf"`
+		Role      string          `json:"role"`
+		Roles     []string        `json:"roles"`
+		Tenant    string          `json:"tenant"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, errors.New("invalid token issuer")
+	}
+	if a.audience != "" && !containsAudience(claims.Audience, a.audience) {
+		return nil, errors.New("invalid token audience")
+	}
+
+	identity := &Identity{Name: claims.Subject, Tenant: claims.Tenant}
+	for _, role := range append(claims.Roles, claims.Role) {
+		if roleLevels[role] > roleLevels[identity.Role] {
+			identity.Role = role
+		}
+	}
+	if identity.Role == "" {
+		return nil, errors.New("token grants no role")
+	}
+	return identity, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func containsAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var multiple []string
+	if json.Unmarshal(raw, &multiple) == nil {
+		for _, a := range multiple {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authMiddleware authenticates the request and adds the identity to its context.
+// Requests without credentials pass as anonymous, requireRole rejects them where needed
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authenticator == nil {
+			identity := &Identity{Name: "anonymous", Role: roleAdmin}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, identity)))
+			return
+		}
+
+		identity, err := authenticator.Authenticate(r)
+		if err != nil {
+			respondUnauthorized(w, err.Error())
+			return
+		}
+		if identity != nil {
+			r = r.WithContext(context.WithValue(r.Context(), identityContextKey, identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRole only passes requests of identities that have at least the given role
+func requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := IdentityOf(r)
+		if identity == nil {
+			respondUnauthorized(w, "authentication required")
+			return
+		}
+		if roleLevels[identity.Role] < roleLevels[role] {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(Response{Status: false, Message: fmt.Sprintf("role %s required", role)})
+			return
+		}
+		if _, ok := TenantOf(identity.Tenant); !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(Response{Status: false, Message: "unknown tenant"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// IdentityOf returns the identity of an authenticated request, nil otherwise
+func IdentityOf(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityContextKey).(*Identity)
+	return identity
+}
+
+func respondUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="ri-orchestration-app"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(Response{Status: false, Message: message})
+}
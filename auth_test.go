@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func setupTestAuthenticator(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []JWK{{
+		Kty: "RSA",
+		Kid: "test",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	apiKeys, _ := json.Marshal([]APIKey{
+		{Name: "dashboard", Key: "viewer-key", Role: roleViewer},
+		{Name: "ci", Key: "operator-key", Role: roleOperator},
+	})
+
+	jwksFile := filepath.Join(storeDir, "jwks.json")
+	apiKeysFile := filepath.Join(storeDir, "api_keys.json")
+	ioutil.WriteFile(jwksFile, jwks, 0600)
+	ioutil.WriteFile(apiKeysFile, apiKeys, 0600)
+
+	authenticator, err = NewAuthenticator(apiKeysFile, jwksFile, "openreq", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAuthentication(t *testing.T) {
+	induceServerError = false
+	key := setupTestAuthenticator(t)
+	defer func() { authenticator = nil }()
+
+	observe := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.whatsapp/interval/daily"}
+	process := endpoint{method: "POST", url: "/hitec/orchestration/app/process/google-play/package-name/eu.openreq"}
+	ready := endpoint{method: "GET", url: "/hitec/orchestration/app/health/ready"}
+
+	assertStatus(t, http.StatusUnauthorized, observe.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusUnauthorized, observe.withHeader(headerAPIKey, "unknown").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusForbidden, process.withHeader(headerAPIKey, "viewer-key").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusAccepted, process.withHeader(headerAPIKey, "operator-key").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusForbidden, observe.withHeader(headerAPIKey, "operator-key").mustExecuteRequest(nil))
+	if rr := ready.mustExecuteRequest(nil); rr.Code == http.StatusUnauthorized {
+		t.Error("Expected the readiness to be public")
+	}
+
+	valid := signTestToken(t, key, map[string]interface{}{"sub": "alice", "iss": "openreq", "roles": []string{"viewer", "admin"}, "exp": time.Now().Add(time.Hour).Unix()})
+	assertStatus(t, http.StatusOK, observe.withHeader(AUTHORIZATION, "Bearer "+valid).mustExecuteRequest(nil))
+
+	expired := signTestToken(t, key, map[string]interface{}{"sub": "alice", "iss": "openreq", "role": "admin", "exp": time.Now().Add(-time.Minute).Unix()})
+	assertStatus(t, http.StatusUnauthorized, observe.withHeader(AUTHORIZATION, "Bearer "+expired).mustExecuteRequest(nil))
+
+	foreignIssuer := signTestToken(t, key, map[string]interface{}{"sub": "alice", "iss": "other", "role": "admin", "exp": time.Now().Add(time.Hour).Unix()})
+	assertStatus(t, http.StatusUnauthorized, observe.withHeader(AUTHORIZATION, "Bearer "+foreignIssuer).mustExecuteRequest(nil))
+
+	tampered := valid[:len(valid)-4] + "AAAA"
+	assertStatus(t, http.StatusUnauthorized, observe.withHeader(AUTHORIZATION, "Bearer "+tampered).mustExecuteRequest(nil))
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * bulk import and export of observables as JSON or CSV. In CSV files, projects and tags are separated by semicolons.
+ *
+ * An import is validated completely before anything is applied. If a single row is invalid, nothing is applied.
+ * Valid rows are stored in the storage layer one by one. If a row cannot be stored, the rows stored before it are rolled
+ * back: created observables are deleted from the storage layer, updated ones get their previous interval again. Otherwise
+ * the reconcile would observe them with the next reload, without their settings. Rows are only applied to the
+ * orchestrator if every row could be stored. Applied rows are scheduled with a single reload of the observation.
+ */
+
+const (
+	maxImportBytes = 1 << 20
+	maxImportRows  = 10000
+
+	formatJSON = "json"
+	formatCSV  = "csv"
+
+	importCreated    = "created"
+	importUpdated    = "updated"
+	importInvalid    = "invalid"
+	importStored     = "stored"
+	importRolledBack = "rolled_back"
+	importFailed     = "failed"
+	importSkipped    = "skipped"
+)
+
+var csvColumns = []string{"package_name", "interval", "time_zone", "jitter", "catch_up", "min_interval", "max_interval", "projects", "tags"}
+
+// parseImport reads the observables of a JSON list or a CSV file with a header row
+func parseImport(r io.Reader, format string) ([]ObservableGooglePlay, error) {
+	var observables []ObservableGooglePlay
+	if format == formatJSON {
+		if err := json.NewDecoder(r).Decode(&observables); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		return observables, nil
+	}
+
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: missing header row")
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !containsString(csvColumns, column) {
+			return nil, fmt.Errorf("invalid CSV: unknown column %q, use %s", column, strings.Join(csvColumns, ", "))
+		}
+		columns[column] = i
+	}
+	if _, ok := columns["package_name"]; !ok {
+		return nil, fmt.Errorf("invalid CSV: missing column package_name")
+	}
+	if _, ok := columns["interval"]; !ok {
+		return nil, fmt.Errorf("invalid CSV: missing column interval")
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		observables = append(observables, ObservableGooglePlay{
+			PackageName: value("package_name"),
+			Interval:    value("interval"),
+			TimeZone:    value("time_zone"),
+			Jitter:      value("jitter"),
+			CatchUp:     value("catch_up"),
+			MinInterval: value("min_interval"),
+			MaxInterval: value("max_interval"),
+			Projects:    splitLabels(value("projects")),
+			Tags:        splitLabels(value("tags")),
+		})
+	}
+	return observables, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateImport checks every row. Returns false if at least one row is invalid
+func validateImport(tenant string, observables []ObservableGooglePlay) ([]ImportRowReport, bool) {
+	reports := make([]ImportRowReport, len(observables))
+	seen := map[string]int{}
+	valid := true
+	for i, observable := range observables {
+		reports[i] = ImportRowReport{Row: i + 1, PackageName: observable.PackageName, Interval: observable.Interval, Status: importCreated}
+		if _, ok := ObservableOf(tenant, observable.PackageName); ok {
+			reports[i].Status = importUpdated
+		}
+
+		err := ValidatePackageName(observable.PackageName)
+		if err == nil {
+			_, err = ScheduleOf(observable)
+		}
+		if err == nil {
+			err = ValidateCatchUpPolicy(observable)
+		}
+		if err == nil {
+			err = ValidateLabels(observable)
+		}
+		if err == nil {
+			if row, ok := seen[observable.PackageName]; ok {
+				err = fmt.Errorf("duplicate of row %d", row)
+			}
+		}
+		seen[observable.PackageName] = i + 1
+
+		if err != nil {
+			reports[i].Status = importInvalid
+			reports[i].Message = err.Error()
+			valid = false
+		}
+	}
+	return reports, valid
+}
+
+// rollbackImport undoes the rows of an import the storage layer accepted before a row failed. Rows that cannot be rolled back stay stored
+func rollbackImport(tenant *Tenant, observables []ObservableGooglePlay, rows []ImportRowReport) {
+	for i, observable := range observables {
+		var ok bool
+		switch rows[i].Status {
+		case importCreated:
+			ok = RESTDeleteObservableGooglePlay(tenant, observable.PackageName)
+		case importUpdated:
+			previous, _ := ObservableOf(tenant.ID, observable.PackageName)
+			ok = RESTPostStoreObserveAppGooglePlay(tenant, observable.PackageName, previous.Interval)
+		default:
+			continue
+		}
+		if ok {
+			rows[i].Status = importRolledBack
+			rows[i].Message = "rolled back in the storage layer"
+		} else {
+			rows[i].Status = importStored
+			rows[i].Message = "accepted by the storage layer, the rollback failed"
+		}
+	}
+}
+
+// ImportObservables validates and applies the observables of a tenant. Returns the report of each row and whether the import was applied
+func ImportObservables(tenant *Tenant, observables []ObservableGooglePlay) ImportReport {
+	rows, valid := validateImport(tenant.ID, observables)
+	report := ImportReport{Rows: rows}
+	if !valid {
+		for i := range report.Rows {
+			if report.Rows[i].Status != importInvalid {
+				report.Rows[i].Status = importSkipped
+			}
+		}
+		return report
+	}
+
+	stored := true
+	for i, observable := range observables {
+		if !stored {
+			report.Rows[i].Status = importSkipped
+			continue
+		}
+		if ok := RESTPostStoreObserveAppGooglePlay(tenant, observable.PackageName, observable.Interval); !ok {
+			report.Rows[i].Status = importFailed
+			report.Rows[i].Message = "storage layer unreachable"
+			stored = false
+		}
+	}
+	if !stored {
+		rollbackImport(tenant, observables, report.Rows)
+		return report
+	}
+
+	now := time.Now()
+	for _, imported := range observables {
+		observable, _ := ObservableOf(tenant.ID, imported.PackageName)
+		if observable.ObservedSince == nil {
+			observable.ObservedSince = &now
+		}
+		observable.Tenant = tenant.ID
+		observable.PackageName = imported.PackageName
+		observable.Interval = imported.Interval
+		observable.TimeZone = imported.TimeZone
+		observable.Jitter = imported.Jitter
+		observable.CatchUp = imported.CatchUp
+		observable.MinInterval = imported.MinInterval
+		observable.MaxInterval = imported.MaxInterval
+		observable.Projects = normalizeLabels(imported.Projects)
+		observable.Tags = normalizeLabels(imported.Tags)
+		if !isAdaptive(observable) {
+			observable.Adaptive = nil
+		}
+		RememberObservable(observable)
+	}
+	EnsureObservation()
+
+	report.Applied = true
+	return report
+}
+
+// ExportObservables returns the observables of a tenant matching the filter. The tenant is left out, so the export can be imported into another tenant
+func ExportObservables(filter ObservableFilter) []ObservableGooglePlay {
+	observables := []ObservableGooglePlay{}
+	for _, status := range ObservableStatuses(filter) {
+		status.Tenant = defaultTenant
+		observables = append(observables, status.ObservableGooglePlay)
+	}
+	return observables
+}
+
+func writeCSV(w io.Writer, observables []ObservableGooglePlay) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, o := range observables {
+		if err := writer.Write([]string{o.PackageName, o.Interval, o.TimeZone, o.Jitter, o.CatchUp, o.MinInterval, o.MaxInterval, strings.Join(o.Projects, ";"), strings.Join(o.Tags, ";")}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// formatOf returns csv or json depending on the query parameter format or the given header (Content-Type or Accept)
+func formatOf(r *http.Request, header string) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	if strings.Contains(r.Header.Get(header), "csv") {
+		return formatCSV
+	}
+	return formatJSON
+}
+
+// postImportObservables imports a JSON list or CSV file of observables (see ImportObservables)
+func postImportObservables(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	format := formatOf(r, "Content-Type")
+	if format != formatJSON && format != formatCSV {
+		respondBadRequest(w, fmt.Errorf("unsupported format %q, use json or csv", format))
+		return
+	}
+
+	observables, err := parseImport(http.MaxBytesReader(w, r.Body, maxImportBytes), format)
+	if err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	if len(observables) == 0 || len(observables) > maxImportRows {
+		respondBadRequest(w, fmt.Errorf("import must contain between 1 and %d observables", maxImportRows))
+		return
+	}
+
+	tenant, _ := TenantOf(tenantOf(r))
+	report := ImportObservables(tenant, observables)
+	switch {
+	case report.Applied:
+		w.WriteHeader(http.StatusOK)
+	case hasRowStatus(report, importInvalid):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func hasRowStatus(report ImportReport, status string) bool {
+	for _, row := range report.Rows {
+		if row.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// getExportObservables exports all observables as JSON or CSV (query parameter format or Accept header). Query parameters: project, tag
+func getExportObservables(w http.ResponseWriter, r *http.Request) {
+	observables := ExportObservables(observableFilterOf(r))
+	switch formatOf(r, "Accept") {
+	case formatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="observables.csv"`)
+		w.WriteHeader(http.StatusOK)
+		writeCSV(w, observables)
+	case formatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(observables)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		respondBadRequest(w, fmt.Errorf("unsupported format, use json or csv"))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestImportObservables(t *testing.T) {
+	induceServerError = false
+	ep := endpoint{method: "POST", url: "/hitec/orchestration/app/observables/import"}
+
+	csv := []byte("package_name,interval,time_zone\ncom.bulk.one,daily,Europe/Berlin\ncom.bulk.two,0 6 * * 1,\n")
+	rr := ep.withHeader("Content-Type", "text/csv").mustExecuteRequest(csv)
+	assertSuccess(t, rr)
+	var report ImportReport
+	json.NewDecoder(rr.Body).Decode(&report)
+	if !report.Applied || len(report.Rows) != 2 || report.Rows[0].Status != importCreated {
+		t.Errorf("Expected both rows to be created. Got %+v instead", report)
+	}
+	if observable, ok := ObservableOf(defaultTenant, "com.bulk.one"); !ok || observable.TimeZone != "Europe/Berlin" {
+		t.Errorf("Expected the imported observable to be scheduled. Got %+v instead", observable)
+	}
+
+	rr = ep.mustExecuteRequest([]ObservableGooglePlay{
+		{PackageName: "com.bulk.one", Interval: "weekly"},
+		{PackageName: "com.bulk.three", Interval: "every-day"},
+		{PackageName: "com.bulk.one", Interval: "daily"},
+	})
+	assertStatus(t, http.StatusBadRequest, rr)
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Applied || report.Rows[0].Status != importSkipped || report.Rows[1].Status != importInvalid || report.Rows[2].Status != importInvalid {
+		t.Errorf("Expected the invalid rows to be reported and nothing to be applied. Got %+v instead", report)
+	}
+	if observable, _ := ObservableOf(defaultTenant, "com.bulk.one"); observable.Interval != "daily" {
+		t.Errorf("Expected the observable to be unchanged. Got %+v instead", observable)
+	}
+
+	induceServerError = true
+	rr = ep.mustExecuteRequest([]ObservableGooglePlay{{PackageName: "com.bulk.four", Interval: "daily"}})
+	induceServerError = false
+	assertStatus(t, http.StatusBadGateway, rr)
+	if _, ok := ObservableOf(defaultTenant, "com.bulk.four"); ok {
+		t.Error("Expected nothing to be applied if the storage layer is unreachable")
+	}
+
+	// the rows stored before a failing row are rolled back
+	rr = ep.mustExecuteRequest([]ObservableGooglePlay{{PackageName: "com.bulk.five", Interval: "daily"}, {PackageName: "com.bulk.one", Interval: "weekly"}, {PackageName: "org.unstorable", Interval: "daily"}})
+	assertStatus(t, http.StatusBadGateway, rr)
+	json.NewDecoder(rr.Body).Decode(&report)
+	if report.Rows[0].Status != importRolledBack || report.Rows[1].Status != importRolledBack || report.Rows[2].Status != importFailed {
+		t.Errorf("Expected the stored rows to be rolled back. Got %+v instead", report)
+	}
+	storageObservables.Lock()
+	for _, observables := range storageObservables.m {
+		if interval, ok := observables["com.bulk.one"]; observables["com.bulk.five"] != "" || (ok && interval != "daily") {
+			t.Errorf("Expected the storage layer to be rolled back. Got %v instead", observables)
+		}
+	}
+	storageObservables.Unlock()
+
+	assertStatus(t, http.StatusBadRequest, ep.withHeader("Content-Type", "text/csv").mustExecuteRequest([]byte("package_name,color\ncom.bulk.one,red\n")))
+}
+
+func TestExportObservables(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.export.app/interval/weekly?jitter=1h"}.mustExecuteRequest(nil))
+
+	rr := endpoint{method: "GET", url: "/hitec/orchestration/app/observables/export?format=csv"}.mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	if !strings.HasPrefix(rr.Body.String(), "package_name,interval,") || !strings.Contains(rr.Body.String(), "com.export.app,weekly,,1h,") {
+		t.Errorf("Expected the observable in the CSV export. Got %s instead", rr.Body.String())
+	}
+
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/observables/export"}.mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	var observables []ObservableGooglePlay
+	if err := json.NewDecoder(rr.Body).Decode(&observables); err != nil || len(observables) == 0 {
+		t.Errorf("Expected the observables in the JSON export. Got %v instead", err)
+	}
+
+	// an export can be imported again
+	csv := endpoint{method: "GET", url: "/hitec/orchestration/app/observables/export?format=csv"}.mustExecuteRequest(nil).Body.Bytes()
+	rr = endpoint{method: "POST", url: "/hitec/orchestration/app/observables/import?format=csv"}.mustExecuteRequest(csv)
+	assertSuccess(t, rr)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+ * catch-up of runs that were missed while the orchestrator was down (or no replica was the leader).
+ * A fire time is missed if it lies after the last successful run (or the start of the observation) and
+ * more than the grace period in the past. The catch-up policy of an observable decides what happens:
+ *  - once: a single catch-up run, no matter how many fire times were missed (default)
+ *  - each: a catch-up run for every missed fire time, limited to CATCH_UP_MAX_RUNS
+ *  - skip: missed fire times are ignored
+ */
+
+const (
+	catchUpOnce = "once"
+	catchUpEach = "each"
+	catchUpSkip = "skip"
+)
+
+var catchUpGrace = parseDurationEnv("CATCH_UP_GRACE", "10m")
+var catchUpMaxRuns = parseIntEnv("CATCH_UP_MAX_RUNS", "10")
+
+func parseDurationEnv(key string, fallback string) time.Duration {
+	duration, err := time.ParseDuration(getEnv(key, fallback))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return duration
+}
+
+func parseIntEnv(key string, fallback string) int {
+	value, err := strconv.Atoi(getEnv(key, fallback))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return value
+}
+
+// ValidateCatchUpPolicy checks the catch-up policy of an observable
+func ValidateCatchUpPolicy(observable ObservableGooglePlay) error {
+	switch observable.CatchUp {
+	case "", catchUpOnce, catchUpEach, catchUpSkip:
+		return nil
+	}
+	return fmt.Errorf("invalid catch_up %q: use once, each or skip", observable.CatchUp)
+}
+
+// MissedRuns returns the fire times of an observable that were missed until now, at most limit
+func MissedRuns(observable ObservableGooglePlay, now time.Time, limit int) []time.Time {
+	var missed []time.Time
+
+	reference := observable.LastSuccessAt
+	if reference == nil {
+		reference = observable.ObservedSince
+	}
+	if reference == nil || isPaused(observable, now) {
+		return missed
+	}
+	deadline := now.Add(-catchUpGrace)
+	if isAdaptive(observable) {
+		// adaptive observables have no fixed fire times, a single due run is missed at most
+		if due := AdaptiveDue(observable); !due.IsZero() && !due.After(deadline) && limit > 0 {
+			missed = append(missed, due)
+		}
+		return missed
+	}
+
+	schedule, err := ScheduleOf(observable)
+	if err != nil {
+		return missed
+	}
+
+	for next := schedule.Next(*reference); !next.IsZero() && !next.After(deadline) && len(missed) < limit; next = schedule.Next(next) {
+		missed = append(missed, next)
+	}
+	return missed
+}
+
+// CatchUpMissedRuns queues catch-up runs for all observables according to their catch-up policy
+func CatchUpMissedRuns(observables []ObservableGooglePlay, now time.Time) {
+	if jobQueue == nil {
+		return
+	}
+
+	for _, observable := range observables {
+		var missed []time.Time
+		switch observable.CatchUp {
+		case catchUpSkip:
+			continue
+		case catchUpEach:
+			missed = MissedRuns(observable, now, catchUpMaxRuns)
+		default:
+			missed = MissedRuns(observable, now, 1)
+		}
+		if len(missed) == 0 {
+			continue
+		}
+
+		if _, err := jobQueue.EnqueueCatchUp(observable.Tenant, observable.PackageName, missed); err != nil {
+			log.Printf("could not catch up %d missed runs of %s: %v\n", len(missed), keyOf(observable), err)
+			continue
+		}
+		log.Printf("catching up %d missed runs of %s\n", len(missed), keyOf(observable))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMissedRuns(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	since := now.Add(-72 * time.Hour)
+	observable := ObservableGooglePlay{PackageName: "eu.openreq", Interval: "daily", TimeZone: "UTC", ObservedSince: &since}
+
+	if missed := MissedRuns(observable, now, 10); len(missed) != 3 {
+		t.Errorf("Expected 3 missed daily runs. Got %v instead", missed)
+	}
+	if missed := MissedRuns(observable, now, 2); len(missed) != 2 {
+		t.Errorf("Expected the missed runs to be limited. Got %v instead", missed)
+	}
+
+	lastSuccess := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	observable.LastSuccessAt = &lastSuccess
+	if missed := MissedRuns(observable, now, 10); len(missed) != 0 {
+		t.Errorf("Expected no missed run after the last successful one. Got %v instead", missed)
+	}
+
+	// a fire time within the grace period is not missed yet
+	now = time.Date(2026, 3, 11, 0, 5, 0, 0, time.UTC)
+	if missed := MissedRuns(observable, now, 10); len(missed) != 0 {
+		t.Errorf("Expected the grace period to be applied. Got %v instead", missed)
+	}
+
+	observable.Paused = true
+	if missed := MissedRuns(observable, now.Add(time.Hour), 10); len(missed) != 0 {
+		t.Errorf("Expected no missed runs of a paused app. Got %v instead", missed)
+	}
+}
+
+func TestCatchUpMissedRuns(t *testing.T) {
+	induceServerError = false
+	since := time.Now().Add(-74 * time.Hour)
+	CatchUpMissedRuns([]ObservableGooglePlay{
+		{PackageName: "org.catchup.each", Interval: "daily", CatchUp: catchUpEach, ObservedSince: &since},
+		{PackageName: "org.catchup.once", Interval: "daily", ObservedSince: &since},
+		{PackageName: "org.catchup.skip", Interval: "daily", CatchUp: catchUpSkip, ObservedSince: &since},
+	}, time.Now())
+
+	for packageName, expected := range map[string]int{"org.catchup.each": 3, "org.catchup.once": 1, "org.catchup.skip": 0} {
+		runs := Runs(RunFilter{PackageName: packageName, Trigger: triggerCatchUp})
+		if len(runs) < expected || (expected <= 1 && len(runs) != expected) {
+			t.Errorf("Expected %d catch-up runs of %s. Got %d instead", expected, packageName, len(runs))
+		}
+		for _, run := range runs {
+			if run.MissedAt == nil {
+				t.Errorf("Expected the missed fire time to be recorded. Got %+v instead", run)
+			}
+			waitForRun(t, run.ID)
+		}
+	}
+}
+
+func TestCatchUpOnce(t *testing.T) {
+	induceServerError = false
+	RequestCatchUp()
+	RestartObservation()
+	if catchUpDue {
+		t.Error("Expected the missed runs to be caught up with the start of the observation")
+	}
+	RestartObservation()
+	if catchUpDue {
+		t.Error("Expected a restart not to catch up again")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenReqEU/ri-orchestration-app/orchestration"
+)
+
+func TestClientVersion(t *testing.T) {
+	data, _ := ioutil.ReadFile("swagger.yaml")
+	version := regexp.MustCompile(`(?m)^  version: "(.*)"$`).FindSubmatch(data)
+	if version == nil || string(version[1]) != orchestration.Version {
+		t.Errorf("Expected the client to be versioned with the API %s. Got %s instead", version, orchestration.Version)
+	}
+}
+
+func TestClient(t *testing.T) {
+	induceServerError = false
+	server := httptest.NewServer(router)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := orchestration.NewClient(server.URL)
+
+	err := client.Observe(ctx, "com.client.app", "daily", orchestration.ObserveOptions{TimeZone: "Europe/Vienna", Projects: []string{"client"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	observables, err := client.Observables(ctx, orchestration.ObservableFilter{Project: "client"})
+	if err != nil || len(observables) != 1 || observables[0].Interval != "daily" || observables[0].TimeZone != "Europe/Vienna" {
+		t.Errorf("Expected the observed app of the project. Got %+v (%v) instead", observables, err)
+	}
+
+	run, err := client.RunNow(ctx, "com.client.app")
+	if err != nil || run.Status != orchestration.RunQueued {
+		t.Fatalf("Expected a queued run. Got %+v (%v) instead", run, err)
+	}
+	var steps []string
+	run, err = client.FollowRun(ctx, run.ID, func(progress orchestration.Progress) {
+		steps = append(steps, progress.Step+" "+progress.Status)
+	})
+	if err != nil || run.Status != orchestration.RunSucceeded {
+		t.Errorf("Expected the run to succeed. Got %+v (%v) instead", run, err)
+	}
+
+	var buffer bytes.Buffer
+	if err := client.Export(ctx, "csv", &buffer); err != nil || !strings.Contains(buffer.String(), "com.client.app,daily") {
+		t.Errorf("Expected the observables as CSV. Got %s (%v) instead", buffer.String(), err)
+	}
+	if health, err := client.Health(ctx); err != nil || health.Status == "" {
+		t.Errorf("Expected the health of the orchestrator. Got %+v (%v) instead", health, err)
+	}
+
+	if err := client.Unobserve(ctx, "com.client.unknown"); !orchestration.IsNotFound(err) {
+		t.Errorf("Expected an app that is not observed to be not found. Got %v instead", err)
+	}
+	if _, err := client.Pause(ctx, "com.client.app", time.Now().Add(-time.Hour)); err == nil || !strings.Contains(err.Error(), "400: resume_at") {
+		t.Errorf("Expected the message of the orchestrator. Got %v instead", err)
+	}
+	if err := client.Unobserve(ctx, "com.client.app"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientRunPages(t *testing.T) {
+	server := httptest.NewServer(router)
+	defer server.Close()
+	client := orchestration.NewClient(server.URL)
+
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		run := Run{ID: newRunID(now.Add(time.Duration(i) * time.Second)), PackageName: "com.client.pages", Status: runSucceeded, QueuedAt: now}
+		SaveRun(run)
+		ids = append([]string{run.ID}, ids...)
+	}
+
+	options := orchestration.RunListOptions{PackageName: "com.client.pages", Limit: 2}
+	page, err := client.Runs(context.Background(), options)
+	if err != nil || len(page.Runs) != 2 || page.Runs[0].ID != ids[0] || page.Next != ids[1] {
+		t.Fatalf("Expected the first page of the newest runs. Got %+v (%v) instead", page, err)
+	}
+	options.Before = page.Next
+	if page, _ = client.Runs(context.Background(), options); len(page.Runs) != 2 || page.Runs[0].ID != ids[2] {
+		t.Errorf("Expected the runs before the cursor. Got %+v instead", page)
+	}
+
+	var all []string
+	options.Before = ""
+	err = client.EachRun(context.Background(), options, func(run orchestration.Run) error {
+		all = append(all, run.ID)
+		return nil
+	})
+	if err != nil || strings.Join(all, ",") != strings.Join(ids, ",") {
+		t.Errorf("Expected all runs, newest first. Got %v (%v) instead", all, err)
+	}
+}
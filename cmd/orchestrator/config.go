@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+ * profiles of the CLI: the server and the credentials (API key or bearer token) of an orchestrator. They are kept in
+ * $ORCHESTRATOR_CONFIG, default ~/.config/orchestrator/config.json. The profile is selected by --profile,
+ * $ORCHESTRATOR_PROFILE or the current profile of the config.
+ */
+
+const defaultServer = "http://localhost:9702"
+
+// Profile of an orchestrator
+type Profile struct {
+	Server string `json:"server"`
+	APIKey string `json:"api_key,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// Config of the CLI
+type Config struct {
+	CurrentProfile string             `json:"current_profile,omitempty"`
+	Profiles       map[string]Profile `json:"profiles"`
+}
+
+func configPath() string {
+	if path := os.Getenv("ORCHESTRATOR_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "orchestrator", "config.json")
+}
+
+// loadConfig reads the config. A missing config is empty
+func loadConfig() (Config, error) {
+	config := Config{Profiles: map[string]Profile{}}
+	data, err := ioutil.ReadFile(configPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid config %s: %v", configPath(), err)
+	}
+	if config.Profiles == nil {
+		config.Profiles = map[string]Profile{}
+	}
+	return config, nil
+}
+
+func saveConfig(config Config) error {
+	path := configPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(config, "", "  ")
+	// the config contains credentials
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// profileOf returns the profile selected by name, $ORCHESTRATOR_PROFILE or the current profile. Without any profile the local server is used
+func profileOf(config Config, name string) (Profile, error) {
+	if name == "" {
+		name = os.Getenv("ORCHESTRATOR_PROFILE")
+	}
+	if name == "" {
+		name = config.CurrentProfile
+	}
+	if name == "" {
+		return Profile{Server: defaultServer}, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return profile, fmt.Errorf("unknown profile %q", name)
+	}
+	if profile.Server == "" {
+		profile.Server = defaultServer
+	}
+	return profile, nil
+}
+
+func profileNames(config Config) []string {
+	var names []string
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
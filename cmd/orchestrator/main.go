@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/OpenReqEU/ri-orchestration-app/orchestration"
+)
+
+/*
+ * orchestrator is the command-line client of the ri-orchestration-app. It only uses the API, so it operates any
+ * orchestrator that the selected profile (see config.go) points to. Output is a table, or JSON with --output json.
+ */
+
+const usage = `usage: orchestrator [--profile name] [--server url] [--output table|json] <command> [arguments]
+
+commands:
+  list [--project p] [--tag t]                      list the observables with their next and last run
+  observe <package_name> <interval> [--project p] [--tag t]
+                                                    observe an app, or change its interval
+  unobserve <package_name>                          stop observing an app
+  run-now <package_name> [--wait]                   queue a run of an app, --wait follows its progress
+  process <package_name> [--wait]                   crawl, process and store an app once, --wait follows its progress
+  runs [--package p] [--status s] [--limit n]       show the run history
+  tail [--package p]                                follow the progress of all runs
+  health                                            show the health of the orchestrator and its downstream services
+  import <file> [--format json|csv]                 import observables
+  export [--format json|csv] [--file f]             export observables
+  profile set <name> [--server url] [--api-key k] [--token t]
+                                                    add or change a profile and make it the current one
+  profile use <name>                                make a profile the current one
+  profile list                                      list the profiles
+`
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// models of the orchestrator
+type (
+	Observable      = orchestration.ObservableStatus
+	Run             = orchestration.Run
+	Progress        = orchestration.Progress
+	Health          = orchestration.Health
+	ComponentStatus = orchestration.ComponentStatus
+)
+
+type cli struct {
+	client *orchestration.Client
+	// ctx ends commands that do not follow a stream after requestTimeout
+	ctx    context.Context
+	out    io.Writer
+	output string
+}
+
+// requestTimeout of the commands that do not follow a stream
+const requestTimeout = 2 * time.Minute
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "orchestrator:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	global := flag.NewFlagSet("orchestrator", flag.ContinueOnError)
+	global.SetOutput(ioutil.Discard)
+	profileName := global.String("profile", "", "")
+	server := global.String("server", "", "")
+	output := global.String("output", outputTable, "")
+	if err := global.Parse(args); err != nil || global.NArg() == 0 {
+		fmt.Fprint(out, usage)
+		return err
+	}
+	if *output != outputTable && *output != outputJSON {
+		return fmt.Errorf("unsupported output %q, use table or json", *output)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	command, args := global.Arg(0), global.Args()[1:]
+	if command == "profile" {
+		return profileCommand(config, args, out)
+	}
+	profile, err := profileOf(config, *profileName)
+	if err != nil {
+		return err
+	}
+	if *server != "" {
+		profile.Server = *server
+	}
+	ctx := context.Background()
+	if command != "tail" && command != "run-now" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+	c := &cli{client: newClient(profile), ctx: ctx, out: out, output: *output}
+
+	commands := map[string]func([]string) error{
+		"list":      c.list,
+		"observe":   c.observe,
+		"unobserve": c.unobserve,
+		"run-now":   c.runNow,
+		"process":   c.process,
+		"runs":      c.runs,
+		"tail":      c.tail,
+		"health":    c.health,
+		"import":    c.importObservables,
+		"export":    c.exportObservables,
+	}
+	handler, ok := commands[command]
+	if !ok {
+		fmt.Fprint(out, usage)
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return handler(args)
+}
+
+// parse parses the flags of a command, also after its arguments, and checks the number of arguments
+func parse(flags *flag.FlagSet, args []string, arguments int) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) != arguments {
+		return nil, fmt.Errorf("%s expects %d arguments, see orchestrator without arguments", flags.Name(), arguments)
+	}
+	return positional, nil
+}
+
+// multiFlag is a flag that can be given several times
+type multiFlag []string
+
+func (f *multiFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// newClient returns a client of the orchestrator of a profile
+func newClient(profile Profile) *orchestration.Client {
+	return orchestration.NewClient(profile.Server, orchestration.WithAPIKey(profile.APIKey), orchestration.WithToken(profile.Token),
+		orchestration.WithHTTPClient(&http.Client{}))
+}
+
+func (c *cli) printJSON(value interface{}) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// printTable prints rows below a header, or the value as JSON
+func (c *cli) printTable(value interface{}, header string, rows func(w io.Writer)) error {
+	if c.output == outputJSON {
+		return c.printJSON(value)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	rows(w)
+	return w.Flush()
+}
+
+// printMessage prints the message of a successful command, or a response as JSON
+func (c *cli) printMessage(message string) error {
+	if c.output == outputJSON {
+		return c.printJSON(orchestration.Response{Status: true, Message: message})
+	}
+	fmt.Fprintln(c.out, message)
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func (c *cli) list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	project := flags.String("project", "", "")
+	tag := flags.String("tag", "", "")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	observables, err := c.client.Observables(c.ctx, orchestration.ObservableFilter{Project: *project, Tag: *tag})
+	if err != nil {
+		return err
+	}
+	return c.printTable(observables, "PACKAGE NAME\tINTERVAL\tSTATE\tNEXT RUN\tLAST RUN\tPROJECTS", func(w io.Writer) {
+		for _, o := range observables {
+			last := formatTime(o.LastRunAt)
+			if o.LastRunAt != nil {
+				if o.LastSuccessAt != nil && o.LastSuccessAt.Equal(*o.LastRunAt) {
+					last += " succeeded"
+				} else {
+					last += " failed"
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", o.PackageName, o.Interval, o.State, formatTime(o.Schedule.NextRun), last, strings.Join(o.Projects, ","))
+		}
+	})
+}
+
+func (c *cli) observe(args []string) error {
+	flags := flag.NewFlagSet("observe", flag.ContinueOnError)
+	var projects, tags multiFlag
+	flags.Var(&projects, "project", "")
+	flags.Var(&tags, "tag", "")
+	positional, err := parse(flags, args, 2)
+	if err != nil {
+		return err
+	}
+	options := orchestration.ObserveOptions{Projects: projects, Tags: tags}
+	if err := c.client.Observe(c.ctx, positional[0], positional[1], options); err != nil {
+		return err
+	}
+	return c.printMessage(fmt.Sprintf("observing %s %s", positional[0], positional[1]))
+}
+
+func (c *cli) unobserve(args []string) error {
+	positional, err := parse(flag.NewFlagSet("unobserve", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.client.Unobserve(c.ctx, positional[0]); err != nil {
+		return err
+	}
+	return c.printMessage("observation of " + positional[0] + " removed")
+}
+
+func (c *cli) process(args []string) error {
+	flags := flag.NewFlagSet("process", flag.ContinueOnError)
+	wait := flags.Bool("wait", false, "")
+	positional, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	runID, err := c.client.Process(c.ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	if !*wait {
+		return c.printMessage("processing of " + positional[0] + " started in run " + runID)
+	}
+	return c.follow(runID)
+}
+
+func (c *cli) runNow(args []string) error {
+	flags := flag.NewFlagSet("run-now", flag.ContinueOnError)
+	wait := flags.Bool("wait", false, "")
+	positional, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	run, err := c.client.RunNow(c.ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	if !*wait {
+		if c.output == outputJSON {
+			return c.printJSON(run)
+		}
+		fmt.Fprintf(c.out, "run %s of %s queued\n", run.ID, run.PackageName)
+		return nil
+	}
+	return c.follow(run.ID)
+}
+
+// follow prints the progress of a run until it finished. Returns an error if the run failed
+func (c *cli) follow(runID string) error {
+	final, err := c.client.FollowRun(c.ctx, runID, c.printProgress)
+	if err != nil {
+		return err
+	}
+	if c.output == outputJSON {
+		return c.printJSON(final)
+	}
+	fmt.Fprintf(c.out, "run %s %s\n", final.ID, final.Status)
+	if final.Status == orchestration.RunFailed {
+		return fmt.Errorf("run failed: %s", final.Error)
+	}
+	return nil
+}
+
+func (c *cli) printProgress(progress Progress) {
+	if c.output == outputJSON {
+		data, _ := json.Marshal(progress)
+		fmt.Fprintln(c.out, string(data))
+		return
+	}
+	line := fmt.Sprintf("%s  %s  %s  %s %s", progress.At.Local().Format("15:04:05"), progress.RunID, progress.PackageName, progress.Step, progress.Status)
+	if progress.Count > 0 {
+		line += fmt.Sprintf(" (%d)", progress.Count)
+	}
+	if progress.Error != "" {
+		line += ": " + progress.Error
+	}
+	fmt.Fprintln(c.out, line)
+}
+
+func (c *cli) runs(args []string) error {
+	flags := flag.NewFlagSet("runs", flag.ContinueOnError)
+	packageName := flags.String("package", "", "")
+	status := flags.String("status", "", "")
+	limit := flags.Int("limit", 20, "")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	page, err := c.client.Runs(c.ctx, orchestration.RunListOptions{PackageName: *packageName, Status: *status, Limit: *limit})
+	if err != nil {
+		return err
+	}
+	runs := page.Runs
+	return c.printTable(runs, "ID\tQUEUED\tPACKAGE NAME\tTRIGGER\tSTATUS\tCRAWLED\tNEW\tCLASSIFIED\tERROR", func(w io.Writer) {
+		for _, r := range runs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", r.ID, formatTime(&r.QueuedAt), r.PackageName, r.Trigger, r.Status, r.CrawledReviews, r.NewReviews, r.ClassifiedReviews, r.Error)
+		}
+	})
+}
+
+func (c *cli) tail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	packageName := flags.String("package", "", "")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	return c.client.FollowProgress(c.ctx, *packageName, func(progress Progress) bool {
+		c.printProgress(progress)
+		return true
+	})
+}
+
+func (c *cli) health(args []string) error {
+	if _, err := parse(flag.NewFlagSet("health", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	ready, err := c.client.Health(c.ctx)
+	if err != nil {
+		return err
+	}
+	downstream, err := c.client.DownstreamHealth(c.ctx)
+	if err != nil {
+		return err
+	}
+	healths := map[string]Health{"orchestrator": ready, "downstream": downstream}
+	return c.printTable(healths, "COMPONENT\tSTATUS\tMESSAGE", func(w io.Writer) {
+		for _, name := range []string{"orchestrator", "downstream"} {
+			fmt.Fprintf(w, "%s\t%s\t\n", name, healths[name].Status)
+			for _, component := range sortedKeys(healths[name].Components) {
+				status := healths[name].Components[component]
+				fmt.Fprintf(w, "  %s\t%s\t%s\n", component, status.Status, status.Message)
+			}
+		}
+	})
+}
+
+func sortedKeys(components map[string]ComponentStatus) []string {
+	var keys []string
+	for key := range components {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *cli) importObservables(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "")
+	positional, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(positional[0]), ".")
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unsupported format %q, use json or csv", *format)
+	}
+	file, err := os.Open(positional[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report, err := c.client.Import(c.ctx, *format, file)
+	if len(report.Rows) == 0 {
+		if err == nil {
+			err = fmt.Errorf("unexpected response of the orchestrator")
+		}
+		return err
+	}
+	if printErr := c.printTable(report, "ROW\tPACKAGE NAME\tSTATUS\tMESSAGE", func(w io.Writer) {
+		for _, row := range report.Rows {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", row.Row, row.PackageName, row.Status, row.Message)
+		}
+	}); printErr != nil {
+		return printErr
+	}
+	if !report.Applied {
+		return fmt.Errorf("import was not applied")
+	}
+	return nil
+}
+
+func (c *cli) exportObservables(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "json", "")
+	file := flags.String("file", "", "")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	if *file == "" {
+		return c.client.Export(c.ctx, *format, c.out)
+	}
+	var buffer bytes.Buffer
+	if err := c.client.Export(c.ctx, *format, &buffer); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*file, buffer.Bytes(), 0644)
+}
+
+func profileCommand(config Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("profile expects set, use or list")
+	}
+	switch args[0] {
+	case "list":
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSERVER\tCURRENT")
+		for _, name := range profileNames(config) {
+			current := ""
+			if name == config.CurrentProfile {
+				current = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, config.Profiles[name].Server, current)
+		}
+		return w.Flush()
+	case "use":
+		if len(args) != 2 {
+			return fmt.Errorf("profile use expects a name")
+		}
+		if _, ok := config.Profiles[args[1]]; !ok {
+			return fmt.Errorf("unknown profile %q", args[1])
+		}
+		config.CurrentProfile = args[1]
+		return saveConfig(config)
+	case "set":
+		flags := flag.NewFlagSet("profile set", flag.ContinueOnError)
+		server := flags.String("server", "", "")
+		apiKey := flags.String("api-key", "", "")
+		token := flags.String("token", "", "")
+		positional, err := parse(flags, args[1:], 1)
+		if err != nil {
+			return err
+		}
+		profile := config.Profiles[positional[0]]
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "server":
+				profile.Server = *server
+			case "api-key":
+				profile.APIKey = *apiKey
+			case "token":
+				profile.Token = *token
+			}
+		})
+		config.Profiles[positional[0]] = profile
+		config.CurrentProfile = positional[0]
+		return saveConfig(config)
+	}
+	return fmt.Errorf("unknown profile command %q, use set, use or list", args[0])
+}
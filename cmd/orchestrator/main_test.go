@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OpenReqEU/ri-orchestration-app/orchestration"
+)
+
+// fakeOrchestrator answers the API calls of the CLI and records them as "METHOD path?query"
+func fakeOrchestrator(requests *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status":false,"message":"invalid API key"}`)
+			return
+		}
+		*requests = append(*requests, r.Method+" "+r.URL.RequestURI())
+		path := strings.TrimPrefix(r.URL.Path, orchestration.BasePath)
+		switch {
+		case path == "/observe/google-play":
+			fmt.Fprint(w, `[{"package_name":"com.whatsapp","interval":"daily","state":"active","projects":["chat"],"schedule":{"next_run":"2026-01-02T03:00:00Z"}}]`)
+		case strings.HasSuffix(path, "/interval/daily"):
+			fmt.Fprint(w, `{"status":true,"message":"observation successfully initiated"}`)
+		case strings.HasSuffix(path, "/run"):
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{"id":"run-1","package_name":"com.whatsapp","status":"queued"}`)
+		case path == "/runs/run-1/progress":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: run\ndata: {\"id\":\"run-1\",\"status\":\"queued\"}\n\n")
+			fmt.Fprint(w, "event: progress\ndata: {\"run_id\":\"run-1\",\"package_name\":\"com.whatsapp\",\"step\":\"crawl_reviews\",\"status\":\"finished\",\"count\":7}\n\n")
+			fmt.Fprint(w, "event: progress\ndata: {\"run_id\":\"run-1\",\"package_name\":\"com.whatsapp\",\"step\":\"run\",\"status\":\"succeeded\"}\n\n")
+		case path == "/runs/run-1":
+			fmt.Fprint(w, `{"id":"run-1","package_name":"com.whatsapp","status":"succeeded"}`)
+		case path == "/runs/run-2/progress":
+			// the stream drops while the run is running
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: run\ndata: {\"id\":\"run-2\",\"status\":\"running\"}\n\n")
+		case path == "/runs/run-2":
+			fmt.Fprint(w, `{"id":"run-2","package_name":"com.whatsapp","status":"running"}`)
+		case path == "/observables/export":
+			fmt.Fprint(w, "package_name,interval\ncom.whatsapp,daily\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"status":false,"message":"app is not observed"}`)
+		}
+	}))
+}
+
+func TestCLI(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "orchestrator-cli")
+	defer os.RemoveAll(dir)
+	os.Setenv("ORCHESTRATOR_CONFIG", filepath.Join(dir, "config.json"))
+	defer os.Unsetenv("ORCHESTRATOR_CONFIG")
+
+	var requests []string
+	server := fakeOrchestrator(&requests)
+	defer server.Close()
+
+	var out bytes.Buffer
+	if err := run([]string{"profile", "set", "local", "--server", server.URL, "--api-key", "secret"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := run([]string{"list", "--project", "chat"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "PACKAGE NAME") || !strings.Contains(out.String(), "com.whatsapp  daily") || requests[0] != "GET "+orchestration.BasePath+"/observe/google-play?project=chat" {
+		t.Errorf("Expected a table of the observables. Got %s instead", out.String())
+	}
+
+	out.Reset()
+	if err := run([]string{"observe", "com.whatsapp", "daily", "--project", "chat", "--tag", "top"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if last := requests[len(requests)-1]; last != "POST "+orchestration.BasePath+"/observe/google-play/package-name/com.whatsapp/interval/daily?project=chat&tag=top" {
+		t.Errorf("Expected the flags after the arguments to be sent. Got %s instead", last)
+	}
+
+	out.Reset()
+	if err := run([]string{"run-now", "--wait", "com.whatsapp"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "crawl_reviews finished (7)") || !strings.HasSuffix(out.String(), "run run-1 succeeded\n") {
+		t.Errorf("Expected the progress and the final state of the run. Got %s instead", out.String())
+	}
+
+	export := filepath.Join(dir, "observables.csv")
+	if err := run([]string{"export", "--format", "csv", "--file", export}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(export); !strings.Contains(string(data), "com.whatsapp,daily") {
+		t.Errorf("Expected the exported observables. Got %s instead", data)
+	}
+
+	err := run([]string{"unobserve", "com.unknown"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "404: app is not observed") {
+		t.Errorf("Expected the error of the orchestrator. Got %v instead", err)
+	}
+	if err := run([]string{"--server", server.URL, "--profile", "missing", "list"}, &out); err == nil {
+		t.Errorf("Expected an unknown profile to fail")
+	}
+	if err := run([]string{"observe", "com.whatsapp"}, &out); err == nil {
+		t.Errorf("Expected missing arguments to fail")
+	}
+}
+
+func TestFollowRunDropped(t *testing.T) {
+	var requests []string
+	server := fakeOrchestrator(&requests)
+	defer server.Close()
+
+	client := orchestration.NewClient(server.URL, orchestration.WithAPIKey("secret"))
+	run, err := client.FollowRun(context.Background(), "run-2", nil)
+	if !errors.Is(err, orchestration.ErrRunNotFinished) || run.Status != orchestration.RunRunning {
+		t.Errorf("Expected the running run and an error. Got %+v, %v instead", run, err)
+	}
+}
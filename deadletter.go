@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * dead-letter queue of the observation pipeline. Runs are not retried automatically, so an app whose run failed is
+ * kept as dead letter with the error of its last failed run and the number of failed runs in a row. Operators retry
+ * (a manual run) or discard it; it is resolved by the next successful run of the app.
+ */
+
+const bucketDeadLetters = "dead_letters"
+
+// RecordDeadLetter keeps the failed run of an app as dead letter
+func RecordDeadLetter(run Run) {
+	if db == nil {
+		return
+	}
+	key := observableKey(run.Tenant, run.PackageName)
+	var letter DeadLetter
+	if _, err := storeGet(bucketDeadLetters, key, &letter); err != nil {
+		log.Printf("ERR could not load dead letter %s: %v\n", key, err)
+	}
+	if letter.FirstFailedAt == nil {
+		letter.FirstFailedAt = run.FinishedAt
+	}
+	letter.Tenant, letter.PackageName = run.Tenant, run.PackageName
+	letter.RunID, letter.Trigger, letter.Error = run.ID, run.Trigger, run.Error
+	letter.FailedAt = run.FinishedAt
+	letter.Failures++
+	if err := storePut(bucketDeadLetters, key, letter); err != nil {
+		log.Printf("ERR could not keep dead letter %s: %v\n", key, err)
+	}
+}
+
+// DeadLetterOf returns the dead letter of an app, false if its last run did not fail
+func DeadLetterOf(tenant string, packageName string) (DeadLetter, bool) {
+	var letter DeadLetter
+	if db == nil {
+		return letter, false
+	}
+	ok, err := storeGet(bucketDeadLetters, observableKey(tenant, packageName), &letter)
+	if err != nil {
+		log.Printf("ERR could not load dead letter %s: %v\n", observableKey(tenant, packageName), err)
+	}
+	return letter, ok
+}
+
+// ResolveDeadLetter removes the dead letter of an app. Returns false if there is none
+func ResolveDeadLetter(tenant string, packageName string) bool {
+	if db == nil {
+		return false
+	}
+	key := observableKey(tenant, packageName)
+	var letter DeadLetter
+	if ok, _ := storeGet(bucketDeadLetters, key, &letter); !ok {
+		return false
+	}
+	if err := storeDelete(bucketDeadLetters, key); err != nil {
+		log.Printf("ERR could not resolve dead letter %s: %v\n", key, err)
+		return false
+	}
+	return true
+}
+
+// DeadLetters returns the dead letters of a tenant, most recently failed first
+func DeadLetters(tenant string) []DeadLetter {
+	letters := []DeadLetter{}
+	if db == nil {
+		return letters
+	}
+	err := storeForEach(bucketDeadLetters, func(key string, data []byte) error {
+		var letter DeadLetter
+		if err := json.Unmarshal(data, &letter); err != nil {
+			return err
+		}
+		if letter.Tenant == tenant {
+			letters = append(letters, letter)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the dead letters: %v\n", err)
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return timeOf(letters[i].FailedAt).After(timeOf(letters[j].FailedAt))
+	})
+	return letters
+}
+
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// getDeadLetters returns the dead letters of the tenant. Query parameters: project, tag
+func getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	packageNames := packageNamesOf(observableFilterOf(r))
+	letters := []DeadLetter{}
+	for _, letter := range DeadLetters(tenantOf(r)) {
+		if matchesPackageNames(packageNames, letter.PackageName) {
+			letters = append(letters, letter)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(letters)
+}
+
+// postRetryDeadLetter queues a manual run of the app of a dead letter. The letter is resolved once a run succeeds
+func postRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tenant, packageName := tenantOf(r), mux.Vars(r)["package_name"]
+	if _, ok := DeadLetterOf(tenant, packageName); !ok {
+		respondUnknownDeadLetter(w)
+		return
+	}
+	if _, ok := ObservableOf(tenant, packageName); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "app is not observed"})
+		return
+	}
+	run, err := jobQueue.Enqueue(tenant, packageName, triggerManual)
+	respondEnqueued(w, run, err)
+}
+
+// deleteDeadLetter discards the dead letter of an app
+func deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ResolveDeadLetter(tenantOf(r), mux.Vars(r)["package_name"]) {
+		respondUnknownDeadLetter(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{Status: true, Message: "dead letter discarded"})
+}
+
+func respondUnknownDeadLetter(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(Response{Status: false, Message: "no dead letter of the app"})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func deadLetterOf(packageName string) (DeadLetter, bool) {
+	var letters []DeadLetter
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/dead-letters"}.mustExecuteRequest(nil).Body).Decode(&letters)
+	for _, letter := range letters {
+		if letter.PackageName == packageName {
+			return letter, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+func TestDeadLetters(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.deadletter.app/interval/daily"}.mustExecuteRequest(nil))
+	retry := endpoint{method: "POST", url: "/hitec/orchestration/app/dead-letters/com.deadletter.app/retry"}
+	discard := endpoint{method: "DELETE", url: "/hitec/orchestration/app/dead-letters/com.deadletter.app"}
+	assertStatus(t, http.StatusNotFound, retry.mustExecuteRequest(nil))
+
+	induceServerError = true
+	runNow(t, "com.deadletter.app")
+	failed := runNow(t, "com.deadletter.app")
+	induceServerError = false
+	letter, ok := deadLetterOf("com.deadletter.app")
+	if !ok || letter.Failures != 2 || letter.RunID != failed.ID || letter.Error == "" {
+		t.Fatalf("Expected a dead letter of both failed runs. Got %+v instead", letter)
+	}
+
+	rr := retry.mustExecuteRequest(nil)
+	assertStatus(t, http.StatusAccepted, rr)
+	var run Run
+	json.NewDecoder(rr.Body).Decode(&run)
+	if run = waitForRun(t, run.ID); run.Status != runSucceeded {
+		t.Fatalf("Expected the retry to succeed. Got %+v instead", run)
+	}
+	if _, ok := deadLetterOf("com.deadletter.app"); ok {
+		t.Errorf("Expected the dead letter to be resolved by the successful run")
+	}
+
+	induceServerError = true
+	runNow(t, "com.deadletter.app")
+	induceServerError = false
+	assertSuccess(t, discard.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, discard.mustExecuteRequest(nil))
+}
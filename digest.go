@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * digest reports. A digest summarizes the apps of an observable or a project over a period (default: one week):
+ * new reviews per star rating, bug reports and feature requests, the longest and most helpful reviews, the app versions
+ * seen on the app page and the health of the pipeline. It is aggregated from the run history and the classified
+ * reviews that are kept for the run history retention.
+ * Digests are generated according to their interval, stored and delivered to their webhook (signed JSON) and emails
+ * (Markdown or HTML). Reports render as Markdown, HTML and JSON.
+ */
+
+const (
+	bucketDigests       = "digests"
+	bucketDigestReports = "digest_reports"
+
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+
+	defaultDigestInterval = "weekly"
+	defaultDigestPeriod   = "168h"
+	topReviewCount        = 3
+)
+
+// digestTick is how often due digests are looked for
+var digestTick = time.Minute
+
+// StartDigests generates the due digests on the leader and prunes old reviews and reports once per hour
+func StartDigests() {
+	go func() {
+		for range time.Tick(digestTick) {
+			if IsLeader() {
+				sendDueDigests(time.Now())
+			}
+		}
+	}()
+	go func() {
+		for range time.Tick(time.Hour) {
+			pruneDigestData(time.Now().Add(-runHistoryRetention))
+		}
+	}()
+}
+
+// ValidateDigest checks a digest and sets its defaults
+func ValidateDigest(digest *Digest) error {
+	if (digest.PackageName == "") == (digest.Project == "") {
+		return fmt.Errorf("a digest needs either a package_name or a project")
+	}
+	if digest.PackageName != "" {
+		if err := ValidatePackageName(digest.PackageName); err != nil {
+			return err
+		}
+	}
+	if digest.Interval == "" {
+		digest.Interval = defaultDigestInterval
+	}
+	if digest.Interval == intervalAdaptive {
+		return fmt.Errorf("digests cannot be sent adaptively")
+	}
+	if _, err := ParseObserverInterval(digest.Interval); err != nil {
+		return err
+	}
+	if digest.Period == "" {
+		digest.Period = defaultDigestPeriod
+	}
+	if period, err := time.ParseDuration(digest.Period); err != nil || period <= 0 || period > runHistoryRetention {
+		return fmt.Errorf("invalid period %q: use a duration up to %s", digest.Period, runHistoryRetention)
+	}
+	if digest.Format == "" {
+		digest.Format = formatHTML
+	}
+	if digest.Format != formatMarkdown && digest.Format != formatHTML {
+		return fmt.Errorf("invalid format %q: use %s or %s", digest.Format, formatMarkdown, formatHTML)
+	}
+	if digest.WebhookURL != "" {
+		if err := validateReceiverURL(digest.WebhookURL); err != nil {
+			return err
+		}
+		if digest.Secret == "" {
+			secret, err := newSecret()
+			if err != nil {
+				return err
+			}
+			digest.Secret = secret
+		}
+	}
+	if len(digest.Emails) > 0 && smtpAddr == "" {
+		return fmt.Errorf("emails require SMTP_ADDR")
+	}
+	for _, email := range digest.Emails {
+		if err := validateEmail(email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (digest Digest) period() time.Duration {
+	period, _ := time.ParseDuration(digest.Period)
+	return period
+}
+
+// nextAt returns the next time the digest is due after now
+func (digest Digest) nextAt(now time.Time) time.Time {
+	schedule, err := ParseObserverInterval(digest.Interval)
+	if err != nil {
+		return now.Add(digest.period())
+	}
+	return schedule.Next(now)
+}
+
+// sendDueDigests generates, stores and delivers all digests that are due
+func sendDueDigests(now time.Time) {
+	for _, tenant := range TenantIDs() {
+		for _, digest := range Digests(tenant) {
+			if digest.NextAt != nil && digest.NextAt.After(now) {
+				continue
+			}
+			if digest.NextAt != nil {
+				report := GenerateDigestReport(digest.Tenant, digest.PackageName, digest.Project, now.Add(-digest.period()), now)
+				report.DigestID = digest.ID
+				if err := deliverDigestReport(digest, report); err != nil {
+					report.Error = err.Error()
+					log.Printf("ERR could not deliver digest %s: %v\n", digest.ID, err)
+				}
+				SaveDigestReport(report)
+				digest.LastSentAt = &now
+			}
+			next := digest.nextAt(now)
+			digest.NextAt = &next
+			if err := SaveDigest(digest); err != nil {
+				log.Printf("ERR could not save digest %s: %v\n", digest.ID, err)
+			}
+		}
+	}
+}
+
+// GenerateDigestReport summarizes an app or all apps of a project of a tenant over a period
+func GenerateDigestReport(tenant string, packageName string, project string, from time.Time, to time.Time) DigestReport {
+	report := DigestReport{ID: newRunID(to), Tenant: tenant, PackageName: packageName, Project: project, From: from, To: to, GeneratedAt: time.Now(), Apps: []AppDigest{}}
+
+	packageNames := []string{packageName}
+	if project != "" {
+		packageNames = []string{}
+		for name := range packageNamesOf(ObservableFilter{Tenant: tenant, Project: project}) {
+			packageNames = append(packageNames, name)
+		}
+		sort.Strings(packageNames)
+	}
+	for _, name := range packageNames {
+		report.Apps = append(report.Apps, appDigestOf(tenant, name, from, to))
+	}
+	return report
+}
+
+func appDigestOf(tenant string, packageName string, from time.Time, to time.Time) AppDigest {
+	app := AppDigest{PackageName: packageName, ReviewsPerRating: map[string]int{}, LongestReviews: []AppReviewGooglePlay{}, HelpfulReviews: []AppReviewGooglePlay{}, VersionChanges: []VersionChange{}}
+	for rating := 1; rating <= 5; rating++ {
+		app.ReviewsPerRating[strconv.Itoa(rating)] = 0
+	}
+
+	// runs are newest first, versions are collected oldest first
+	runs := Runs(RunFilter{Tenant: tenant, PackageName: packageName})
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+		if run.QueuedAt.Before(from) || run.QueuedAt.After(to) {
+			continue
+		}
+		switch run.Status {
+		case runSucceeded:
+			app.Health.Succeeded++
+		case runFailed:
+			app.Health.Failed++
+			app.Health.LastError = run.Error
+		default:
+			continue
+		}
+		app.Health.Runs++
+		app.NewReviews += run.NewReviews
+		app.BugReports += run.BugReports
+		app.FeatureRequests += run.FeatureRequests
+		for index, count := range run.ReviewsPerRating {
+			app.ReviewsPerRating[strconv.Itoa(index+1)] += count
+		}
+		if run.PageRating != 0 {
+			app.PageRating = run.PageRating
+		}
+		if run.AppVersion != "" && (len(app.VersionChanges) == 0 || app.VersionChanges[len(app.VersionChanges)-1].Version != run.AppVersion) {
+			firstSeenAt := run.QueuedAt
+			if run.FinishedAt != nil {
+				firstSeenAt = *run.FinishedAt
+			}
+			app.VersionChanges = append(app.VersionChanges, VersionChange{Version: run.AppVersion, FirstSeenAt: firstSeenAt})
+		}
+	}
+
+	reviews := []AppReviewGooglePlay{}
+	for _, kept := range KeptReviews(tenant, packageName, from, to) {
+		reviews = append(reviews, kept.Review)
+	}
+	app.LongestReviews = topReviews(reviews, func(a, b AppReviewGooglePlay) bool { return len(a.Title)+len(a.Body) > len(b.Title)+len(b.Body) })
+	helpful := []AppReviewGooglePlay{}
+	for _, review := range reviews {
+		if review.ThumbsUp > 0 {
+			helpful = append(helpful, review)
+		}
+	}
+	app.HelpfulReviews = topReviews(helpful, func(a, b AppReviewGooglePlay) bool { return a.ThumbsUp > b.ThumbsUp })
+	return app
+}
+
+// topReviews returns the first reviews in the given order
+func topReviews(reviews []AppReviewGooglePlay, less func(a, b AppReviewGooglePlay) bool) []AppReviewGooglePlay {
+	sorted := append([]AppReviewGooglePlay{}, reviews...)
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	if len(sorted) > topReviewCount {
+		sorted = sorted[:topReviewCount]
+	}
+	return sorted
+}
+
+// deliverDigestReport sends a report to the webhook and the emails of its digest
+func deliverDigestReport(digest Digest, report DigestReport) error {
+	var errs []string
+	if digest.WebhookURL != "" {
+		payload, _ := json.Marshal(report)
+		if err := postSigned(digest.WebhookURL, digest.Secret, payload); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(digest.Emails) > 0 {
+		contentType, body, _ := RenderDigestReport(report, digest.Format)
+		if err := sendMail(digest.Emails, "Digest of "+subjectOf(report), strings.Split(contentType, ";")[0], body); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func subjectOf(report DigestReport) string {
+	subject := report.PackageName
+	if report.Project != "" {
+		subject = "project " + report.Project
+	}
+	return fmt.Sprintf("%s from %s to %s", subject, report.From.Format("2006-01-02"), report.To.Format("2006-01-02"))
+}
+
+// RenderDigestReport renders a report as JSON, Markdown or HTML. Returns the content type of the rendered report
+func RenderDigestReport(report DigestReport, format string) (string, []byte, error) {
+	switch format {
+	case "", formatJSON:
+		data, err := json.Marshal(report)
+		return TYPE_JSON, data, err
+	case formatMarkdown:
+		return "text/markdown; charset=utf-8", renderDigestMarkdown(report), nil
+	case formatHTML:
+		var buffer bytes.Buffer
+		err := digestTemplate.Execute(&buffer, report)
+		return "text/html; charset=utf-8", buffer.Bytes(), err
+	}
+	return "", nil, fmt.Errorf("invalid format %q: use %s, %s or %s", format, formatJSON, formatMarkdown, formatHTML)
+}
+
+func renderDigestMarkdown(report DigestReport) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Digest of %s\n", subjectOf(report))
+	for _, app := range report.Apps {
+		fmt.Fprintf(&b, "\n## %s\n\n", app.PackageName)
+		if app.PageRating != 0 {
+			fmt.Fprintf(&b, "Rating of the app page: %.2f\n\n", app.PageRating)
+		}
+		fmt.Fprintf(&b, "| New reviews | 1 star | 2 stars | 3 stars | 4 stars | 5 stars | Bug reports | Feature requests |\n")
+		fmt.Fprintf(&b, "|---|---|---|---|---|---|---|---|\n")
+		fmt.Fprintf(&b, "| %d | %d | %d | %d | %d | %d | %d | %d |\n", app.NewReviews,
+			app.ReviewsPerRating["1"], app.ReviewsPerRating["2"], app.ReviewsPerRating["3"], app.ReviewsPerRating["4"], app.ReviewsPerRating["5"],
+			app.BugReports, app.FeatureRequests)
+		writeMarkdownReviews(&b, "Longest reviews", app.LongestReviews)
+		writeMarkdownReviews(&b, "Most helpful reviews", app.HelpfulReviews)
+		if len(app.VersionChanges) > 0 {
+			fmt.Fprintf(&b, "\n### Versions\n\n")
+			for _, change := range app.VersionChanges {
+				fmt.Fprintf(&b, "- %s (first seen %s)\n", change.Version, change.FirstSeenAt.Format("2006-01-02 15:04"))
+			}
+		}
+		fmt.Fprintf(&b, "\n### Pipeline health\n\n%d runs, %d succeeded, %d failed\n", app.Health.Runs, app.Health.Succeeded, app.Health.Failed)
+		if app.Health.LastError != "" {
+			fmt.Fprintf(&b, "\nLast error: %s\n", app.Health.LastError)
+		}
+	}
+	return []byte(b.String())
+}
+
+func writeMarkdownReviews(b *strings.Builder, title string, reviews []AppReviewGooglePlay) {
+	if len(reviews) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\n### %s\n\n", title)
+	for _, review := range reviews {
+		fmt.Fprintf(b, "- %d/5", review.Rating)
+		if review.ThumbsUp > 0 {
+			fmt.Fprintf(b, ", %d helpful", review.ThumbsUp)
+		}
+		fmt.Fprintf(b, ": %s\n", strings.Replace(summaryOf(review.Title, review.Body, 280), "\n", " ", -1))
+	}
+}
+
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("2006-01-02") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Digest</title></head>
+<body>
+<h1>Digest {{if .Project}}of project {{.Project}}{{else}}of {{.PackageName}}{{end}} from {{date .From}} to {{date .To}}</h1>
+{{range .Apps}}
+<h2>{{.PackageName}}</h2>
+{{if .PageRating}}<p>Rating of the app page: {{printf "%.2f" .PageRating}}</p>{{end}}
+<table border="1">
+<tr><th>New reviews</th><th>1 star</th><th>2 stars</th><th>3 stars</th><th>4 stars</th><th>5 stars</th><th>Bug reports</th><th>Feature requests</th></tr>
+<tr><td>{{.NewReviews}}</td><td>{{index .ReviewsPerRating "1"}}</td><td>{{index .ReviewsPerRating "2"}}</td><td>{{index .ReviewsPerRating "3"}}</td><td>{{index .ReviewsPerRating "4"}}</td><td>{{index .ReviewsPerRating "5"}}</td><td>{{.BugReports}}</td><td>{{.FeatureRequests}}</td></tr>
+</table>
+{{if .LongestReviews}}<h3>Longest reviews</h3>
+<ul>{{range .LongestReviews}}<li>{{.Rating}}/5: {{if .Title}}<b>{{.Title}}</b> {{end}}{{.Body}}</li>{{end}}</ul>{{end}}
+{{if .HelpfulReviews}}<h3>Most helpful reviews</h3>
+<ul>{{range .HelpfulReviews}}<li>{{.Rating}}/5, {{.ThumbsUp}} helpful: {{if .Title}}<b>{{.Title}}</b> {{end}}{{.Body}}</li>{{end}}</ul>{{end}}
+{{if .VersionChanges}}<h3>Versions</h3>
+<ul>{{range .VersionChanges}}<li>{{.Version}} (first seen {{date .FirstSeenAt}})</li>{{end}}</ul>{{end}}
+<h3>Pipeline health</h3>
+<p>{{.Health.Runs}} runs, {{.Health.Succeeded}} succeeded, {{.Health.Failed}} failed</p>
+{{if .Health.LastError}}<p>Last error: {{.Health.LastError}}</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// pruneDigestData deletes the reviews and reports that are older than the given time
+func pruneDigestData(before time.Time) {
+	pruneReviews(before)
+
+	var keys []string
+	storeForEach(bucketDigestReports, func(key string, data []byte) error {
+		var report DigestReport
+		if err := json.Unmarshal(data, &report); err == nil && report.GeneratedAt.Before(before) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	for _, key := range keys {
+		if err := storeDelete(bucketDigestReports, key); err != nil {
+			log.Printf("ERR could not prune digest report %s: %v\n", key, err)
+		}
+	}
+}
+
+// SaveDigest adds or updates a digest
+func SaveDigest(digest Digest) error {
+	return storePut(bucketDigests, observableKey(digest.Tenant, digest.ID), digest)
+}
+
+// DigestOf returns a digest of a tenant
+func DigestOf(tenant string, id string) (Digest, bool) {
+	var digest Digest
+	ok, err := storeGet(bucketDigests, observableKey(tenant, id), &digest)
+	if err != nil {
+		log.Printf("ERR could not load digest %s: %v\n", id, err)
+	}
+	return digest, ok && digest.Tenant == tenant
+}
+
+// Digests returns all digests of a tenant
+func Digests(tenant string) []Digest {
+	digests := []Digest{}
+	if db == nil {
+		return digests
+	}
+	err := storeForEach(bucketDigests, func(key string, data []byte) error {
+		var digest Digest
+		if err := json.Unmarshal(data, &digest); err != nil {
+			return err
+		}
+		if digest.Tenant == tenant {
+			digests = append(digests, digest)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the digests: %v\n", err)
+	}
+	return digests
+}
+
+// SaveDigestReport adds a generated report
+func SaveDigestReport(report DigestReport) {
+	if err := storePut(bucketDigestReports, report.ID, report); err != nil {
+		log.Printf("ERR could not save digest report %s: %v\n", report.ID, err)
+	}
+}
+
+// DigestReports returns the stored reports of a digest, newest first
+func DigestReports(digest Digest) []DigestReport {
+	reports := []DigestReport{}
+	err := storeForEach(bucketDigestReports, func(key string, data []byte) error {
+		var report DigestReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			return err
+		}
+		if report.Tenant == digest.Tenant && report.DigestID == digest.ID {
+			reports = append([]DigestReport{report}, reports...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the digest reports: %v\n", err)
+	}
+	return reports
+}
+
+// postDigest creates a digest. The response contains the secret of its webhook, which is not shown again
+func postDigest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var digest Digest
+	if err := json.NewDecoder(r.Body).Decode(&digest); err != nil {
+		respondBadRequest(w, fmt.Errorf("invalid digest: %v", err))
+		return
+	}
+	if err := ValidateDigest(&digest); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	now := time.Now()
+	next := digest.nextAt(now)
+	digest.ID = newRunID(now)
+	digest.Tenant = tenantOf(r)
+	digest.CreatedAt = now
+	digest.NextAt = &next
+	digest.LastSentAt = nil
+	if err := SaveDigest(digest); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(digest)
+}
+
+// getDigests returns all digests without their secrets. Query parameters: project, tag. A digest matches if its app matches or it is the digest of the project
+func getDigests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	filter := observableFilterOf(r)
+	packageNames := packageNamesOf(filter)
+	digests := []Digest{}
+	for _, digest := range Digests(tenantOf(r)) {
+		if packageNames != nil && !packageNames[digest.PackageName] && (filter.Project == "" || filter.Project != digest.Project) {
+			continue
+		}
+		digest.Secret = ""
+		digests = append(digests, digest)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(digests)
+}
+
+// deleteDigest deletes a digest, its reports are kept until they are pruned
+func deleteDigest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	digest, ok := DigestOf(tenantOf(r), mux.Vars(r)["digest_id"])
+	if !ok {
+		respondUnknownDigest(w)
+		return
+	}
+	if err := storeDelete(bucketDigests, observableKey(digest.Tenant, digest.ID)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{Status: true, Message: "digest deleted"})
+}
+
+// getDigestReports returns the reports of a digest, newest first. Query parameters: project, tag. They restrict the apps of the reports
+func getDigestReports(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	digest, ok := DigestOf(tenantOf(r), mux.Vars(r)["digest_id"])
+	if !ok {
+		respondUnknownDigest(w)
+		return
+	}
+	packageNames := packageNamesOf(observableFilterOf(r))
+	reports := DigestReports(digest)
+	for i := range reports {
+		apps := []AppDigest{}
+		for _, app := range reports[i].Apps {
+			if matchesPackageNames(packageNames, app.PackageName) {
+				apps = append(apps, app)
+			}
+		}
+		reports[i].Apps = apps
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reports)
+}
+
+// getDigestReport renders a report of a digest. Query parameter format: json (default), markdown or html
+func getDigestReport(w http.ResponseWriter, r *http.Request) {
+	digest, ok := DigestOf(tenantOf(r), mux.Vars(r)["digest_id"])
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		respondUnknownDigest(w)
+		return
+	}
+	var report DigestReport
+	if found, _ := storeGet(bucketDigestReports, mux.Vars(r)["report_id"], &report); !found || report.Tenant != digest.Tenant || report.DigestID != digest.ID {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "unknown digest report"})
+		return
+	}
+	respondDigestReport(w, report, r.URL.Query().Get("format"))
+}
+
+// getDigestPreview generates a report on demand. Query parameters: package_name or project, period (default 168h), format
+func getDigestPreview(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	digest := Digest{PackageName: query.Get("package_name"), Project: query.Get("project"), Period: query.Get("period")}
+	if err := ValidateDigest(&digest); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respondBadRequest(w, err)
+		return
+	}
+	now := time.Now()
+	report := GenerateDigestReport(tenantOf(r), digest.PackageName, digest.Project, now.Add(-digest.period()), now)
+	respondDigestReport(w, report, query.Get("format"))
+}
+
+func respondDigestReport(w http.ResponseWriter, report DigestReport, format string) {
+	contentType, body, err := RenderDigestReport(report, format)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respondBadRequest(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func respondUnknownDigest(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(Response{Status: false, Message: "unknown digest"})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDigestPreview(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.digest.app/interval/daily?project=digesting"}.mustExecuteRequest(nil))
+	// the app page is only crawled for apps with a digest
+	nextAt := time.Now().Add(time.Hour)
+	SaveDigest(Digest{ID: "digest-preview", PackageName: "com.digest.app", Interval: defaultDigestInterval, Period: defaultDigestPeriod, NextAt: &nextAt})
+	defer storeDelete(bucketDigests, observableKey(defaultTenant, "digest-preview"))
+	runNow(t, "com.digest.app")
+
+	preview := endpoint{method: "GET", url: "/hitec/orchestration/app/digests/preview?%s"}
+	var report DigestReport
+	json.NewDecoder(preview.withVars("package_name=com.digest.app").mustExecuteRequest(nil).Body).Decode(&report)
+	if len(report.Apps) != 1 {
+		t.Fatalf("Expected a digest of the app. Got %+v instead", report)
+	}
+	app := report.Apps[0]
+	if app.NewReviews != 3 || app.BugReports != 1 || app.FeatureRequests != 1 || app.ReviewsPerRating["1"] != 1 || app.ReviewsPerRating["2"] != 0 || app.Health.Succeeded != 1 {
+		t.Errorf("Expected the signals of the run. Got %+v instead", app)
+	}
+	if len(app.LongestReviews) != 3 || app.LongestReviews[0].ReviewID != "digest-1" || len(app.HelpfulReviews) != 2 || app.HelpfulReviews[0].ReviewID != "digest-2" {
+		t.Errorf("Expected the top reviews by length and helpfulness. Got %+v and %+v instead", app.LongestReviews, app.HelpfulReviews)
+	}
+	if len(app.VersionChanges) != 1 || app.VersionChanges[0].Version != "1.0.0" {
+		t.Errorf("Expected the version of the app page. Got %+v instead", app.VersionChanges)
+	}
+
+	rr := preview.withVars("project=digesting&format=markdown").mustExecuteRequest(nil)
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/markdown") || !strings.Contains(rr.Body.String(), "## com.digest.app") || !strings.Contains(rr.Body.String(), "| 3 | 1 | 0 | 0 | 1 | 1 | 1 | 1 |") {
+		t.Errorf("Expected a Markdown digest. Got %s instead", rr.Body.String())
+	}
+	rr = preview.withVars("package_name=com.digest.app&format=html").mustExecuteRequest(nil)
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") || !strings.Contains(rr.Body.String(), "<h2>com.digest.app</h2>") {
+		t.Errorf("Expected an HTML digest. Got %s instead", rr.Body.String())
+	}
+	assertStatus(t, http.StatusBadRequest, preview.withVars("package_name=com.digest.app&format=pdf").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, preview.withVars("package_name=com.digest.app&period=1y").mustExecuteRequest(nil))
+}
+
+func TestScheduledDigest(t *testing.T) {
+	induceServerError = false
+	stub := newSMTPStub(t)
+	defer stub.listener.Close()
+	defer func(addr string, from string) { smtpAddr, smtpFrom = addr, from }(smtpAddr, smtpFrom)
+	smtpAddr, smtpFrom = stub.listener.Addr().String(), "orchestrator@example.com"
+
+	var delivered []DigestReport
+	var deliveredMutex sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report DigestReport
+		json.NewDecoder(r.Body).Decode(&report)
+		deliveredMutex.Lock()
+		delivered = append(delivered, report)
+		deliveredMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	digests := endpoint{method: "POST", url: "/hitec/orchestration/app/digests"}
+	assertStatus(t, http.StatusBadRequest, digests.mustExecuteRequest(Digest{Project: "digesting", Interval: intervalAdaptive}))
+	assertStatus(t, http.StatusBadRequest, digests.mustExecuteRequest(Digest{Project: "digesting", Format: "pdf"}))
+	rr := digests.mustExecuteRequest(Digest{Project: "digesting", WebhookURL: receiver.URL, Emails: []string{"team@example.com"}})
+	assertStatus(t, http.StatusCreated, rr)
+	var digest Digest
+	json.NewDecoder(rr.Body).Decode(&digest)
+	if digest.Interval != defaultDigestInterval || digest.NextAt == nil || digest.Secret == "" {
+		t.Fatalf("Expected a weekly digest. Got %+v instead", digest)
+	}
+
+	sendDueDigests(time.Now())
+	if len(stub.received()) != 0 {
+		t.Fatal("Expected the digest not to be due yet")
+	}
+	sendDueDigests(digest.NextAt.Add(time.Second))
+	if mails := stub.received(); len(mails) != 1 || !strings.Contains(mails[0], "Subject: Digest of project digesting") || !strings.Contains(mails[0], "Content-Type: text/html") {
+		t.Errorf("Expected the digest to be mailed as HTML. Got %v instead", mails)
+	}
+	deliveredMutex.Lock()
+	if len(delivered) != 1 || delivered[0].Project != "digesting" {
+		t.Errorf("Expected the digest to be posted to the webhook. Got %+v instead", delivered)
+	}
+	deliveredMutex.Unlock()
+
+	var reports []DigestReport
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/digests/" + digest.ID + "/reports"}.mustExecuteRequest(nil).Body).Decode(&reports)
+	if len(reports) != 1 || reports[0].Error != "" {
+		t.Fatalf("Expected the delivered report to be stored. Got %+v instead", reports)
+	}
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/digests/" + digest.ID + "/reports/" + reports[0].ID + "?format=markdown"}.mustExecuteRequest(nil)
+	assertStatus(t, http.StatusOK, rr)
+	if !strings.HasPrefix(rr.Body.String(), "# Digest of project digesting") {
+		t.Errorf("Expected the stored report as Markdown. Got %s instead", rr.Body.String())
+	}
+
+	assertSuccess(t, endpoint{method: "DELETE", url: "/hitec/orchestration/app/digests/" + digest.ID}.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/digests/" + digest.ID + "/reports"}.mustExecuteRequest(nil))
+}
+
+func TestKeptReviews(t *testing.T) {
+	from := time.Now()
+	reviews := []AppReviewGooglePlay{{ReviewID: "kept-1", PackageName: "com.kept.app"}, {ReviewID: "kept-2", PackageName: "com.kept.app"}, {ReviewID: "kept-3", PackageName: "com.kept.other"}}
+	KeepReviews(defaultTenant, reviews)
+	KeepReviews(defaultTenant, reviews[:1])
+	KeepReviews("kept", reviews[:1])
+
+	if kept := KeptReviews(defaultTenant, "com.kept.app", from, time.Now()); len(kept) != 2 || kept[0].Review.ReviewID == kept[1].Review.ReviewID {
+		t.Errorf("Expected the 2 reviews of the app to be kept once. Got %+v instead", kept)
+	}
+	if kept := KeptReviews(defaultTenant, "com.kept.app", from.Add(-time.Hour), from.Add(-time.Minute)); len(kept) != 0 {
+		t.Errorf("Expected no reviews before the period. Got %+v instead", kept)
+	}
+	if kept := KeptReviews("kept", "com.kept.app", from, time.Now()); len(kept) != 1 || kept[0].Tenant != "kept" {
+		t.Errorf("Expected the review of the other tenant. Got %+v instead", kept)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * discovery of competitors. If an observable opts in (query parameter discover), the similar apps of its app page are
+ * either proposed for observation (propose) or observed right away (auto) after each page crawl.
+ * Discovered apps inherit the interval, projects and discovery settings of the app that led to them and are tagged
+ * with competitor and its package name. They discover further competitors until the discovery depth is reached.
+ * Every discovered app is recorded as a proposal, so a rejected app is not proposed again.
+ */
+
+const (
+	bucketProposals = "proposals"
+
+	discoverPropose = "propose"
+	discoverAuto    = "auto"
+
+	proposalPending  = "pending"
+	proposalApproved = "approved"
+	proposalRejected = "rejected"
+
+	tagCompetitor = "competitor"
+
+	defaultDiscoverDepth = 1
+	maxDiscoverDepth     = 3
+	defaultDiscoverCount = 5
+	maxDiscoverCount     = 20
+)
+
+var errUnknownProposal = errors.New("unknown proposal")
+var errProposalDecided = errors.New("proposal was already decided")
+var errStorageUnreachable = errors.New("storage layer unreachable")
+
+// discoveryMutex serializes the changes of proposals
+var discoveryMutex sync.Mutex
+
+// applyDiscoverySettings sets the discovery settings of an observable if they are given as query parameters. Empty values reset them
+func applyDiscoverySettings(observable *ObservableGooglePlay, query url.Values) error {
+	if _, ok := query["discover"]; ok {
+		observable.Discover = query.Get("discover")
+	}
+	for name, field := range map[string]*int{"discover_depth": &observable.DiscoverDepth, "discover_count": &observable.DiscoverCount} {
+		if _, ok := query[name]; !ok {
+			continue
+		}
+		if query.Get(name) == "" {
+			*field = 0
+			continue
+		}
+		value, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			return fmt.Errorf("%s must be a number", name)
+		}
+		*field = value
+	}
+
+	if observable.Discover == "" {
+		observable.DiscoverDepth = 0
+		observable.DiscoverCount = 0
+		return nil
+	}
+	if observable.DiscoverDepth == 0 {
+		observable.DiscoverDepth = defaultDiscoverDepth
+	}
+	if observable.DiscoverCount == 0 {
+		observable.DiscoverCount = defaultDiscoverCount
+	}
+	return nil
+}
+
+// ValidateDiscoverySettings checks the discovery mode, depth and count of an observable
+func ValidateDiscoverySettings(observable ObservableGooglePlay) error {
+	switch observable.Discover {
+	case "":
+		return nil
+	case discoverPropose, discoverAuto:
+	default:
+		return fmt.Errorf("invalid discover %q: use %s or %s", observable.Discover, discoverPropose, discoverAuto)
+	}
+	if observable.DiscoverDepth < 1 || observable.DiscoverDepth > maxDiscoverDepth {
+		return fmt.Errorf("discover_depth must be between 1 and %d", maxDiscoverDepth)
+	}
+	if observable.DiscoverCount < 1 || observable.DiscoverCount > maxDiscoverCount {
+		return fmt.Errorf("discover_count must be between 1 and %d", maxDiscoverCount)
+	}
+	return nil
+}
+
+// DiscoverCompetitors proposes or observes the similar apps of a crawled app page. Returns the number of discovered apps
+func DiscoverCompetitors(tenant *Tenant, appPage AppPageGooglePlay) int {
+	seed, ok := ObservableOf(tenant.ID, appPage.PackageName)
+	if !ok || seed.Discover == "" || seed.DiscoveryLevel >= seed.DiscoverDepth {
+		return 0
+	}
+
+	discovered, observed := discover(tenant, seed, appPage.SimilarApps)
+	if observed > 0 {
+		EnsureObservation()
+	}
+	return discovered
+}
+
+func discover(tenant *Tenant, seed ObservableGooglePlay, similarApps []string) (int, int) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+
+	known := len(Proposals(tenant.ID, func(proposal Proposal) bool { return proposal.Observable.DiscoveredFrom == seed.PackageName }))
+	discovered, observed := 0, 0
+	now := time.Now()
+	for _, packageName := range similarApps {
+		if known+discovered >= seed.DiscoverCount {
+			break
+		}
+		if packageName == seed.PackageName || ValidatePackageName(packageName) != nil {
+			continue
+		}
+		if _, ok := ObservableOf(tenant.ID, packageName); ok {
+			continue
+		}
+		if _, ok := ProposalOf(tenant.ID, packageName); ok {
+			continue
+		}
+
+		proposal := Proposal{Status: proposalPending, ProposedAt: now, Observable: competitorOf(seed, packageName)}
+		if seed.Discover == discoverAuto {
+			if ok := observeCompetitor(tenant, proposal.Observable); ok {
+				proposal.Status = proposalApproved
+				proposal.DecidedAt = &now
+				observed++
+			} else {
+				log.Printf("could not observe competitor %s of %s, proposing it instead\n", packageName, keyOf(seed))
+			}
+		}
+		SaveProposal(proposal)
+		discovered++
+	}
+	return discovered, observed
+}
+
+// competitorOf returns the observable of a competitor discovered among the similar apps of the seed
+func competitorOf(seed ObservableGooglePlay, packageName string) ObservableGooglePlay {
+	competitor := ObservableGooglePlay{
+		Tenant:         seed.Tenant,
+		PackageName:    packageName,
+		Interval:       seed.Interval,
+		TimeZone:       seed.TimeZone,
+		Jitter:         seed.Jitter,
+		MinInterval:    seed.MinInterval,
+		MaxInterval:    seed.MaxInterval,
+		Projects:       seed.Projects,
+		Tags:           []string{tagCompetitor},
+		Discover:       seed.Discover,
+		DiscoverDepth:  seed.DiscoverDepth,
+		DiscoverCount:  seed.DiscoverCount,
+		DiscoveredFrom: seed.PackageName,
+		DiscoveryLevel: seed.DiscoveryLevel + 1,
+	}
+	if len(seed.PackageName) <= maxLabelLength {
+		competitor.Tags = normalizeLabels(append(competitor.Tags, seed.PackageName))
+	}
+	return competitor
+}
+
+// observeCompetitor stores a discovered app in the storage layer and the local snapshot. The observation has to be reloaded afterwards
+func observeCompetitor(tenant *Tenant, observable ObservableGooglePlay) bool {
+	if ok := RESTPostStoreObserveAppGooglePlay(tenant, observable.PackageName, observable.Interval); !ok {
+		return false
+	}
+	now := time.Now()
+	observable.ObservedSince = &now
+	RememberObservable(observable)
+	return true
+}
+
+// SaveProposal adds or updates a proposal
+func SaveProposal(proposal Proposal) {
+	if db == nil {
+		return
+	}
+	if err := storePut(bucketProposals, keyOf(proposal.Observable), proposal); err != nil {
+		log.Printf("ERR could not save proposal %s: %v\n", keyOf(proposal.Observable), err)
+	}
+}
+
+// ProposalOf returns the proposal of a package name of a tenant
+func ProposalOf(tenant string, packageName string) (Proposal, bool) {
+	var proposal Proposal
+	if db == nil {
+		return proposal, false
+	}
+	ok, err := storeGet(bucketProposals, observableKey(tenant, packageName), &proposal)
+	if err != nil {
+		log.Printf("ERR could not load proposal %s: %v\n", observableKey(tenant, packageName), err)
+	}
+	return proposal, ok
+}
+
+// Proposals returns the proposals of a tenant matching the filter, newest first
+func Proposals(tenant string, filter func(proposal Proposal) bool) []Proposal {
+	proposals := []Proposal{}
+	if db == nil {
+		return proposals
+	}
+	err := storeForEach(bucketProposals, func(key string, data []byte) error {
+		var proposal Proposal
+		if err := json.Unmarshal(data, &proposal); err != nil {
+			return err
+		}
+		if proposal.Observable.Tenant == tenant && filter(proposal) {
+			proposals = append(proposals, proposal)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the proposals: %v\n", err)
+	}
+	sort.Slice(proposals, func(i, j int) bool { return proposals[i].ProposedAt.After(proposals[j].ProposedAt) })
+	return proposals
+}
+
+// DecideProposal approves or rejects a pending proposal. An approved app is observed
+func DecideProposal(tenant *Tenant, packageName string, approve bool) (Proposal, error) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+
+	proposal, ok := ProposalOf(tenant.ID, packageName)
+	if !ok {
+		return proposal, errUnknownProposal
+	}
+	if proposal.Status != proposalPending {
+		return proposal, errProposalDecided
+	}
+
+	now := time.Now()
+	proposal.DecidedAt = &now
+	proposal.Status = proposalRejected
+	if approve {
+		if ok := observeCompetitor(tenant, proposal.Observable); !ok {
+			return proposal, errStorageUnreachable
+		}
+		proposal.Status = proposalApproved
+	}
+	SaveProposal(proposal)
+	return proposal, nil
+}
+
+// getProposals returns the proposals of discovered competitors. Query parameter status (default pending, all for every status)
+func getProposals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = proposalPending
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Proposals(tenantOf(r), func(proposal Proposal) bool {
+		return status == "all" || proposal.Status == status
+	}))
+}
+
+// postApproveProposal observes a proposed competitor
+func postApproveProposal(w http.ResponseWriter, r *http.Request) {
+	decideProposal(w, r, true)
+}
+
+// postRejectProposal rejects a proposed competitor, it is not proposed again
+func postRejectProposal(w http.ResponseWriter, r *http.Request) {
+	decideProposal(w, r, false)
+}
+
+func decideProposal(w http.ResponseWriter, r *http.Request, approve bool) {
+	w.Header().Set("Content-Type", "application/json")
+	tenant, _ := TenantOf(tenantOf(r))
+	proposal, err := DecideProposal(tenant, mux.Vars(r)["package_name"], approve)
+	switch err {
+	case nil:
+		if approve {
+			EnsureObservation()
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(proposal)
+		return
+	case errUnknownProposal:
+		w.WriteHeader(http.StatusNotFound)
+	case errProposalDecided:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+}
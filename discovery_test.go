@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// similarAppsOf are the similar apps of the app pages of the mocked collection layer
+var similarAppsOf = map[string][]string{
+	"com.discover.seed":      {"com.discover.seed", "invalid", "com.discover.rival", "com.discover.other"},
+	"com.discover.auto":      {"com.discover.autorival"},
+	"com.discover.autorival": {"com.discover.autodeep"},
+	"com.discover.autodeep":  {"com.discover.toodeep"},
+}
+
+func runNow(t *testing.T, packageName string) Run {
+	rr := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/%s/run"}.withVars(packageName).mustExecuteRequest(nil)
+	assertStatus(t, http.StatusAccepted, rr)
+	var run Run
+	json.NewDecoder(rr.Body).Decode(&run)
+	return waitForRun(t, run.ID)
+}
+
+func TestDiscoverySettings(t *testing.T) {
+	induceServerError = false
+	ep := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.discover.invalid/interval/daily?%s"}
+	assertStatus(t, http.StatusBadRequest, ep.withVars("discover=always").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, ep.withVars("discover=auto&discover_depth=9").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, ep.withVars("discover=auto&discover_count=many").mustExecuteRequest(nil))
+}
+
+func TestDiscoverCompetitorsProposals(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.discover.seed/interval/weekly?discover=propose&discover_count=1&project=discovery"}.mustExecuteRequest(nil))
+
+	if run := runNow(t, "com.discover.seed"); !run.PageCrawled || run.DiscoveredApps != 1 {
+		t.Errorf("Expected the page to be crawled and one competitor to be discovered. Got %+v instead", run)
+	}
+	if run := runNow(t, "com.discover.seed"); run.DiscoveredApps != 0 {
+		t.Errorf("Expected no further competitor beyond the discover count. Got %d", run.DiscoveredApps)
+	}
+	if _, ok := ObservableOf(defaultTenant, "com.discover.rival"); ok {
+		t.Error("Expected the competitor to be proposed only")
+	}
+
+	rr := endpoint{method: "GET", url: "/hitec/orchestration/app/discovery/proposals"}.mustExecuteRequest(nil)
+	var proposals []Proposal
+	json.NewDecoder(rr.Body).Decode(&proposals)
+	if len(proposals) != 1 || proposals[0].Observable.PackageName != "com.discover.rival" || proposals[0].Observable.DiscoveredFrom != "com.discover.seed" {
+		t.Fatalf("Expected com.discover.rival to be proposed. Got %+v instead", proposals)
+	}
+
+	approve := endpoint{method: "POST", url: "/hitec/orchestration/app/discovery/proposals/%s/approve"}
+	assertSuccess(t, approve.withVars("com.discover.rival").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusConflict, approve.withVars("com.discover.rival").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, endpoint{method: "POST", url: "/hitec/orchestration/app/discovery/proposals/org.unknown/reject"}.mustExecuteRequest(nil))
+
+	observable, ok := ObservableOf(defaultTenant, "com.discover.rival")
+	if !ok || observable.Interval != "weekly" || !containsString(observable.Tags, tagCompetitor) || !containsString(observable.Tags, "com.discover.seed") || !containsString(observable.Projects, "discovery") {
+		t.Errorf("Expected the approved competitor to be observed like its seed. Got %+v instead", observable)
+	}
+}
+
+func TestDiscoverCompetitorsAutomatically(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.discover.auto/interval/daily?discover=auto&discover_depth=2"}.mustExecuteRequest(nil))
+
+	runNow(t, "com.discover.auto")
+	rival, ok := ObservableOf(defaultTenant, "com.discover.autorival")
+	if !ok || rival.DiscoveryLevel != 1 {
+		t.Fatalf("Expected the competitor to be observed automatically. Got %+v instead", rival)
+	}
+
+	runNow(t, "com.discover.autorival")
+	if deep, ok := ObservableOf(defaultTenant, "com.discover.autodeep"); !ok || deep.DiscoveryLevel != 2 || deep.DiscoveredFrom != "com.discover.autorival" {
+		t.Fatalf("Expected the competitor of the competitor to be observed. Got %+v instead", deep)
+	}
+
+	runNow(t, "com.discover.autodeep")
+	if _, ok := ObservableOf(defaultTenant, "com.discover.toodeep"); ok {
+		t.Error("Expected the discovery to stop at its depth")
+	}
+}
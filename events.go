@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * domain events of the pipeline for downstream consumers. Events are written to an outbox in the local store, in the
+ * same transaction as the state change they describe where that state lives in the store (runs, observables), and
+ * relayed in order to the broker of EVENTS_BROKER:
+ *   memory  keeps the last EVENTS_MEMORY_SIZE events, readable via GET /hitec/orchestration/app/events
+ *   file    appends JSON lines to EVENTS_FILE
+ *   nats    publishes to the NATS server EVENTS_NATS_URL (subject EVENTS_SUBJECT_PREFIX.<type>)
+ *   kafka-rest  produces to the topic EVENTS_KAFKA_TOPIC via the Kafka REST proxy (v2 API) EVENTS_KAFKA_REST_URL, keyed
+ *               by package name. The orchestrator does not speak the Kafka protocol itself
+ * An event is deleted from the outbox once the broker accepted it, so consumers get every event at least once.
+ * Events the broker did not accept within the run history retention expire, so the outbox does not grow while the
+ * broker is down. Without EVENTS_BROKER no events are written.
+ */
+
+const (
+	bucketOutbox = "outbox"
+
+	eventObservableAdded   = "ObservableAdded"
+	eventObservableRemoved = "ObservableRemoved"
+	eventRunStarted        = "RunStarted"
+	eventRunSucceeded      = "RunSucceeded"
+	eventRunFailed         = "RunFailed"
+	eventReviewsClassified = "ReviewsClassified"
+	eventAppPageChanged    = "AppPageChanged"
+
+	brokerMemory    = "memory"
+	brokerFile      = "file"
+	brokerNATS      = "nats"
+	brokerKafkaREST = "kafka-rest"
+
+	defaultEventsMemorySize = 1000
+	outboxPageSize          = 100
+)
+
+// Broker publishes the events of the outbox
+type Broker interface {
+	Publish(event Event, payload []byte) error
+	Close() error
+}
+
+// broker is nil if events are disabled
+var broker Broker
+
+var eventsSubjectPrefix = getEnv("EVENTS_SUBJECT_PREFIX", "ri.orchestration.app")
+var eventsRelayInterval = time.Second
+
+// relayWakeup triggers the relay right after an event was written
+var relayWakeup = make(chan struct{}, 1)
+
+// relayMutex serializes the relay of the outbox, so events are published in order
+var relayMutex sync.Mutex
+
+// StartEvents configures the broker from the environment (EVENTS_BROKER) and relays the outbox, e.g. events left after a restart.
+// Expired events are pruned from the outbox once per hour
+func StartEvents() error {
+	b, err := NewBroker(os.Getenv("EVENTS_BROKER"))
+	if err != nil || b == nil {
+		return err
+	}
+	broker = b
+	go func() {
+		for range time.Tick(time.Hour) {
+			pruneOutbox(time.Now().Add(-runHistoryRetention))
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(eventsRelayInterval)
+		for {
+			relayOutbox(b)
+			select {
+			case <-ticker.C:
+			case <-relayWakeup:
+			}
+		}
+	}()
+	return nil
+}
+
+// NewBroker creates a broker by name, nil if the name is empty
+func NewBroker(name string) (Broker, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case brokerMemory:
+		return &MemoryBroker{size: parseIntEnv("EVENTS_MEMORY_SIZE", fmt.Sprint(defaultEventsMemorySize))}, nil
+	case brokerFile:
+		path := os.Getenv("EVENTS_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("EVENTS_BROKER=file requires EVENTS_FILE")
+		}
+		return &FileBroker{path: path}, nil
+	case brokerNATS:
+		u, err := url.Parse(os.Getenv("EVENTS_NATS_URL"))
+		if err != nil || u.Scheme != "nats" || u.Host == "" {
+			return nil, fmt.Errorf("EVENTS_BROKER=nats requires EVENTS_NATS_URL, e.g. nats://localhost:4222")
+		}
+		return &NATSBroker{address: u.Host, prefix: eventsSubjectPrefix}, nil
+	case brokerKafkaREST:
+		restURL := os.Getenv("EVENTS_KAFKA_REST_URL")
+		if restURL == "" {
+			return nil, fmt.Errorf("EVENTS_BROKER=kafka-rest requires EVENTS_KAFKA_REST_URL of a Kafka REST proxy")
+		}
+		return &KafkaRESTBroker{url: strings.TrimSuffix(restURL, "/"), topic: getEnv("EVENTS_KAFKA_TOPIC", "ri-orchestration-app-events")}, nil
+	}
+	return nil, fmt.Errorf("unsupported EVENTS_BROKER %q: use %s, %s, %s or %s", name, brokerMemory, brokerFile, brokerNATS, brokerKafkaREST)
+}
+
+// newEvent returns an event of an app. Data is encoded as JSON
+func newEvent(eventType string, tenant string, packageName string, runID string, data interface{}) Event {
+	now := time.Now()
+	event := Event{ID: newRunID(now), Type: eventType, Tenant: tenant, PackageName: packageName, RunID: runID, OccurredAt: now}
+	if data != nil {
+		event.Data, _ = json.Marshal(data)
+	}
+	return event
+}
+
+// putEvents writes events to the outbox within a transaction of the local store
+func putEvents(tx *bolt.Tx, events ...Event) error {
+	if broker == nil {
+		return nil
+	}
+	bucket := tx.Bucket([]byte(bucketOutbox))
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(event.ID), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wakeRelay relays the outbox without waiting for the next interval
+func wakeRelay() {
+	select {
+	case relayWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// PublishEvents writes events that do not belong to a state change of the local store to the outbox
+func PublishEvents(events ...Event) {
+	if broker == nil || db == nil || len(events) == 0 {
+		return
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return putEvents(tx, events...) }); err != nil {
+		log.Printf("ERR could not write events to the outbox: %v\n", err)
+		return
+	}
+	wakeRelay()
+}
+
+// relayOutbox publishes the events of the outbox in order to a broker, a page at a time. It stops at the first event the broker does not accept
+func relayOutbox(b Broker) {
+	relayMutex.Lock()
+	defer relayMutex.Unlock()
+	if b == nil || db == nil {
+		return
+	}
+	for {
+		// published events are deleted, so the next page starts at the oldest event again
+		events := OutboxEvents(outboxPageSize)
+		for _, event := range events {
+			payload, _ := json.Marshal(event)
+			if err := b.Publish(event, payload); err != nil {
+				log.Printf("ERR could not publish event %s %s, retrying: %v\n", event.Type, event.ID, err)
+				return
+			}
+			if err := storeDelete(bucketOutbox, event.ID); err != nil {
+				log.Printf("ERR could not delete event %s from the outbox: %v\n", event.ID, err)
+				return
+			}
+		}
+		if len(events) < outboxPageSize {
+			return
+		}
+	}
+}
+
+// OutboxEvents returns the oldest events, up to limit, that were not published yet, oldest first. A limit of 0 returns all events
+func OutboxEvents(limit int) []Event {
+	events := []Event{}
+	if db == nil {
+		return events
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(bucketOutbox)).Cursor()
+		for k, v := cursor.First(); k != nil && (limit == 0 || len(events) < limit); k, v = cursor.Next() {
+			var event Event
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the outbox: %v\n", err)
+	}
+	return events
+}
+
+// OutboxPending returns the number of events of a tenant that were not published yet
+func OutboxPending(tenant string) int {
+	pending := 0
+	err := storeForEach(bucketOutbox, func(key string, data []byte) error {
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			return err
+		}
+		if event.Tenant == tenant {
+			pending++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the outbox: %v\n", err)
+	}
+	return pending
+}
+
+// pruneOutbox deletes the events that occurred before the given time and were not published meanwhile
+func pruneOutbox(before time.Time) {
+	if db == nil {
+		return
+	}
+	relayMutex.Lock()
+	defer relayMutex.Unlock()
+	// event ids sort by the time they occurred
+	bound := []byte(newRunID(before))
+	expired := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketOutbox))
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil && bytes.Compare(k, bound) < 0; k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		expired = len(keys)
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not prune the outbox: %v\n", err)
+		return
+	}
+	if expired > 0 {
+		log.Printf("ERR %d events expired in the outbox, the broker did not accept them\n", expired)
+	}
+}
+
+// runEvents returns the events of a state change of a run
+func runEvents(run Run) []Event {
+	switch run.Status {
+	case runRunning:
+		return []Event{newEvent(eventRunStarted, run.Tenant, run.PackageName, run.ID, map[string]string{"trigger": run.Trigger})}
+	case runSucceeded:
+		return []Event{newEvent(eventRunSucceeded, run.Tenant, run.PackageName, run.ID, run.RunResult)}
+	case runFailed:
+		return []Event{newEvent(eventRunFailed, run.Tenant, run.PackageName, run.ID, map[string]string{"trigger": run.Trigger, "error": run.Error})}
+	}
+	return nil
+}
+
+// reviewsClassifiedEvent returns the event of the reviews classified by a run
+func reviewsClassifiedEvent(tenant string, packageName string, runID string, reviews []AppReviewGooglePlay) Event {
+	type classifiedReview struct {
+		ReviewID       string `json:"review_id"`
+		Rating         int    `json:"rating"`
+		BugReport      bool   `json:"bug_report"`
+		FeatureRequest bool   `json:"feature_request"`
+	}
+	classified := make([]classifiedReview, len(reviews))
+	for i, review := range reviews {
+		classified[i] = classifiedReview{ReviewID: review.ReviewID, Rating: review.Rating, BugReport: review.BugReport, FeatureRequest: review.FeatureRequest}
+	}
+	return newEvent(eventReviewsClassified, tenant, packageName, runID, map[string]interface{}{"count": len(reviews), "reviews": classified})
+}
+
+// appPageChangedEvent returns the event of a changed rating or version of an app page crawled by a run compared to the last run that crawled it, false if nothing changed
+func appPageChangedEvent(tenant string, runID string, appPage AppPageGooglePlay) (Event, bool) {
+	for _, run := range Runs(RunFilter{Tenant: tenant, PackageName: appPage.PackageName, Status: runSucceeded}) {
+		if !run.PageCrawled {
+			continue
+		}
+		if run.PageRating == appPage.Rating && run.AppVersion == appPage.CurrentSoftwareVersion {
+			return Event{}, false
+		}
+		return newEvent(eventAppPageChanged, tenant, appPage.PackageName, runID, map[string]interface{}{
+			"previous_rating":  run.PageRating,
+			"rating":           appPage.Rating,
+			"previous_version": run.AppVersion,
+			"version":          appPage.CurrentSoftwareVersion,
+		}), true
+	}
+	return Event{}, false
+}
+
+// MemoryBroker keeps the last events in memory
+type MemoryBroker struct {
+	mutex  sync.Mutex
+	size   int
+	events []Event
+}
+
+// Publish keeps an event, the oldest event is dropped if the broker is full
+func (b *MemoryBroker) Publish(event Event, payload []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.events = append(b.events, event)
+	if len(b.events) > b.size {
+		b.events = b.events[len(b.events)-b.size:]
+	}
+	return nil
+}
+
+// Close drops all events
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.events = nil
+	return nil
+}
+
+// Events returns the kept events of a tenant after the event with the given id, oldest first
+func (b *MemoryBroker) Events(tenant string, after string, eventType string) []Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	events := []Event{}
+	for _, event := range b.events {
+		if event.Tenant == tenant && event.ID > after && (eventType == "" || event.Type == eventType) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// FileBroker appends events as JSON lines to a file
+type FileBroker struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// Publish appends an event
+func (b *FileBroker) Publish(event Event, payload []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	file, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(payload, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Close does nothing, the file is closed after every event
+func (b *FileBroker) Close() error {
+	return nil
+}
+
+// NATSBroker publishes events with the NATS client protocol. Every publication is confirmed by a PING, so a failed connection is noticed
+type NATSBroker struct {
+	mutex   sync.Mutex
+	address string
+	prefix  string
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+// Publish publishes an event to the subject <prefix>.<type>
+func (b *NATSBroker) Publish(event Event, payload []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.conn == nil {
+		if err := b.connect(); err != nil {
+			return err
+		}
+	}
+	err := b.publish(b.prefix+"."+event.Type, payload)
+	if err != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+func (b *NATSBroker) connect() error {
+	conn, err := net.DialTimeout("tcp", b.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("no NATS server at %s", b.address)
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"ri-orchestration-app\"}\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	b.conn, b.reader = conn, reader
+	return nil
+}
+
+func (b *NATSBroker) publish(subject string, payload []byte) error {
+	b.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "PUB %s %d\r\n", subject, len(payload))
+	message.Write(payload)
+	message.WriteString("\r\nPING\r\n")
+	if _, err := b.conn.Write(message.Bytes()); err != nil {
+		return err
+	}
+	for {
+		line, err := b.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "PING"):
+			fmt.Fprintf(b.conn, "PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// Close closes the connection to the NATS server
+func (b *NATSBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+// KafkaRESTBroker produces events to a topic via the HTTP API (v2) of a Kafka REST proxy, e.g. the Confluent REST Proxy
+type KafkaRESTBroker struct {
+	url   string
+	topic string
+}
+
+// Publish produces an event keyed by its package name, so the events of an app stay in order
+func (b *KafkaRESTBroker) Publish(event Event, payload []byte) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": event.PackageName, "value": json.RawMessage(payload)}},
+	})
+	req, _ := http.NewRequest(POST, b.url+"/topics/"+url.PathEscape(b.topic), bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Add(ACCEPT, "application/vnd.kafka.v2+json")
+	res, err := externalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Kafka REST proxy responded with %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Close does nothing, every event is produced with its own request
+func (b *KafkaRESTBroker) Close() error {
+	return nil
+}
+
+// getEvents returns the events kept by the memory broker. Query parameters: after (event id), type
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	memory, ok := broker.(*MemoryBroker)
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "events are only kept with EVENTS_BROKER=memory"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(memory.Events(tenantOf(r), r.URL.Query().Get("after"), r.URL.Query().Get("type")))
+}
+
+// getOutbox returns the number of events of the tenant that were not published yet
+func getOutbox(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"pending": OutboxPending(tenantOf(r))})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.events.app/interval/daily?discover=propose"}.mustExecuteRequest(nil))
+	run := runNow(t, "com.events.app")
+	relayOutbox(broker)
+
+	var events []Event
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/events"}.mustExecuteRequest(nil).Body).Decode(&events)
+	var types []string
+	for _, event := range events {
+		if event.PackageName == "com.events.app" {
+			types = append(types, event.Type)
+		}
+	}
+	if strings.Join(types, ",") != "ObservableAdded,RunStarted,ReviewsClassified,RunSucceeded" {
+		t.Errorf("Expected the events of the app in order. Got %v instead", types)
+	}
+
+	var classified []Event
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/events?type=ReviewsClassified&after=%s"}.withVars(run.ID).mustExecuteRequest(nil).Body).Decode(&classified)
+	var data struct {
+		Count int `json:"count"`
+	}
+	if len(classified) == 0 || classified[len(classified)-1].RunID != run.ID || json.Unmarshal(classified[len(classified)-1].Data, &data) != nil || data.Count != 2 {
+		t.Errorf("Expected the classified reviews of the run. Got %+v instead", classified)
+	}
+
+	if _, changed := appPageChangedEvent(run.Tenant, "", AppPageGooglePlay{PackageName: "com.events.app", Rating: run.PageRating, CurrentSoftwareVersion: run.AppVersion}); changed {
+		t.Errorf("Expected no event of an unchanged app page")
+	}
+	if event, changed := appPageChangedEvent(run.Tenant, "next-run", AppPageGooglePlay{PackageName: "com.events.app", Rating: run.PageRating, CurrentSoftwareVersion: "2.0.0"}); !changed || event.RunID != "next-run" || !strings.Contains(string(event.Data), `"version":"2.0.0"`) {
+		t.Errorf("Expected an event of the new version. Got %+v instead", event)
+	}
+}
+
+func TestEventsOfUnstoredReviews(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/org.unstored.app/interval/daily"}.mustExecuteRequest(nil))
+	runNow(t, "org.unstored.app")
+	relayOutbox(broker)
+
+	for _, event := range broker.(*MemoryBroker).Events(defaultTenant, "", "") {
+		if event.PackageName == "org.unstored.app" && event.Type == eventReviewsClassified {
+			t.Errorf("Expected no event of reviews that could not be stored. Got %+v instead", event)
+		}
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	induceServerError = false
+	dir, _ := ioutil.TempDir(storeDir, "events")
+	PublishEvents(newEvent(eventRunFailed, "", "com.outbox.app", "", nil))
+	for i := 0; i < outboxPageSize; i++ {
+		PublishEvents(newEvent(eventRunFailed, "outbox", "com.outbox.app", "", nil))
+	}
+
+	relayOutbox(&FileBroker{path: filepath.Join(dir, "missing", "events.jsonl")})
+	if len(OutboxEvents(0)) == 0 {
+		t.Fatalf("Expected the events to stay in the outbox")
+	}
+	if pending := OutboxPending("outbox"); pending != outboxPageSize {
+		t.Errorf("Expected the pending events of the tenant only. Got %d instead", pending)
+	}
+
+	path := filepath.Join(dir, "events.jsonl")
+	relayOutbox(&FileBroker{path: path})
+	if pending := len(OutboxEvents(0)); pending != 0 {
+		t.Errorf("Expected an empty outbox. Got %d pending events instead", pending)
+	}
+	content, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(content), `"package_name":"com.outbox.app"`) {
+		t.Errorf("Expected the event in the file. Got %s instead", content)
+	}
+}
+
+func TestOutboxExpiry(t *testing.T) {
+	expired := newEvent(eventRunFailed, "", "com.outbox.expired", "", nil)
+	expired.ID = newRunID(time.Now().Add(-2 * runHistoryRetention))
+	PublishEvents(expired, newEvent(eventRunFailed, "", "com.outbox.kept", "", nil))
+
+	pruneOutbox(time.Now().Add(-runHistoryRetention))
+	var packageNames []string
+	for _, event := range OutboxEvents(0) {
+		packageNames = append(packageNames, event.PackageName)
+	}
+	if strings.Contains(strings.Join(packageNames, ","), "com.outbox.expired") || !strings.Contains(strings.Join(packageNames, ","), "com.outbox.kept") {
+		t.Errorf("Expected the expired event to be pruned. Got %v instead", packageNames)
+	}
+}
+
+func TestSnapshotEvents(t *testing.T) {
+	SaveSnapshot("snapshot-events", []ObservableGooglePlay{{Tenant: "snapshot-events", PackageName: "com.snapshot.kept"}, {Tenant: "snapshot-events", PackageName: "com.snapshot.removed"}})
+	SaveSnapshot("snapshot-events", []ObservableGooglePlay{{Tenant: "snapshot-events", PackageName: "com.snapshot.kept"}, {Tenant: "snapshot-events", PackageName: "com.snapshot.added"}})
+	relayOutbox(broker)
+
+	var types []string
+	for _, event := range broker.(*MemoryBroker).Events("snapshot-events", "", "") {
+		types = append(types, event.Type+" "+event.PackageName)
+	}
+	expected := "ObservableAdded com.snapshot.kept,ObservableAdded com.snapshot.removed,ObservableAdded com.snapshot.added,ObservableRemoved com.snapshot.removed"
+	if strings.Join(types, ",") != expected {
+		t.Errorf("Expected the events of the reconciled observables. Got %v instead", types)
+	}
+	SaveSnapshot("snapshot-events", nil)
+}
+
+func TestNATSBroker(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	published := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PUB"):
+				payload, _ := reader.ReadString('\n')
+				published <- strings.TrimSpace(line) + " " + strings.TrimSpace(payload)
+			case strings.HasPrefix(line, "PING"):
+				conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+
+	b := &NATSBroker{address: listener.Addr().String(), prefix: "ri.orchestration.app"}
+	defer b.Close()
+	event := newEvent(eventRunStarted, "", "com.nats.app", "", nil)
+	payload, _ := json.Marshal(event)
+	if err := b.Publish(event, payload); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-published; !strings.HasPrefix(message, "PUB ri.orchestration.app.RunStarted ") || !strings.Contains(message, `"package_name":"com.nats.app"`) {
+		t.Errorf("Expected the event on its subject. Got %s instead", message)
+	}
+}
+
+func TestKafkaRESTBroker(t *testing.T) {
+	var records struct {
+		Records []struct {
+			Key   string `json:"key"`
+			Value Event  `json:"value"`
+		} `json:"records"`
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/events" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&records)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	event := newEvent(eventRunSucceeded, "", "com.kafka.app", "", nil)
+	payload, _ := json.Marshal(event)
+	if err := (&KafkaRESTBroker{url: proxy.URL, topic: "events"}).Publish(event, payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Records) != 1 || records.Records[0].Key != "com.kafka.app" || records.Records[0].Value.ID != event.ID {
+		t.Errorf("Expected the event keyed by its app. Got %+v instead", records)
+	}
+	if err := (&KafkaRESTBroker{url: proxy.URL, topic: "unknown"}).Publish(event, payload); err == nil {
+		t.Errorf("Expected an error of the proxy")
+	}
+}
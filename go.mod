@@ -0,0 +1,12 @@
+module github.com/OpenReqEU/ri-orchestration-app
+
+go 1.25.0
+
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/robfig/cron v1.2.0
+	go.etcd.io/bbolt v1.5.0
+)
+
+require golang.org/x/sys v0.45.0 // indirect
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * issue-tracker integration. Reviews classified as bug report are turned into issues of the issue sinks of a tenant
+ * (ISSUE_SINKS_FILE). Every review is linked to the issue it was reported in, so it is never reported twice.
+ * If grouping is enabled for a sink, a review is added to the issue of a similar review of the same app (Jaccard
+ * similarity of their words) and that issue is updated instead of creating a new one.
+ * Issues that could not be created are retried with the next bug reports of the sink.
+ */
+
+const (
+	bucketIssues     = "issues"
+	bucketIssueLinks = "issue_links"
+
+	issueSinkREST = "rest"
+
+	defaultIssueSimilarity = 0.5
+	maxIssueReviews        = 50
+	maxIssueTitleLength    = 80
+)
+
+// IssueSink creates and updates issues in an issue tracker
+type IssueSink interface {
+	// CreateIssue returns the id and the link of the created issue
+	CreateIssue(issue Issue) (string, string, error)
+	UpdateIssue(id string, issue Issue) error
+}
+
+// IssueSinkConfig model of the ISSUE_SINKS_FILE
+type IssueSinkConfig struct {
+	Name         string   `json:"name"`
+	Tenant       string   `json:"tenant,omitempty"`
+	Type         string   `json:"type"`
+	URL          string   `json:"url"`
+	Token        string   `json:"token,omitempty"`
+	IDField      string   `json:"id_field,omitempty"`
+	LinkField    string   `json:"link_field,omitempty"`
+	Labels       []string `json:"labels,omitempty"`
+	PackageNames []string `json:"package_names,omitempty"`
+	Group        bool     `json:"group"`
+	Similarity   float64  `json:"similarity,omitempty"`
+}
+
+type configuredIssueSink struct {
+	config IssueSinkConfig
+	sink   IssueSink
+}
+
+var issueSinks []configuredIssueSink
+
+// issuesMutex serializes the grouping of bug reports into issues, so a review is never reported twice
+var issuesMutex sync.Mutex
+
+// issueSyncMutexes are the mutexes of the issue sinks by name, see issueSyncMutexOf
+var issueSyncMutexes = map[string]*sync.Mutex{}
+
+// LoadIssueSinks configures the issue sinks from the environment (ISSUE_SINKS_FILE)
+func LoadIssueSinks() error {
+	issueSinksFile := os.Getenv("ISSUE_SINKS_FILE")
+	if issueSinksFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(issueSinksFile)
+	if err != nil {
+		return err
+	}
+	var configs []IssueSinkConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("invalid issue sinks file: %v", err)
+	}
+
+	sinks := []configuredIssueSink{}
+	names := map[string]bool{}
+	for _, config := range configs {
+		sink, err := NewIssueSink(&config)
+		if err != nil {
+			return err
+		}
+		if names[observableKey(config.Tenant, config.Name)] {
+			return fmt.Errorf("duplicate issue sink %q", config.Name)
+		}
+		names[observableKey(config.Tenant, config.Name)] = true
+		sinks = append(sinks, configuredIssueSink{config: config, sink: sink})
+	}
+	issueSinks = sinks
+	return nil
+}
+
+// NewIssueSink validates the configuration of an issue sink, sets its defaults and creates it
+func NewIssueSink(config *IssueSinkConfig) (IssueSink, error) {
+	if config.Name == "" || strings.ContainsAny(config.Name, "/ ") {
+		return nil, fmt.Errorf("invalid issue sink name %q", config.Name)
+	}
+	if config.Similarity == 0 {
+		config.Similarity = defaultIssueSimilarity
+	}
+	if config.Similarity < 0 || config.Similarity > 1 {
+		return nil, fmt.Errorf("issue sink %q: similarity must be between 0 and 1", config.Name)
+	}
+	switch config.Type {
+	case "", issueSinkREST:
+		config.Type = issueSinkREST
+		if config.URL == "" {
+			return nil, fmt.Errorf("issue sink %q needs a url", config.Name)
+		}
+		if config.IDField == "" {
+			config.IDField = "number"
+		}
+		if config.LinkField == "" {
+			config.LinkField = "html_url"
+		}
+		return &RESTIssueSink{config: *config}, nil
+	}
+	return nil, fmt.Errorf("issue sink %q: unsupported type %q", config.Name, config.Type)
+}
+
+// RESTIssueSink creates issues with POST {url}/issues and updates them with PATCH {url}/issues/{id}, e.g. in GitHub or Gitea
+type RESTIssueSink struct {
+	config IssueSinkConfig
+}
+
+// CreateIssue creates an issue. The id and the link are read from the fields IDField and LinkField of the response
+func (s *RESTIssueSink) CreateIssue(issue Issue) (string, string, error) {
+	issue.Labels = s.config.Labels
+	var created map[string]interface{}
+	if err := s.do(POST, s.config.URL+"/issues", issue, &created); err != nil {
+		return "", "", err
+	}
+	id, ok := created[s.config.IDField]
+	if !ok {
+		return "", "", fmt.Errorf("issue tracker responded without %s", s.config.IDField)
+	}
+	link, _ := created[s.config.LinkField].(string)
+	return jsonString(id), link, nil
+}
+
+// UpdateIssue replaces the title and the body of an issue
+func (s *RESTIssueSink) UpdateIssue(id string, issue Issue) error {
+	return s.do("PATCH", s.config.URL+"/issues/"+id, issue, nil)
+}
+
+func (s *RESTIssueSink) do(method string, url string, issue Issue, response interface{}) error {
+	requestBody := new(bytes.Buffer)
+	json.NewEncoder(requestBody).Encode(issue)
+	req, _ := http.NewRequest(method, url, requestBody)
+	req.Header.Set("Content-Type", TYPE_JSON)
+	req.Header.Add(ACCEPT, TYPE_JSON)
+	if s.config.Token != "" {
+		req.Header.Set(AUTHORIZATION, "Bearer "+s.config.Token)
+	}
+	res, err := externalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("issue tracker responded with %d", res.StatusCode)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+// jsonString formats a JSON value as string, numbers without exponent
+func jsonString(value interface{}) string {
+	if number, ok := value.(float64); ok {
+		return fmt.Sprintf("%.0f", number)
+	}
+	return fmt.Sprint(value)
+}
+
+// SyncIssues reports the bug reports among the classified reviews of an app to the issue sinks of the tenant. The app version is the one of the crawled app page
+func SyncIssues(tenant string, packageName string, appVersion string, reviews []AppReviewGooglePlay) {
+	if len(issueSinks) == 0 {
+		return
+	}
+
+	for _, configured := range issueSinks {
+		config := configured.config
+		if config.Tenant != tenant || (len(config.PackageNames) > 0 && !containsString(config.PackageNames, packageName)) {
+			continue
+		}
+		for _, id := range groupIssues(config, packageName, appVersion, reviews) {
+			syncIssueGroup(configured.sink, id)
+		}
+	}
+}
+
+// groupIssues links the new bug reports of an app to the issues of a sink and saves the issues. Returns the ids of the issues to create or update
+func groupIssues(config IssueSinkConfig, packageName string, appVersion string, reviews []AppReviewGooglePlay) []string {
+	issuesMutex.Lock()
+	defer issuesMutex.Unlock()
+
+	tenant := config.Tenant
+	groups := IssueGroups(IssueFilter{Tenant: tenant, Sink: config.Name})
+	changed := map[string]bool{}
+	for _, group := range groups {
+		if group.IssueID == "" {
+			changed[group.ID] = true
+		}
+	}
+	for _, review := range reviews {
+		if !review.BugReport || issueLinked(tenant, config.Name, review.ReviewID) {
+			continue
+		}
+		issueReview := IssueReview{ReviewID: review.ReviewID, Rating: review.Rating, Title: review.Title, Body: review.Body, PermaLink: review.PermaLink, AppVersion: appVersion}
+		index := -1
+		if config.Group {
+			index = similarIssueGroup(groups, packageName, issueReview, config.Similarity)
+		}
+		if index < 0 {
+			groups = append(groups, IssueGroup{ID: newRunID(time.Now()), Tenant: tenant, Sink: config.Name, PackageName: packageName, CreatedAt: time.Now()})
+			index = len(groups) - 1
+		}
+		if len(groups[index].Reviews) < maxIssueReviews {
+			groups[index].Reviews = append(groups[index].Reviews, issueReview)
+			changed[groups[index].ID] = true
+		}
+		linkIssue(tenant, config.Name, review.ReviewID, groups[index].ID)
+	}
+
+	var ids []string
+	for _, group := range groups {
+		if !changed[group.ID] {
+			continue
+		}
+		if err := storePut(bucketIssues, group.ID, group); err != nil {
+			log.Printf("ERR could not save issue %s: %v\n", group.ID, err)
+			continue
+		}
+		ids = append(ids, group.ID)
+	}
+	return ids
+}
+
+// issueSyncMutexOf returns the mutex that serializes the calls to the issue tracker of a sink, so an issue is never created twice
+func issueSyncMutexOf(sink string) *sync.Mutex {
+	issuesMutex.Lock()
+	defer issuesMutex.Unlock()
+	mutex, ok := issueSyncMutexes[sink]
+	if !ok {
+		mutex = &sync.Mutex{}
+		issueSyncMutexes[sink] = mutex
+	}
+	return mutex
+}
+
+// syncIssueGroup creates or updates the issue of a group with its latest reviews. The issue tracker is called without holding issuesMutex
+func syncIssueGroup(sink IssueSink, id string) {
+	var group IssueGroup
+	if ok, err := storeGet(bucketIssues, id, &group); !ok {
+		log.Printf("ERR could not load issue %s: %v\n", id, err)
+		return
+	}
+	syncMutex := issueSyncMutexOf(group.Sink)
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	// another run may have synchronized the issue meanwhile
+	storeGet(bucketIssues, id, &group)
+
+	issue := issueOf(group)
+	issueID, issueURL := group.IssueID, group.IssueURL
+	var err error
+	if issueID == "" {
+		issueID, issueURL, err = sink.CreateIssue(issue)
+	} else {
+		err = sink.UpdateIssue(issueID, issue)
+	}
+	if err != nil {
+		log.Printf("ERR could not sync issue %s of %s to %s: %v\n", group.ID, group.PackageName, group.Sink, err)
+	}
+
+	// reviews may have been added meanwhile, only the state of the issue is updated
+	issuesMutex.Lock()
+	defer issuesMutex.Unlock()
+	storeGet(bucketIssues, id, &group)
+	group.IssueID, group.IssueURL, group.Error = issueID, issueURL, ""
+	if err != nil {
+		group.Error = err.Error()
+	}
+	group.UpdatedAt = time.Now()
+	if err := storePut(bucketIssues, group.ID, group); err != nil {
+		log.Printf("ERR could not save issue %s: %v\n", group.ID, err)
+	}
+}
+
+// issueOf maps the reviews of a group to an issue
+func issueOf(group IssueGroup) Issue {
+	title := fmt.Sprintf("[%s] %s", group.PackageName, summaryOf(group.Reviews[0].Title, group.Reviews[0].Body, maxIssueTitleLength))
+	if len(group.Reviews) > 1 {
+		title += fmt.Sprintf(" (%d reviews)", len(group.Reviews))
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Bug report from the Google Play reviews of %s.\n", group.PackageName)
+	for _, review := range group.Reviews {
+		fmt.Fprintf(&body, "\n### Review %s\n\n", review.ReviewID)
+		fmt.Fprintf(&body, "- Rating: %d/5\n", review.Rating)
+		if review.AppVersion != "" {
+			fmt.Fprintf(&body, "- App version: %s\n", review.AppVersion)
+		}
+		if review.PermaLink != "" {
+			fmt.Fprintf(&body, "- Link: %s\n", review.PermaLink)
+		}
+		if review.Title != "" {
+			fmt.Fprintf(&body, "\n**%s**\n", review.Title)
+		}
+		fmt.Fprintf(&body, "\n> %s\n", strings.Replace(review.Body, "\n", "\n> ", -1))
+	}
+	return Issue{Title: title, Body: body.String()}
+}
+
+// summaryOf returns the title of a review or, if it has none, the beginning of its body, shortened to length characters
+func summaryOf(title string, body string, length int) string {
+	summary := title
+	if summary == "" {
+		summary = body
+	}
+	if runes := []rune(summary); len(runes) > length {
+		summary = strings.TrimSpace(string(runes[:length])) + "..."
+	}
+	return summary
+}
+
+// similarIssueGroup returns the index of the group of the app with the most similar first review, -1 if none reaches the threshold
+func similarIssueGroup(groups []IssueGroup, packageName string, review IssueReview, threshold float64) int {
+	index, best := -1, 0.0
+	words := wordsOf(review.Title + " " + review.Body)
+	for i, group := range groups {
+		if group.PackageName != packageName || len(group.Reviews) == 0 {
+			continue
+		}
+		first := group.Reviews[0]
+		if similarity := jaccard(words, wordsOf(first.Title+" "+first.Body)); similarity >= threshold && similarity > best {
+			index, best = i, similarity
+		}
+	}
+	return index
+}
+
+// wordsOf returns the set of lower case words with at least three letters
+func wordsOf(text string) map[string]bool {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if len(word) >= 3 {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+func jaccard(a map[string]bool, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	intersection := 0
+	for word := range a {
+		if b[word] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
+
+func issueLinkKey(tenant string, sink string, reviewID string) string {
+	return observableKey(tenant, sink+"/"+reviewID)
+}
+
+func issueLinked(tenant string, sink string, reviewID string) bool {
+	var groupID string
+	ok, err := storeGet(bucketIssueLinks, issueLinkKey(tenant, sink, reviewID), &groupID)
+	if err != nil {
+		log.Printf("ERR could not load the issue link of review %s: %v\n", reviewID, err)
+	}
+	return ok
+}
+
+func linkIssue(tenant string, sink string, reviewID string, groupID string) {
+	if err := storePut(bucketIssueLinks, issueLinkKey(tenant, sink, reviewID), groupID); err != nil {
+		log.Printf("ERR could not link review %s to issue %s: %v\n", reviewID, groupID, err)
+	}
+}
+
+// IssueFilter selects issues of a tenant. Other empty fields match every issue
+type IssueFilter struct {
+	Tenant      string
+	Sink        string
+	PackageName string
+	// PackageNames restricts the issues to a set of apps, e.g. the ones of a project
+	PackageNames map[string]bool
+}
+
+// IssueGroups returns the issues matching the filter, oldest first
+func IssueGroups(filter IssueFilter) []IssueGroup {
+	groups := []IssueGroup{}
+	if db == nil {
+		return groups
+	}
+	err := storeForEach(bucketIssues, func(key string, data []byte) error {
+		var group IssueGroup
+		if err := json.Unmarshal(data, &group); err != nil {
+			return err
+		}
+		if group.Tenant == filter.Tenant && (filter.Sink == "" || filter.Sink == group.Sink) && (filter.PackageName == "" || filter.PackageName == group.PackageName) && matchesPackageNames(filter.PackageNames, group.PackageName) {
+			groups = append(groups, group)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the issues: %v\n", err)
+	}
+	return groups
+}
+
+// getIssues returns the issues created from bug reports with their reviews. Query parameters: package_name, sink, project, tag
+func getIssues(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	filter := IssueFilter{Tenant: tenantOf(r), Sink: query.Get("sink"), PackageName: query.Get("package_name"), PackageNames: packageNamesOf(observableFilterOf(r))}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(IssueGroups(filter))
+}
+
+// getIssueSinks returns the issue sinks of the tenant without their tokens
+func getIssueSinks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	configs := []IssueSinkConfig{}
+	for _, configured := range issueSinks {
+		if configured.config.Tenant == tenantOf(r) {
+			config := configured.config
+			config.Token = ""
+			configs = append(configs, config)
+		}
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Name < configs[j].Name })
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(configs)
+}
+
+// getIssueOfReview returns the issues a review was reported in
+func getIssueOfReview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reviewID := mux.Vars(r)["review_id"]
+	groups := []IssueGroup{}
+	for _, group := range IssueGroups(IssueFilter{Tenant: tenantOf(r)}) {
+		for _, review := range group.Reviews {
+			if review.ReviewID == reviewID {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	if len(groups) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "review was not reported in an issue"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(groups)
+}
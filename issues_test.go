@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeIssueTracker is an issue tracker with a GitHub like REST API. The first creation of an issue fails
+type fakeIssueTracker struct {
+	sync.Mutex
+	issues  map[string]Issue
+	creates int
+	updates int
+}
+
+func (f *fakeIssueTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.Header.Get(AUTHORIZATION) != "Bearer tracker-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var issue Issue
+	json.NewDecoder(r.Body).Decode(&issue)
+	switch {
+	case r.Method == POST && r.URL.Path == "/issues":
+		f.creates++
+		if f.creates == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		number := len(f.issues) + 1
+		f.issues[fmt.Sprint(number)] = issue
+		respond(w, http.StatusCreated, map[string]interface{}{"number": number, "html_url": fmt.Sprintf("https://tracker.example.com/issues/%d", number)})
+	case r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/issues/"):
+		id := strings.TrimPrefix(r.URL.Path, "/issues/")
+		if _, ok := f.issues[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.updates++
+		issue.Labels = f.issues[id].Labels
+		f.issues[id] = issue
+		respond(w, http.StatusOK, map[string]interface{}{"number": id})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSyncIssues(t *testing.T) {
+	induceServerError = false
+	tracker := &fakeIssueTracker{issues: map[string]Issue{}}
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+
+	config := IssueSinkConfig{Name: "tracker", URL: server.URL, Token: "tracker-token", Labels: []string{"bug"}, PackageNames: []string{"com.issues.app"}, Group: true}
+	sink, err := NewIssueSink(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(sinks []configuredIssueSink) { issueSinks = sinks }(issueSinks)
+	issueSinks = []configuredIssueSink{{config: config, sink: sink}}
+
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.issues.app/interval/daily"}.mustExecuteRequest(nil))
+	runNow(t, "com.issues.app")
+	runNow(t, "com.issues.app")
+
+	tracker.Lock()
+	if len(tracker.issues) != 2 || tracker.updates != 0 {
+		t.Fatalf("Expected the failed issue to be retried and no duplicates. Got %+v instead", tracker.issues)
+	}
+	camera := tracker.issues["2"]
+	if !strings.Contains(camera.Title, "(2 reviews)") || !strings.Contains(camera.Body, "App version: 1.0.0") || !strings.Contains(camera.Body, "https://play.google.com/review/issue-1") || camera.Labels[0] != "bug" {
+		t.Errorf("Expected the similar crashes in one issue. Got %+v instead", camera)
+	}
+	tracker.Unlock()
+
+	reviewsOf["com.issues.app"] = append(reviewsOf["com.issues.app"], AppReviewGooglePlay{ReviewID: "issue-5", PackageName: "com.issues.app", Rating: 1, Body: "crashes when I open the camera", BugReport: true})
+	runNow(t, "com.issues.app")
+	tracker.Lock()
+	if tracker.updates != 1 || !strings.Contains(tracker.issues["2"].Title, "(3 reviews)") {
+		t.Errorf("Expected the issue to be updated with the new bug report. Got %+v instead", tracker.issues["2"])
+	}
+	tracker.Unlock()
+
+	var groups []IssueGroup
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/issues?package_name=com.issues.app"}.mustExecuteRequest(nil).Body).Decode(&groups)
+	if len(groups) != 2 || groups[0].IssueURL != "https://tracker.example.com/issues/2" || groups[0].Error != "" {
+		t.Errorf("Expected the issues with their links. Got %+v instead", groups)
+	}
+	assertStatus(t, http.StatusOK, endpoint{method: "GET", url: "/hitec/orchestration/app/issues/reviews/issue-5"}.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/issues/reviews/issue-4"}.mustExecuteRequest(nil))
+
+	var sinks []IssueSinkConfig
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/issues/sinks"}.mustExecuteRequest(nil).Body).Decode(&sinks)
+	if len(sinks) != 1 || sinks[0].Token != "" {
+		t.Errorf("Expected the sink without its token. Got %+v instead", sinks)
+	}
+}
+
+func TestNewIssueSink(t *testing.T) {
+	for _, config := range []IssueSinkConfig{
+		{Name: "", URL: "https://tracker.example.com"},
+		{Name: "tracker", Type: "mail", URL: "https://tracker.example.com"},
+		{Name: "tracker"},
+		{Name: "tracker", URL: "https://tracker.example.com", Similarity: 2},
+	} {
+		if _, err := NewIssueSink(&config); err == nil {
+			t.Errorf("Expected %+v to be invalid", config)
+		}
+	}
+}
+
+func TestSummaryOf(t *testing.T) {
+	if summary := summaryOf("", "Größenänderung geht nicht", 5); summary != "Größe..." {
+		t.Errorf("Expected the body to be shortened by characters. Got %q instead", summary)
+	}
+	if summary := summaryOf("Absturz", "Die App stürzt ständig ab", 10); summary != "Absturz" {
+		t.Errorf("Expected the title. Got %q instead", summary)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * projects and tags group observed apps. An app can belong to several projects and carry free-form tags
+ * like "competitor" or "own-app". Lists of observables, runs, alerts, digests, dead letters, issues and requirements
+ * and the export can be filtered by both (query parameters project and tag), and a whole project
+ * can be paused, resumed, run or given a new interval at once.
+ */
+
+const maxLabelLength = 64
+
+// ObservableFilter selects observables of a tenant by project and tag. Empty projects and tags match every observable
+type ObservableFilter struct {
+	Tenant  string
+	Project string
+	Tag     string
+}
+
+func observableFilterOf(r *http.Request) ObservableFilter {
+	return ObservableFilter{Tenant: tenantOf(r), Project: r.URL.Query().Get("project"), Tag: r.URL.Query().Get("tag")}
+}
+
+// matchesPackageNames returns true if an app is in a set of packageNamesOf. A nil set matches every app
+func matchesPackageNames(packageNames map[string]bool, packageName string) bool {
+	return packageNames == nil || packageNames[packageName]
+}
+
+func (f ObservableFilter) isEmpty() bool {
+	return f.Project == "" && f.Tag == ""
+}
+
+func (f ObservableFilter) matches(observable ObservableGooglePlay) bool {
+	return f.Tenant == observable.Tenant &&
+		(f.Project == "" || containsString(observable.Projects, f.Project)) &&
+		(f.Tag == "" || containsString(observable.Tags, f.Tag))
+}
+
+// packageNamesOf returns the package names of all observables matching the filter, nil if the filter is empty
+func packageNamesOf(filter ObservableFilter) map[string]bool {
+	if filter.isEmpty() {
+		return nil
+	}
+	packageNames := map[string]bool{}
+	for _, status := range ObservableStatuses(filter) {
+		packageNames[status.PackageName] = true
+	}
+	return packageNames
+}
+
+// ValidateLabels checks the projects and tags of an observable
+func ValidateLabels(observable ObservableGooglePlay) error {
+	for _, label := range append(append([]string{}, observable.Projects...), observable.Tags...) {
+		if label == "" || len(label) > maxLabelLength || strings.ContainsAny(label, ",;/") || strings.TrimSpace(label) != label {
+			return fmt.Errorf("invalid project or tag %q: use 1 to %d characters without leading or trailing spaces and without , ; /", label, maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// normalizeLabels sorts the labels and removes duplicates
+func normalizeLabels(labels []string) []string {
+	seen := map[string]bool{}
+	var normalized []string
+	for _, label := range labels {
+		if !seen[label] {
+			seen[label] = true
+			normalized = append(normalized, label)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// splitLabels splits a list of labels separated by semicolons (CSV import)
+func splitLabels(value string) []string {
+	var labels []string
+	for _, label := range strings.Split(value, ";") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// Projects returns all projects of a tenant with the number of their observables
+func Projects(tenant string) []Project {
+	counts := map[string]int{}
+	for _, status := range ObservableStatuses(ObservableFilter{Tenant: tenant}) {
+		for _, project := range status.Projects {
+			counts[project]++
+		}
+	}
+	projects := []Project{}
+	for name, count := range counts {
+		projects = append(projects, Project{Name: name, Observables: count})
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	return projects
+}
+
+// putLabelsObservableGooglePlay replaces the projects and tags of an observed app
+func putLabelsObservableGooglePlay(w http.ResponseWriter, r *http.Request) {
+	packageName := mux.Vars(r)["package_name"]
+	w.Header().Set("Content-Type", "application/json")
+
+	var labels Labels
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		respondBadRequest(w, fmt.Errorf("invalid labels: %v", err))
+		return
+	}
+	if err := ValidateLabels(ObservableGooglePlay{Projects: labels.Projects, Tags: labels.Tags}); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+
+	observable, ok := UpdateObservable(tenantOf(r), packageName, func(observable *ObservableGooglePlay) {
+		observable.Projects = normalizeLabels(labels.Projects)
+		observable.Tags = normalizeLabels(labels.Tags)
+	})
+	respondObservable(w, observable, ok)
+}
+
+// getProjects returns all projects
+func getProjects(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Projects(tenantOf(r)))
+}
+
+// projectObservables returns the observables of the project of the request. Responds with 404 if the project has none
+func projectObservables(w http.ResponseWriter, r *http.Request) (string, []ObservableStatus, bool) {
+	project := mux.Vars(r)["project"]
+	statuses := ObservableStatuses(ObservableFilter{Tenant: tenantOf(r), Project: project})
+	if len(statuses) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "project has no observed apps"})
+		return project, nil, false
+	}
+	return project, statuses, true
+}
+
+// respondBulkReport responds with the report, with 207 if the operation failed for some apps
+func respondBulkReport(w http.ResponseWriter, report BulkReport) {
+	status := http.StatusOK
+	for _, result := range report.Results {
+		if !result.Status {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// postPauseProject pauses all apps of a project. The optional query parameter resume_at (RFC 3339) resumes them automatically
+func postPauseProject(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	resumeAt, err := resumeAtOf(r)
+	if err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	project, statuses, ok := projectObservables(w, r)
+	if !ok {
+		return
+	}
+
+	report := BulkReport{Project: project}
+	for _, status := range statuses {
+		_, err := PauseObservable(status.Tenant, status.PackageName, resumeAt)
+		addBulkResult(&report, status.PackageName, err == nil, "paused")
+	}
+	respondBulkReport(w, report)
+}
+
+// postResumeProject resumes all apps of a project
+func postResumeProject(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	project, statuses, ok := projectObservables(w, r)
+	if !ok {
+		return
+	}
+
+	report := BulkReport{Project: project}
+	for _, status := range statuses {
+		_, err := ResumeObservable(status.Tenant, status.PackageName)
+		addBulkResult(&report, status.PackageName, err == nil, "resumed")
+	}
+	respondBulkReport(w, report)
+}
+
+// postRunProject queues a manual run for all apps of a project
+func postRunProject(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	project, statuses, ok := projectObservables(w, r)
+	if !ok {
+		return
+	}
+
+	report := BulkReport{Project: project}
+	for _, status := range statuses {
+		run, err := jobQueue.Enqueue(status.Tenant, status.PackageName, triggerManual)
+		if err != nil {
+			report.Results = append(report.Results, BulkResult{PackageName: status.PackageName, Status: false, Message: err.Error()})
+			continue
+		}
+		report.Results = append(report.Results, BulkResult{PackageName: status.PackageName, Status: true, Message: "queued run " + run.ID})
+	}
+	respondBulkReport(w, report)
+}
+
+// postIntervalProject changes the interval of all apps of a project and reloads the observation once
+func postIntervalProject(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	interval := mux.Vars(r)["interval"]
+	if _, err := ParseObserverInterval(interval); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	project, statuses, ok := projectObservables(w, r)
+	if !ok {
+		return
+	}
+	for _, status := range statuses {
+		observable := status.ObservableGooglePlay
+		observable.Interval = interval
+		if err := ValidateScheduleSettings(observable); err != nil {
+			respondBadRequest(w, fmt.Errorf("%s: %v", observable.PackageName, err))
+			return
+		}
+	}
+
+	tenant, _ := TenantOf(tenantOf(r))
+	report := BulkReport{Project: project}
+	for _, status := range statuses {
+		if ok := RESTPostStoreObserveAppGooglePlay(tenant, status.PackageName, interval); !ok {
+			addBulkResult(&report, status.PackageName, false, "")
+			continue
+		}
+		_, ok := UpdateObservable(status.Tenant, status.PackageName, func(observable *ObservableGooglePlay) {
+			observable.Interval = interval
+			if !isAdaptive(*observable) {
+				observable.Adaptive = nil
+			}
+		})
+		addBulkResult(&report, status.PackageName, ok, "interval changed to "+interval)
+	}
+	EnsureObservation()
+	respondBulkReport(w, report)
+}
+
+func addBulkResult(report *BulkReport, packageName string, ok bool, message string) {
+	if !ok {
+		message = "storage layer unreachable or app no longer observed"
+	}
+	report.Results = append(report.Results, BulkResult{PackageName: packageName, Status: ok, Message: message})
+}
+
+func resumeAtOf(r *http.Request) (*time.Time, error) {
+	value := r.URL.Query().Get("resume_at")
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume_at %q: use RFC 3339, e.g. 2006-01-02T15:04:05Z", value)
+	}
+	if !t.After(time.Now()) {
+		return nil, fmt.Errorf("resume_at %q must be in the future", value)
+	}
+	return &t, nil
+}
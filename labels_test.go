@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProjectsAndTags(t *testing.T) {
+	induceServerError = false
+	observe := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/%s/interval/daily?%s"}
+	assertSuccess(t, observe.withVars("com.project.own", "project=acme&tag=own-app").mustExecuteRequest(nil))
+	assertSuccess(t, observe.withVars("com.project.rival", "project=acme&project=globex&tag=competitor").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, observe.withVars("com.project.rival", "tag=a%2Cb").mustExecuteRequest(nil))
+
+	labels := endpoint{method: "PUT", url: "/hitec/orchestration/app/observe/google-play/package-name/%s/labels"}
+	assertSuccess(t, labels.withVars("com.project.own").mustExecuteRequest(Labels{Projects: []string{"acme"}, Tags: []string{"own-app", "beta"}}))
+	assertStatus(t, http.StatusNotFound, labels.withVars("org.unknown").mustExecuteRequest(Labels{}))
+
+	var statuses []ObservableStatus
+	rr := endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play?project=acme&tag=competitor"}.mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&statuses)
+	if len(statuses) != 1 || statuses[0].PackageName != "com.project.rival" {
+		t.Errorf("Expected only the competitor of the project. Got %+v instead", statuses)
+	}
+
+	var projects []Project
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/projects"}.mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&projects)
+	if !containsProject(projects, Project{Name: "acme", Observables: 2}) || !containsProject(projects, Project{Name: "globex", Observables: 1}) {
+		t.Errorf("Expected the projects with their number of apps. Got %+v instead", projects)
+	}
+
+	project := endpoint{method: "POST", url: "/hitec/orchestration/app/projects/%s/%s"}
+	assertSuccess(t, project.withVars("acme", "pause").mustExecuteRequest(nil))
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play?project=acme"}.mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&statuses)
+	for _, status := range statuses {
+		if status.State != statePaused {
+			t.Errorf("Expected all apps of the project to be paused. Got %+v instead", status)
+		}
+	}
+	assertSuccess(t, project.withVars("acme", "resume").mustExecuteRequest(nil))
+	assertSuccess(t, project.withVars("acme", "interval/weekly").mustExecuteRequest(nil))
+	if observable, _ := ObservableOf(defaultTenant, "com.project.rival"); observable.Interval != "weekly" || observable.Paused {
+		t.Errorf("Expected the project to be resumed with the new interval. Got %+v instead", observable)
+	}
+	assertStatus(t, http.StatusBadRequest, project.withVars("acme", "interval/sometimes").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, project.withVars("initech", "pause").mustExecuteRequest(nil))
+
+	rr = project.withVars("globex", "run").mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	var report BulkReport
+	json.NewDecoder(rr.Body).Decode(&report)
+	if len(report.Results) != 1 || !report.Results[0].Status {
+		t.Fatalf("Expected a run of the project to be queued. Got %+v instead", report)
+	}
+	waitForRun(t, Runs(RunFilter{PackageName: "com.project.rival", Limit: 1})[0].ID)
+
+	var runs []Run
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/runs?project=globex"}.mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&runs)
+	if len(runs) != 1 || runs[0].PackageName != "com.project.rival" {
+		t.Errorf("Expected the runs of the project only. Got %+v instead", runs)
+	}
+}
+
+func TestRespondBulkReport(t *testing.T) {
+	rr := httptest.NewRecorder()
+	respondBulkReport(rr, BulkReport{Project: "acme", Results: []BulkResult{{PackageName: "com.acme.a", Status: true}, {PackageName: "com.acme.b", Status: false}}})
+	assertStatus(t, http.StatusMultiStatus, rr)
+	rr = httptest.NewRecorder()
+	respondBulkReport(rr, BulkReport{Project: "acme", Results: []BulkResult{{PackageName: "com.acme.a", Status: true}}})
+	assertStatus(t, http.StatusOK, rr)
+}
+
+func containsProject(projects []Project, project Project) bool {
+	for _, p := range projects {
+		if p == project {
+			return true
+		}
+	}
+	return false
+}
+
+func TestImportLabels(t *testing.T) {
+	observables, err := parseImport(bytes.NewBufferString("package_name,interval,projects,tags\ncom.labels.app,daily,acme; globex,competitor\n"), formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observables[0].Projects) != 2 || observables[0].Projects[1] != "globex" || observables[0].Tags[0] != "competitor" {
+		t.Errorf("Expected projects and tags to be imported. Got %+v instead", observables[0])
+	}
+}
+
+func TestFilterByProject(t *testing.T) {
+	induceServerError = false
+	observe := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/%s/interval/daily?%s"}
+	assertSuccess(t, observe.withVars("com.filter.in", "project=initrode&tag=filtered").mustExecuteRequest(nil))
+	assertSuccess(t, observe.withVars("com.filter.out", "project=umbrella").mustExecuteRequest(nil))
+
+	now := time.Now()
+	for _, packageName := range []string{"com.filter.in", "com.filter.out"} {
+		SaveAlert(Alert{RuleID: "filter-rule", Tenant: defaultTenant, PackageName: packageName, Status: alertFiring})
+		RecordDeadLetter(Run{ID: packageName, Tenant: defaultTenant, PackageName: packageName, Trigger: triggerScheduled, FinishedAt: &now})
+		SaveDigest(Digest{ID: "filter-" + packageName, Tenant: defaultTenant, PackageName: packageName, Interval: "daily"})
+		storePut(bucketIssues, "filter-"+packageName, IssueGroup{ID: "filter-" + packageName, Tenant: defaultTenant, Sink: "filter-sink", PackageName: packageName})
+		KeepReviews(defaultTenant, []AppReviewGooglePlay{{ReviewID: packageName, PackageName: packageName, FeatureRequest: true}})
+	}
+	SaveDigest(Digest{ID: "filter-project", Tenant: defaultTenant, Project: "initrode", Interval: "daily"})
+	SaveDigestReport(DigestReport{ID: "filter-report", DigestID: "filter-project", Tenant: defaultTenant, Apps: []AppDigest{{PackageName: "com.filter.in"}, {PackageName: "com.filter.out"}}})
+
+	for url, expected := range map[string][]string{
+		"/hitec/orchestration/app/observables/export?project=initrode":      {"com.filter.in"},
+		"/hitec/orchestration/app/alerts?rule_id=filter-rule&tag=filtered":  {"com.filter.in"},
+		"/hitec/orchestration/app/dead-letters?project=initrode":            {"com.filter.in"},
+		"/hitec/orchestration/app/issues?sink=filter-sink&project=initrode": {"com.filter.in"},
+		"/hitec/orchestration/app/digests?project=initrode":                 {"com.filter.in", ""},
+	} {
+		var items []struct {
+			PackageName string `json:"package_name"`
+		}
+		rr := endpoint{method: "GET", url: url}.mustExecuteRequest(nil)
+		assertSuccess(t, rr)
+		json.NewDecoder(rr.Body).Decode(&items)
+		var packageNames []string
+		for _, item := range items {
+			packageNames = append(packageNames, item.PackageName)
+		}
+		sort.Strings(packageNames)
+		sort.Strings(expected)
+		if strings.Join(packageNames, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected %s to return %v. Got %v instead", url, expected, packageNames)
+		}
+	}
+
+	var requirements []Requirement
+	rr := endpoint{method: "GET", url: "/hitec/orchestration/app/requirements?project=initrode"}.mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&requirements)
+	if len(requirements) != 1 || requirements[0].ID != "review-com.filter.in" {
+		t.Errorf("Expected the requirements of the project only. Got %+v instead", requirements)
+	}
+
+	var reports []DigestReport
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/digests/filter-project/reports?tag=filtered"}.mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&reports)
+	if len(reports) != 1 || len(reports[0].Apps) != 1 || reports[0].Apps[0].PackageName != "com.filter.in" {
+		t.Errorf("Expected the reports to contain the matching apps only. Got %+v instead", reports)
+	}
+}
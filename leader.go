@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * Leader election: only the leader schedules observations, all other replicas are followers.
+ * The leader renews its lease periodically; a follower takes over once the lease expired.
+ * The store (STORE_PATH) is not shared: every replica prunes its own run history and resumes its own webhook deliveries.
+ */
+
+// LeaseBackend is the shared store of the leadership lease
+type LeaseBackend interface {
+	// TryAcquire acquires or renews the lease for holder. Returns true if holder owns the lease afterwards
+	TryAcquire(holder string, duration time.Duration) (bool, error)
+	// Release gives up the lease if it is owned by holder
+	Release(holder string) error
+}
+
+// Lease model
+type Lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// elector is nil if leader election is disabled. The replica is then always the leader
+var elector *LeaderElector
+
+// LeaderElector keeps track of the leadership of this replica
+type LeaderElector struct {
+	backend  LeaseBackend
+	holder   string
+	duration time.Duration
+	onChange func(leader bool)
+
+	mutex   sync.Mutex
+	leader  bool
+	renewed time.Time
+}
+
+// NewLeaderElector creates an elector. onChange is called whenever the leadership of this replica changes
+func NewLeaderElector(backend LeaseBackend, holder string, duration time.Duration, onChange func(leader bool)) *LeaderElector {
+	return &LeaderElector{backend: backend, holder: holder, duration: duration, onChange: onChange}
+}
+
+// IsLeader returns true if this replica should schedule observations
+func IsLeader() bool {
+	if elector == nil {
+		return true
+	}
+	return elector.IsLeader()
+}
+
+// IsLeader returns true if the elector holds the lease
+func (e *LeaderElector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.leader && e.leaseValid(time.Now())
+}
+
+// leaseValid returns true if the last renewed lease is valid for at least one more tick. The leadership ends a tick before
+// the lease expires, so it never overlaps with a replica that acquires the expired lease
+func (e *LeaderElector) leaseValid(now time.Time) bool {
+	return now.Sub(e.renewed) < e.duration-e.duration/4
+}
+
+// Run acquires and renews the lease until stop is closed. The lease is released afterwards
+func (e *LeaderElector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.duration / 4)
+	defer ticker.Stop()
+
+	e.tick()
+	for {
+		select {
+		case <-stop:
+			if err := e.backend.Release(e.holder); err != nil {
+				log.Printf("ERR could not release the lease: %v\n", err)
+			}
+			e.setLeader(false)
+			return
+		case <-ticker.C:
+			e.tick()
+		}
+	}
+}
+
+func (e *LeaderElector) tick() {
+	// the lease counts from the request on, the backend may take a while to answer
+	requested := time.Now()
+	acquired, err := e.backend.TryAcquire(e.holder, e.duration)
+
+	e.mutex.Lock()
+	if err != nil {
+		log.Printf("ERR could not renew the lease: %v\n", err)
+		// keep the leadership as long as the last renewed lease is valid
+		acquired = e.leader && e.leaseValid(time.Now())
+	} else if acquired {
+		e.renewed = requested
+	}
+	e.mutex.Unlock()
+
+	e.setLeader(acquired)
+}
+
+func (e *LeaderElector) setLeader(leader bool) {
+	e.mutex.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	e.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if leader {
+		log.Printf("%s became the leader\n", e.holder)
+	} else {
+		log.Printf("%s became a follower\n", e.holder)
+	}
+	if e.onChange != nil {
+		e.onChange(leader)
+	}
+}
+
+// LeaderStatus returns the role of this replica
+func LeaderStatus() ComponentStatus {
+	if elector == nil {
+		return ComponentStatus{Status: statusOK, Message: "leader election disabled"}
+	}
+	if elector.IsLeader() {
+		return ComponentStatus{Status: statusOK, Message: "leader"}
+	}
+	return ComponentStatus{Status: statusOK, Message: "follower"}
+}
+
+// becameLeader starts the work of the leader that is not checked periodically
+func becameLeader() {
+	RequestCatchUp()
+}
+
+// StartLeaderElection enables the leader election if LEADER_ELECTION is set. Supported backends: http, bolt (replicas of a single host only).
+// Without leader election this replica is the leader right away
+func StartLeaderElection() error {
+	backendName := os.Getenv("LEADER_ELECTION")
+	if backendName == "" {
+		becameLeader()
+		return nil
+	}
+
+	duration, err := time.ParseDuration(getEnv("LEASE_DURATION", "15s"))
+	if err != nil {
+		return err
+	}
+
+	var backend LeaseBackend
+	switch backendName {
+	case "http":
+		leaseURL := os.Getenv("LEASE_URL")
+		if leaseURL == "" {
+			return fmt.Errorf("LEADER_ELECTION=http requires LEASE_URL")
+		}
+		backend = &HTTPLeaseBackend{URL: leaseURL, Client: &http.Client{Timeout: 5 * time.Second}}
+	case "bolt":
+		backend = &BoltLeaseBackend{Path: getEnv("LEASE_PATH", "leader.lease")}
+	default:
+		return fmt.Errorf("unknown leader election backend %q", backendName)
+	}
+
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	elector = NewLeaderElector(backend, holder, duration, func(leader bool) {
+		if leader {
+			becameLeader()
+		}
+		EnsureObservation()
+	})
+	go elector.Run(make(chan struct{}))
+	return nil
+}
+
+/*
+ * lease backend based on a bolt db shared by all replicas of a single host (e.g. via a shared volume).
+ * The file lock of bolt guarantees that only one replica accesses the lease at a time.
+ */
+
+var leaseBucket = []byte("lease")
+var leaseKey = []byte("leader")
+
+// BoltLeaseBackend stores the lease in a bolt db
+type BoltLeaseBackend struct {
+	Path string
+}
+
+// TryAcquire acquires the lease if it is free, expired or already held by holder
+func (b *BoltLeaseBackend) TryAcquire(holder string, duration time.Duration) (bool, error) {
+	acquired := false
+	err := b.update(func(bucket *bolt.Bucket) error {
+		var lease Lease
+		if data := bucket.Get(leaseKey); data != nil {
+			if err := json.Unmarshal(data, &lease); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		if lease.Holder != "" && lease.Holder != holder && now.Before(lease.Expires) {
+			return nil
+		}
+
+		acquired = true
+		data, err := json.Marshal(Lease{Holder: holder, Expires: now.Add(duration)})
+		if err != nil {
+			return err
+		}
+		return bucket.Put(leaseKey, data)
+	})
+	return acquired, err
+}
+
+// Release deletes the lease if it is held by holder
+func (b *BoltLeaseBackend) Release(holder string) error {
+	return b.update(func(bucket *bolt.Bucket) error {
+		var lease Lease
+		if data := bucket.Get(leaseKey); data != nil {
+			if err := json.Unmarshal(data, &lease); err != nil {
+				return err
+			}
+		}
+		if lease.Holder != holder {
+			return nil
+		}
+		return bucket.Delete(leaseKey)
+	})
+}
+
+func (b *BoltLeaseBackend) update(fn func(bucket *bolt.Bucket) error) error {
+	leaseDB, err := bolt.Open(b.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer leaseDB.Close()
+
+	return leaseDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(leaseBucket)
+		if err != nil {
+			return err
+		}
+		return fn(bucket)
+	})
+}
+
+/*
+ * lease backend based on a resource of a key-value store shared by all replicas, accessed via HTTP. The store must
+ * support conditional requests: a GET returns the lease with its ETag, a PUT or DELETE with If-Match only succeeds if
+ * the lease did not change meanwhile and a PUT with If-None-Match: * only succeeds if there is no lease.
+ */
+
+// HTTPLeaseBackend stores the lease at URL
+type HTTPLeaseBackend struct {
+	URL    string
+	Client *http.Client
+}
+
+// TryAcquire acquires the lease if it is free, expired or already held by holder
+func (b *HTTPLeaseBackend) TryAcquire(holder string, duration time.Duration) (bool, error) {
+	lease, etag, err := b.get()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if lease.Holder != "" && lease.Holder != holder && now.Before(lease.Expires) {
+		return false, nil
+	}
+
+	data, err := json.Marshal(Lease{Holder: holder, Expires: now.Add(duration)})
+	if err != nil {
+		return false, err
+	}
+	request, err := http.NewRequest("PUT", b.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	b.setCondition(request, etag)
+	response, err := b.Client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusPreconditionFailed:
+		// another replica changed the lease meanwhile
+		return false, nil
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return false, fmt.Errorf("could not write the lease: %s", response.Status)
+	}
+	return true, nil
+}
+
+// Release deletes the lease if it is held by holder
+func (b *HTTPLeaseBackend) Release(holder string) error {
+	lease, etag, err := b.get()
+	if err != nil || lease.Holder != holder {
+		return err
+	}
+	request, err := http.NewRequest("DELETE", b.URL, nil)
+	if err != nil {
+		return err
+	}
+	b.setCondition(request, etag)
+	response, err := b.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusPreconditionFailed && (response.StatusCode < 200 || response.StatusCode > 299) {
+		return fmt.Errorf("could not delete the lease: %s", response.Status)
+	}
+	return nil
+}
+
+// get returns the current lease and its ETag. A missing lease is empty
+func (b *HTTPLeaseBackend) get() (Lease, string, error) {
+	var lease Lease
+	response, err := b.Client.Get(b.URL)
+	if err != nil {
+		return lease, "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return lease, "", nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return lease, "", fmt.Errorf("could not read the lease: %s", response.Status)
+	}
+	etag := response.Header.Get("ETag")
+	if etag == "" {
+		return lease, "", fmt.Errorf("the lease store does not support conditional requests, no ETag")
+	}
+	return lease, etag, json.NewDecoder(response.Body).Decode(&lease)
+}
+
+func (b *HTTPLeaseBackend) setCondition(request *http.Request, etag string) {
+	if etag == "" {
+		request.Header.Set("If-None-Match", "*")
+		return
+	}
+	request.Header.Set("If-Match", etag)
+}
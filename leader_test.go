@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	backend := &BoltLeaseBackend{Path: filepath.Join(storeDir, "leader.lease")}
+	duration := 100 * time.Millisecond
+	var changes []bool
+	first := NewLeaderElector(backend, "first", duration, func(leader bool) { changes = append(changes, leader) })
+	second := NewLeaderElector(backend, "second", duration, nil)
+
+	first.tick()
+	second.tick()
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatal("Expected the first replica to be the only leader")
+	}
+
+	// the first replica stops renewing its lease
+	time.Sleep(duration + 20*time.Millisecond)
+	second.tick()
+	if !second.IsLeader() {
+		t.Error("Expected the second replica to take over after the lease expired")
+	}
+	first.tick()
+	if first.IsLeader() {
+		t.Error("Expected the first replica to step down")
+	}
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("Expected the first replica to become leader and follower. Got %v instead", changes)
+	}
+
+	if err := backend.Release("second"); err != nil {
+		t.Fatal(err)
+	}
+	first.tick()
+	if !first.IsLeader() {
+		t.Error("Expected the first replica to take over a released lease")
+	}
+}
+
+// unreachableLeaseBackend fails once its lease store became unreachable
+type unreachableLeaseBackend struct {
+	BoltLeaseBackend
+	unreachable bool
+}
+
+func (b *unreachableLeaseBackend) TryAcquire(holder string, duration time.Duration) (bool, error) {
+	if b.unreachable {
+		return false, fmt.Errorf("lease store unreachable")
+	}
+	return b.BoltLeaseBackend.TryAcquire(holder, duration)
+}
+
+func TestLeaderStepsDown(t *testing.T) {
+	backend := &unreachableLeaseBackend{BoltLeaseBackend: BoltLeaseBackend{Path: filepath.Join(storeDir, "stepdown.lease")}}
+	duration := 100 * time.Millisecond
+	leader := NewLeaderElector(backend, "leader", duration, nil)
+	leader.tick()
+	backend.unreachable = true
+	leader.tick()
+	if !leader.IsLeader() {
+		t.Fatal("Expected the leader to keep a valid lease it could not renew")
+	}
+
+	// the next tick would come after the lease expired
+	time.Sleep(duration - duration/4)
+	if leader.IsLeader() {
+		t.Error("Expected the leader to step down a tick before the lease expires")
+	}
+	leader.tick()
+	if leader.IsLeader() {
+		t.Error("Expected the leader to give up the lease it could not renew")
+	}
+}
+
+func TestHTTPLeaseBackend(t *testing.T) {
+	var mutex sync.Mutex
+	var stored []byte
+	version := 0
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		etag := fmt.Sprintf("%q", strconv.Itoa(version))
+		if (stored == nil && r.Header.Get("If-Match") != "") || (stored != nil && (r.Header.Get("If-None-Match") == "*" || (r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag))) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			w.Write(stored)
+		case "PUT":
+			stored, _ = ioutil.ReadAll(r.Body)
+			version++
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			stored = nil
+			version++
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer store.Close()
+
+	backend := &HTTPLeaseBackend{URL: store.URL, Client: store.Client()}
+	duration := 100 * time.Millisecond
+	first := NewLeaderElector(backend, "first", duration, nil)
+	second := NewLeaderElector(backend, "second", duration, nil)
+
+	first.tick()
+	second.tick()
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatal("Expected the first replica to be the only leader")
+	}
+	time.Sleep(duration + 20*time.Millisecond)
+	second.tick()
+	first.tick()
+	if !second.IsLeader() || first.IsLeader() {
+		t.Error("Expected the second replica to take over after the lease expired")
+	}
+
+	isStored := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return stored != nil
+	}
+	if err := backend.Release("first"); err != nil || !isStored() {
+		t.Errorf("Expected the lease of another replica to be kept. Got %v instead", err)
+	}
+	if err := backend.Release("second"); err != nil || isStored() {
+		t.Errorf("Expected the lease to be released. Got %v instead", err)
+	}
+	first.tick()
+	if !first.IsLeader() {
+		t.Error("Expected the first replica to take over a released lease")
+	}
+}
@@ -1,11 +1,252 @@
 package main
 
-// ObservableGooglePlay model
-type ObservableGooglePlay struct {
-	PackageName string `json:"package_name" bson:"package_name"`
-	Interval    string `json:"interval" bson:"interval"`
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/OpenReqEU/ri-orchestration-app/orchestration"
+)
+
+// models of the API, see package orchestration
+type (
+	ObservableGooglePlay = orchestration.ObservableGooglePlay
+	AdaptiveState        = orchestration.AdaptiveState
+	ObservableStatus     = orchestration.ObservableStatus
+	EffectiveSchedule    = orchestration.EffectiveSchedule
+	Run                  = orchestration.Run
+	RunResult            = orchestration.RunResult
+	Progress             = orchestration.Progress
+	DeadLetter           = orchestration.DeadLetter
+	Event                = orchestration.Event
+	Labels               = orchestration.Labels
+	Project              = orchestration.Project
+	BulkReport           = orchestration.BulkReport
+	BulkResult           = orchestration.BulkResult
+	ImportReport         = orchestration.ImportReport
+	ImportRowReport      = orchestration.ImportRowReport
+	IntervalPreview      = orchestration.IntervalPreview
+	Response             = orchestration.Response
+	Health               = orchestration.Health
+	ComponentStatus      = orchestration.ComponentStatus
+)
+
+// Proposal model of a competitor discovered among the similar apps of an observed app
+type Proposal struct {
+	Status     string               `json:"status"`
+	ProposedAt time.Time            `json:"proposed_at"`
+	DecidedAt  *time.Time           `json:"decided_at,omitempty"`
+	Observable ObservableGooglePlay `json:"observable"`
+}
+
+// Webhook model of a subscription to newly classified reviews
+type Webhook struct {
+	ID           string    `json:"id"`
+	Tenant       string    `json:"tenant,omitempty"`
+	URL          string    `json:"url"`
+	Secret       string    `json:"secret,omitempty"`
+	PackageNames []string  `json:"package_names,omitempty"`
+	Classes      []string  `json:"classes,omitempty"`
+	MinRating    int       `json:"min_rating,omitempty"`
+	MaxRating    int       `json:"max_rating,omitempty"`
+	Keywords     []string  `json:"keywords,omitempty"`
+	BatchSize    int       `json:"batch_size"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// WebhookPayload model of the body POSTed to a webhook
+type WebhookPayload struct {
+	WebhookID   string                `json:"webhook_id"`
+	DeliveryID  string                `json:"delivery_id"`
+	PackageName string                `json:"package_name"`
+	Reviews     []AppReviewGooglePlay `json:"reviews"`
+}
+
+// Delivery model of a batch of reviews sent to a webhook
+type Delivery struct {
+	ID            string            `json:"id"`
+	WebhookID     string            `json:"webhook_id"`
+	Tenant        string            `json:"tenant,omitempty"`
+	PackageName   string            `json:"package_name"`
+	Reviews       int               `json:"reviews"`
+	Status        string            `json:"status"`
+	CreatedAt     time.Time         `json:"created_at"`
+	NextAttemptAt *time.Time        `json:"next_attempt_at,omitempty"`
+	Attempts      []DeliveryAttempt `json:"attempts"`
+	Payload       json.RawMessage   `json:"payload"`
+}
+
+// DeliveryAttempt model
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Duration   string    `json:"duration,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Issue model of an issue in an issue tracker
+type Issue struct {
+	Title  string   `json:"title"`
+	Body   string   `json:"body"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// IssueGroup model of the bug reports reported in a single issue of an issue sink
+type IssueGroup struct {
+	ID          string        `json:"id"`
+	Tenant      string        `json:"tenant,omitempty"`
+	Sink        string        `json:"sink"`
+	PackageName string        `json:"package_name"`
+	IssueID     string        `json:"issue_id,omitempty"`
+	IssueURL    string        `json:"issue_url,omitempty"`
+	Reviews     []IssueReview `json:"reviews"`
+	Error       string        `json:"error,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// IssueReview model of a bug report in an issue
+type IssueReview struct {
+	ReviewID   string `json:"review_id"`
+	Rating     int    `json:"rating"`
+	Title      string `json:"title,omitempty"`
+	Body       string `json:"body"`
+	PermaLink  string `json:"perma_link,omitempty"`
+	AppVersion string `json:"app_version,omitempty"`
+}
+
+// Requirement model of the OpenReq JSON format
+type Requirement struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Text             string            `json:"text"`
+	CreatedAt        int64             `json:"created_at"`
+	ModifiedAt       int64             `json:"modified_at"`
+	Status           string            `json:"status"`
+	RequirementType  string            `json:"requirement_type"`
+	RequirementParts []RequirementPart `json:"requirementParts"`
+}
+
+// RequirementPart model of the OpenReq JSON format, carries a property of a requirement
+type RequirementPart struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Text string `json:"text"`
 }
 
+// AlertRule model of a condition on the signals of an observable or of all apps of a project
+type AlertRule struct {
+	ID          string   `json:"id"`
+	Tenant      string   `json:"tenant,omitempty"`
+	Name        string   `json:"name"`
+	PackageName string   `json:"package_name,omitempty"`
+	Project     string   `json:"project,omitempty"`
+	Metric      string   `json:"metric"`
+	Threshold   float64  `json:"threshold"`
+	Window      string   `json:"window,omitempty"`
+	WebhookURL  string   `json:"webhook_url,omitempty"`
+	Secret      string   `json:"secret,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+	// SilencedUntil suppresses the notifications of the rule, its alerts are still evaluated
+	SilencedUntil *time.Time `json:"silenced_until,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Alert model of the state of a rule for an app
+type Alert struct {
+	RuleID      string     `json:"rule_id"`
+	Tenant      string     `json:"tenant,omitempty"`
+	PackageName string     `json:"package_name"`
+	Status      string     `json:"status"`
+	Value       float64    `json:"value"`
+	FiredAt     *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	EvaluatedAt time.Time  `json:"evaluated_at"`
+	// Notified is true once the firing alert was sent to the sinks of its rule
+	Notified bool `json:"notified"`
+	// NotifiedSinks are the sinks of its rule (webhook, emails) the current status was sent to
+	NotifiedSinks []string `json:"notified_sinks,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// AlertNotification model of the body POSTed to the webhook of an alert rule
+type AlertNotification struct {
+	Rule  AlertRule `json:"rule"`
+	Alert Alert     `json:"alert"`
+}
+
+// Digest model of a report that is generated periodically for an app or a project and delivered to its sinks
+type Digest struct {
+	ID          string   `json:"id"`
+	Tenant      string   `json:"tenant,omitempty"`
+	PackageName string   `json:"package_name,omitempty"`
+	Project     string   `json:"project,omitempty"`
+	Interval    string   `json:"interval"`
+	Period      string   `json:"period,omitempty"`
+	WebhookURL  string   `json:"webhook_url,omitempty"`
+	Secret      string   `json:"secret,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+	// Format of the mails, markdown or html
+	Format     string     `json:"format,omitempty"`
+	NextAt     *time.Time `json:"next_at,omitempty"`
+	LastSentAt *time.Time `json:"last_sent_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// DigestReport model of the summary of the apps of a digest over a period
+type DigestReport struct {
+	ID          string      `json:"id"`
+	DigestID    string      `json:"digest_id,omitempty"`
+	Tenant      string      `json:"tenant,omitempty"`
+	PackageName string      `json:"package_name,omitempty"`
+	Project     string      `json:"project,omitempty"`
+	From        time.Time   `json:"from"`
+	To          time.Time   `json:"to"`
+	GeneratedAt time.Time   `json:"generated_at"`
+	Apps        []AppDigest `json:"apps"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// AppDigest model of the summary of an app
+type AppDigest struct {
+	PackageName      string                `json:"package_name"`
+	NewReviews       int                   `json:"new_reviews"`
+	ReviewsPerRating map[string]int        `json:"reviews_per_rating"`
+	BugReports       int                   `json:"bug_reports"`
+	FeatureRequests  int                   `json:"feature_requests"`
+	LongestReviews   []AppReviewGooglePlay `json:"longest_reviews"`
+	HelpfulReviews   []AppReviewGooglePlay `json:"helpful_reviews"`
+	PageRating       float64               `json:"page_rating,omitempty"`
+	VersionChanges   []VersionChange       `json:"version_changes"`
+	Health           PipelineHealth        `json:"health"`
+}
+
+// VersionChange model of an app version first seen on the app page
+type VersionChange struct {
+	Version     string    `json:"version"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+}
+
+// PipelineHealth model of the runs of an app
+type PipelineHealth struct {
+	Runs      int    `json:"runs"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// KeptReview model of a classified review kept for the digests and, if it is a feature request, for the export as requirement
+type KeptReview struct {
+	Tenant       string              `json:"tenant,omitempty"`
+	Review       AppReviewGooglePlay `json:"review"`
+	ClassifiedAt time.Time           `json:"classified_at"`
+	PushedAt     *time.Time          `json:"pushed_at,omitempty"`
+}
+
+const (
+	stateActive = "active"
+	statePaused = "paused"
+)
+
 // AppPageGooglePlay model
 type AppPageGooglePlay struct {
 	Name                    string             `json:"name" bson:"name"`
@@ -44,20 +285,21 @@ type StarCountPerRating struct {
 
 // AppReviewGooglePlay model
 type AppReviewGooglePlay struct {
-	ReviewID       string `json:"review_id" bson:"review_id"`
-	PackageName    string `json:"package_name" bson:"package_name"`
-	Author         string `json:"author" bson:"author"`
-	Date           int64  `json:"date_posted" bson:"date_posted"`
-	Rating         int    `json:"rating" bson:"rating"`
-	Title          string `json:"title" bson:"title"`
-	Body           string `json:"body" bson:"body"`
-	PermaLink      string `json:"perma_link" bson:"perma_link"`
-	FeatureRequest bool   `json:"cluster_is_feature_request" bson:"cluster_is_feature_request"`
-	BugReport      bool   `json:"cluster_is_bug_report" bson:"cluster_is_bug_report"`
-}
-
-// Response model
-type Response struct {
-	Message string `json:"message"`
-	Status  bool   `json:"status"`
+	ReviewID    string `json:"review_id" bson:"review_id"`
+	PackageName string `json:"package_name" bson:"package_name"`
+	Author      string `json:"author" bson:"author"`
+	Date        int64  `json:"date_posted" bson:"date_posted"`
+	Rating      int    `json:"rating" bson:"rating"`
+	Title       string `json:"title" bson:"title"`
+	Body        string `json:"body" bson:"body"`
+	PermaLink   string `json:"perma_link" bson:"perma_link"`
+	// ThumbsUp is the number of users who found the review helpful, if the collection layer provides it
+	ThumbsUp       int  `json:"thumbs_up,omitempty" bson:"thumbs_up,omitempty"`
+	FeatureRequest bool `json:"cluster_is_feature_request" bson:"cluster_is_feature_request"`
+	BugReport      bool `json:"cluster_is_bug_report" bson:"cluster_is_bug_report"`
 }
+
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+)
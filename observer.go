@@ -1,42 +1,408 @@
 package main
 
 import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/robfig/cron"
 )
 
 var observableAppsGooglePlay = NewSet()
-var reviews []AppReviewGooglePlay
 var observer *cron.Cron
 
-func startObsevation() {
-	loadObservableApps()
+var errNotObserved = errors.New("app is not observed")
+
+// observerMutex guards the observer and the observable apps
+var observerMutex sync.Mutex
+
+// observablesLoaded is true once the observables could be loaded from the storage layer
+var observablesLoaded bool
+
+// catchUpDue is true until the missed runs were caught up after the start of the orchestrator or after this replica became the leader
+var catchUpDue = true
+
+// observationRetrying is true while a retry loop waits for the storage layer
+var observationRetrying bool
+
+// backoff used while the storage layer is unavailable
+var observationRetryInitialBackoff = 1 * time.Second
+var observationRetryMaxBackoff = 5 * time.Minute
+
+// startObsevation loads the observables and schedules them. The observables of the storage layer are fetched before (see RestartObservation)
+func startObsevation(remote map[string][]ObservableGooglePlay, fetchedAt time.Time) bool {
+	ok := loadObservableApps(remote, fetchedAt)
 
 	observer = cron.New()
-	for packageName := range observableAppsGooglePlay.m {
-		observerInterval := getObserverInterval(observableAppsGooglePlay.m[packageName])
-		observer.AddFunc(observerInterval, func() {
-			updateApp(packageName)
-		})
+	if !IsLeader() {
+		// followers keep the observables up to date but do not schedule them
+		return ok
+	}
+	var observables []ObservableGooglePlay
+	for key, observable := range observableAppsGooglePlay.m {
+		tenant, packageName := observable.Tenant, observable.PackageName
+		observables = append(observables, observable)
+		schedule, err := ScheduleOf(observable)
+		if err != nil {
+			log.Printf("ERR could not schedule %s: %v\n", key, err)
+			continue
+		}
+		observer.Schedule(schedule, cron.FuncJob(func() {
+			runScheduled(tenant, packageName)
+		}))
 	}
 	observer.Start()
+	if catchUpDue {
+		// a restart after a change of the observables must not catch up again
+		catchUpDue = false
+		go CatchUpMissedRuns(observables, time.Now())
+	}
+
+	return ok
+}
+
+// runScheduled queues the observation of an app unless it is paused. A paused app is resumed once its resume time passed
+func runScheduled(tenant string, packageName string) {
+	observable, ok := ObservableOf(tenant, packageName)
+	if !ok {
+		return
+	}
+	if observable.Paused {
+		if isPaused(observable, time.Now()) {
+			log.Printf("skip observation of paused app %s\n", packageName)
+			return
+		}
+		// an elapsed resume time is not paused anymore, even if the storage layer could not be told
+		ResumeObservable(tenant, packageName)
+	}
+	if isAdaptive(observable) {
+		due := AdaptiveDue(observable)
+		if time.Now().Before(due) {
+			return
+		}
+		if due.IsZero() {
+			// due once, the delay counts from now on
+			UpdateObservable(tenant, packageName, func(observable *ObservableGooglePlay) {
+				now := time.Now()
+				observable.ObservedSince = &now
+			})
+		}
+	}
+	if _, err := jobQueue.Enqueue(tenant, packageName, triggerScheduled); err != nil {
+		log.Printf("skip scheduled observation of %s: %v\n", keyOf(observable), err)
+	}
 }
 
-func updateApp(packageName string) {
-	crawledAppReviews := crawlObservableApps(packageName)
-	nonExistingAppReviews := RESTPostNonExistingAppReviewsGooglePlay(crawledAppReviews)
+/*
+* observation pipeline of an app
+*
+* Steps:
+*  1. crawl and store the app page if it is needed (see needsAppPage), discover competitors among its similar apps (does not fail the run)
+*  2. crawl app reviews
+*  3. filter app reviews that are not processed yet
+*  4. process reviews
+*  5. store processed app reviews
+*  6. notify the webhooks of the tenant and report bug reports to its issue sinks
+*  7. keep feature requests and push them as requirements (does not fail the run)
+*  8. keep the classified reviews for the digests
+ */
+func updateApp(tenantID string, packageName string, progress progressReporter) RunResult {
+	var result RunResult
+
+	tenant, ok := TenantOf(tenantID)
+	if !ok {
+		result.Error = "unknown tenant"
+		return result
+	}
+
+	var appPage AppPageGooglePlay
+	if observable, _ := ObservableOf(tenant.ID, packageName); needsAppPage(observable) {
+		progress.start(stepCrawlPage)
+		appPage, ok = RESTGetAppPageGooglePlay(tenant, packageName)
+		if ok {
+			if event, changed := appPageChangedEvent(tenant.ID, progress.runID, appPage); changed {
+				PublishEvents(event)
+			}
+			result.PageCrawled = RESTPostStoreAppPageGooglePlay(tenant, appPage)
+			result.PageRating = appPage.Rating
+			result.AppVersion = appPage.CurrentSoftwareVersion
+			result.DiscoveredApps = DiscoverCompetitors(tenant, appPage)
+		}
+		if result.PageCrawled {
+			progress.finish(stepCrawlPage, 0)
+		} else {
+			progress.fail(stepCrawlPage, "could not crawl and store the app page")
+		}
+	}
+
+	progress.start(stepCrawlReviews)
+	crawledAppReviews, ok := crawlObservableApps(tenant, packageName)
+	if !ok {
+		result.Error = "collection layer unreachable, could not crawl app reviews"
+		progress.fail(stepCrawlReviews, result.Error)
+		return result
+	}
+	result.CrawledReviews = len(crawledAppReviews)
+	progress.finish(stepCrawlReviews, result.CrawledReviews)
+
 	// just consider app reviews that are not processed yet
-	processedAppReviews := processObservableApps(nonExistingAppReviews)
-	storeProcessedApps(processedAppReviews)
+	progress.start(stepFilterReviews)
+	nonExistingAppReviews, ok := RESTPostNonExistingAppReviewsGooglePlay(tenant, crawledAppReviews)
+	if !ok {
+		result.Error = "storage layer unreachable, could not filter existing app reviews"
+		progress.fail(stepFilterReviews, result.Error)
+		return result
+	}
+	result.NewReviews = len(nonExistingAppReviews)
+	progress.finish(stepFilterReviews, result.NewReviews)
+
+	progress.start(stepClassifyReviews)
+	processedAppReviews, ok := processObservableApps(tenant, nonExistingAppReviews)
+	if !ok {
+		result.Error = "analytics layer unreachable, could not classify app reviews"
+		progress.fail(stepClassifyReviews, result.Error)
+		return result
+	}
+	result.ClassifiedReviews = len(processedAppReviews)
+	progress.finish(stepClassifyReviews, result.ClassifiedReviews)
+	result.ReviewsPerRating = make([]int, 5)
+	for _, review := range processedAppReviews {
+		if review.Rating >= 1 && review.Rating <= 5 {
+			result.ReviewsPerRating[review.Rating-1]++
+		}
+		if review.BugReport {
+			result.BugReports++
+		}
+		if review.FeatureRequest {
+			result.FeatureRequests++
+		}
+		if review.Rating == 1 {
+			result.OneStarReviews++
+		}
+	}
+
+	progress.start(stepStoreReviews)
+	if ok := storeProcessedApps(tenant, processedAppReviews); !ok {
+		result.Error = "storage layer unreachable, could not store app reviews"
+		progress.fail(stepStoreReviews, result.Error)
+		return result
+	}
+	progress.finish(stepStoreReviews, len(processedAppReviews))
+	// published once the reviews are stored, the next run would classify reviews that could not be stored again
+	if len(processedAppReviews) > 0 {
+		PublishEvents(reviewsClassifiedEvent(tenant.ID, packageName, progress.runID, processedAppReviews))
+	}
+
+	progress.start(stepPostProcess)
+	NotifyWebhooks(tenant.ID, packageName, processedAppReviews)
+	SyncIssues(tenant.ID, packageName, appPage.CurrentSoftwareVersion, processedAppReviews)
+	KeepReviews(tenant.ID, processedAppReviews)
+	result.PushedRequirements = exportRequirements(tenant)
+	progress.finish(stepPostProcess, 0)
+	return result
+}
+
+// needsAppPage returns true if the app page of an observable is used: to discover competitors, by rating_drop alert rules,
+// by digests or for the app version of the issues of bug reports. Runs of other apps do not crawl it
+func needsAppPage(observable ObservableGooglePlay) bool {
+	if observable.Discover != "" {
+		return true
+	}
+	for _, rule := range AlertRules(observable.Tenant) {
+		if rule.Metric == metricRatingDrop && rule.appliesTo(observable) {
+			return true
+		}
+	}
+	for _, digest := range Digests(observable.Tenant) {
+		if digest.PackageName == observable.PackageName || (digest.Project != "" && containsString(observable.Projects, digest.Project)) {
+			return true
+		}
+	}
+	for _, configured := range issueSinks {
+		config := configured.config
+		if config.Tenant == observable.Tenant && (len(config.PackageNames) == 0 || containsString(config.PackageNames, observable.PackageName)) {
+			return true
+		}
+	}
+	return false
 }
 
 func stopObservation() {
 	observer.Stop()
 }
 
-func loadObservableApps() {
-	for _, observable := range RESTGetObservablesGooglePlay() {
-		observableAppsGooglePlay.Add(observable.PackageName, observable.Interval)
+// fetchObservables returns the observables of the storage layer of every tenant whose storage layer is reachable
+func fetchObservables() map[string][]ObservableGooglePlay {
+	remote := map[string][]ObservableGooglePlay{}
+	for _, id := range TenantIDs() {
+		tenant, _ := TenantOf(id)
+		if observables, ok := RESTGetObservablesGooglePlay(tenant); ok {
+			remote[id] = observables
+		}
+	}
+	return remote
+}
+
+// loadObservableApps replaces the observable apps of every tenant with the ones of its storage layer (fetched at fetchedAt) reconciled with the local snapshot.
+// Falls back to the observables already loaded or the local snapshot if the storage layer of a tenant is unreachable
+func loadObservableApps(remotes map[string][]ObservableGooglePlay, fetchedAt time.Time) bool {
+	snapshot := LoadSnapshot()
+	loaded := NewSet()
+	ok := true
+	for _, id := range TenantIDs() {
+		local := observablesOfTenant(snapshot, id)
+
+		remote, tenantOK := remotes[id]
+		if !tenantOK {
+			ok = false
+			if current := observablesOfTenant(observableAppsGooglePlay.list(), id); len(current) > 0 {
+				local = current
+			}
+			for _, observable := range local {
+				loaded.Add(observable)
+			}
+			continue
+		}
+
+		observables := reconcileObservables(id, remote, local, fetchedAt)
+		SaveSnapshot(id, observables)
+		for _, observable := range observables {
+			loaded.Add(observable)
+		}
+	}
+
+	observablesLoaded = ok
+	observableAppsGooglePlay = loaded
+	return ok
+}
+
+func observablesOfTenant(observables []ObservableGooglePlay, tenant string) []ObservableGooglePlay {
+	var selected []ObservableGooglePlay
+	for _, observable := range observables {
+		if observable.Tenant == tenant {
+			selected = append(selected, observable)
+		}
 	}
+	return selected
+}
+
+func newSetOf(observables []ObservableGooglePlay) *set {
+	s := NewSet()
+	for _, observable := range observables {
+		s.Add(observable)
+	}
+	return s
+}
+
+// isPaused returns true if the observable is paused and its resume time (if any) has not passed yet
+func isPaused(observable ObservableGooglePlay, now time.Time) bool {
+	return observable.Paused && (observable.ResumeAt == nil || now.Before(*observable.ResumeAt))
+}
+
+// UpdateObservable changes an observable and the local snapshot. Returns false if the app is not observed
+func UpdateObservable(tenant string, packageName string, update func(observable *ObservableGooglePlay)) (ObservableGooglePlay, bool) {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
+	observable, ok := observableAppsGooglePlay.m[observableKey(tenant, packageName)]
+	if !ok {
+		return observable, false
+	}
+	update(&observable)
+	observableAppsGooglePlay.Add(observable)
+	RememberObservable(observable)
+	return observable, true
+}
+
+// RemoveObservable stops observing an app and removes it from the local snapshot. Returns false if the app is not observed
+func RemoveObservable(tenant string, packageName string) bool {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
+	observable, ok := observableAppsGooglePlay.m[observableKey(tenant, packageName)]
+	if !ok {
+		return false
+	}
+	delete(observableAppsGooglePlay.m, keyOf(observable))
+	ForgetObservable(observable)
+	return true
+}
+
+// PauseObservable stops running the observation of an app until it is resumed. If resumeAt is set, it is resumed automatically at that time
+func PauseObservable(tenant string, packageName string, resumeAt *time.Time) (ObservableGooglePlay, error) {
+	return setPaused(tenant, packageName, true, resumeAt)
+}
+
+// ResumeObservable runs the observation of a paused app again
+func ResumeObservable(tenant string, packageName string) (ObservableGooglePlay, error) {
+	return setPaused(tenant, packageName, false, nil)
+}
+
+// setPaused stores the paused state in the storage layer first, it wins over the snapshot on reloads (see the conflict rules).
+// The storage layer is called without holding the observerMutex
+func setPaused(tenant string, packageName string, paused bool, resumeAt *time.Time) (ObservableGooglePlay, error) {
+	observable, ok := ObservableOf(tenant, packageName)
+	if !ok {
+		return observable, errNotObserved
+	}
+	t, _ := TenantOf(tenant)
+	if ok := RESTPostPauseObservableGooglePlay(t, packageName, paused, resumeAt); !ok {
+		return observable, errStorageUnreachable
+	}
+	observable, ok = UpdateObservable(tenant, packageName, func(observable *ObservableGooglePlay) {
+		observable.Paused = paused
+		observable.ResumeAt = resumeAt
+	})
+	if !ok {
+		return observable, errNotObserved
+	}
+	return observable, nil
+}
+
+// StatusOf returns the observable with its state and effective schedule
+func StatusOf(observable ObservableGooglePlay, now time.Time) ObservableStatus {
+	status := ObservableStatus{ObservableGooglePlay: observable, State: stateActive}
+	if !isPaused(observable, now) {
+		status.Schedule = EffectiveScheduleOf(observable, now)
+		return status
+	}
+
+	status.State = statePaused
+	if observable.ResumeAt != nil {
+		status.Schedule = EffectiveScheduleOf(observable, *observable.ResumeAt)
+	} else {
+		status.Schedule = EffectiveScheduleOf(observable, now)
+		status.Schedule.NextRun = nil
+	}
+	return status
+}
+
+// ObservableStatuses returns all observables of the tenant of the filter matching it with their effective schedule, ordered by package name
+func ObservableStatuses(filter ObservableFilter) []ObservableStatus {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
+	now := time.Now()
+	statuses := []ObservableStatus{}
+	for _, observable := range observableAppsGooglePlay.m {
+		if !filter.matches(observable) {
+			continue
+		}
+		statuses = append(statuses, StatusOf(observable, now))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].PackageName < statuses[j].PackageName })
+	return statuses
+}
+
+// ObservableOf returns the observable of a package name of a tenant
+func ObservableOf(tenant string, packageName string) (ObservableGooglePlay, bool) {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
+	observable, ok := observableAppsGooglePlay.m[observableKey(tenant, packageName)]
+	return observable, ok
 }
 
 func getObserverInterval(interval string) string {
@@ -51,26 +417,97 @@ func getObserverInterval(interval string) string {
 	if specialInterval, ok := specialIntervals[interval]; ok {
 		return specialInterval
 	} else {
-		return interval // allows custom intervals to the cron job specification (https://godoc.org/github.com/robfig/cron) might thorw an error if the custom interval is wrong
+		return interval // allows custom intervals to the cron job specification (https://godoc.org/github.com/robfig/cron) validated by ParseObserverInterval
 	}
 }
 
-func crawlObservableApps(packageName string) []AppReviewGooglePlay {
-	return RESTGetAppReviewsGooglePlay(packageName, 0)
+func crawlObservableApps(tenant *Tenant, packageName string) ([]AppReviewGooglePlay, bool) {
+	return RESTGetAppReviewsGooglePlay(tenant, packageName, 0)
 }
 
-func processObservableApps(appReviews []AppReviewGooglePlay) []AppReviewGooglePlay {
-	return RESTPostProcessAppReviewsGooglePlay(appReviews)
+func processObservableApps(tenant *Tenant, appReviews []AppReviewGooglePlay) ([]AppReviewGooglePlay, bool) {
+	return RESTPostProcessAppReviewsGooglePlay(tenant, appReviews)
 }
 
-func storeProcessedApps(processedAppReviews []AppReviewGooglePlay) {
-	RESTPostStoreProcessedAppReviewsGooglePlay(processedAppReviews)
+func storeProcessedApps(tenant *Tenant, processedAppReviews []AppReviewGooglePlay) bool {
+	return RESTPostStoreProcessedAppReviewsGooglePlay(tenant, processedAppReviews)
 }
 
-// RestartObservation stops the observation and starts it again
-func RestartObservation() {
+// restartMutex serializes the restarts of the observation. Unlike observerMutex, it is held while the storage layer is called
+var restartMutex sync.Mutex
+
+// RestartObservation stops the observation and starts it again. Returns ok if the observables could be loaded
+func RestartObservation() bool {
+	restartMutex.Lock()
+	defer restartMutex.Unlock()
+
+	fetchedAt := time.Now()
+	remote := fetchObservables()
+
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
 	if observer != nil {
 		stopObservation()
 	}
-	startObsevation()
+	return startObsevation(remote, fetchedAt)
+}
+
+// RequestCatchUp catches up the missed runs with the next start of the observation, e.g. after this replica became the leader
+func RequestCatchUp() {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+	catchUpDue = true
+}
+
+// EnsureObservation (re)starts the observation. If the storage layer is unavailable, it keeps retrying in the background with an exponential backoff
+func EnsureObservation() {
+	if RestartObservation() {
+		return
+	}
+
+	observerMutex.Lock()
+	if observationRetrying {
+		observerMutex.Unlock()
+		return
+	}
+	observationRetrying = true
+	observerMutex.Unlock()
+
+	go retryObservation()
+}
+
+func retryObservation() {
+	backoff := observationRetryInitialBackoff
+	for {
+		log.Printf("could not load observables, retry in %v\n", backoff)
+		time.Sleep(backoff)
+		if RestartObservation() {
+			break
+		}
+
+		backoff *= 2
+		if backoff > observationRetryMaxBackoff {
+			backoff = observationRetryMaxBackoff
+		}
+	}
+
+	observerMutex.Lock()
+	observationRetrying = false
+	observerMutex.Unlock()
+	log.Println("observables loaded, observation started")
+}
+
+// SchedulerStatus returns the readiness of the scheduler
+func SchedulerStatus() ComponentStatus {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
+	if !observablesLoaded && len(observableAppsGooglePlay.m) > 0 {
+		return ComponentStatus{Status: statusDegraded, Message: "storage layer unreachable, observing apps of the local snapshot", Observables: len(observableAppsGooglePlay.m)}
+	}
+	if !observablesLoaded {
+		return ComponentStatus{Status: statusDegraded, Message: "observables could not be loaded from the storage layer yet"}
+	}
+	return ComponentStatus{Status: statusOK, Message: "observing apps", Observables: len(observableAppsGooglePlay.m)}
 }
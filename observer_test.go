@@ -1,8 +1,84 @@
 package main
 
-import "testing"
+import (
+	"net/http"
+	"testing"
+	"time"
+)
 
 func TestUpdateApp(t *testing.T) {
 	induceServerError = false
-	updateApp("eu.openreq")
+	if result := updateApp(defaultTenant, "eu.openreq", progressReporter{}); result.Error != "" {
+		t.Errorf("Expected the pipeline to succeed. Got %s instead", result.Error)
+	}
+
+	induceServerError = true
+	if result := updateApp(defaultTenant, "eu.openreq", progressReporter{}); result.Error == "" {
+		t.Error("Expected the pipeline to fail")
+	}
+	induceServerError = false
+}
+
+func TestEnsureObservation(t *testing.T) {
+	observationRetryInitialBackoff = 10 * time.Millisecond
+	observationRetryMaxBackoff = 20 * time.Millisecond
+	ep := endpoint{method: "GET", url: "/hitec/orchestration/app/health/ready"}
+
+	induceServerError = true
+	EnsureObservation()
+	if rr := ep.mustExecuteRequest(nil); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the scheduler to be degraded. Got status %d instead", rr.Code)
+	}
+
+	induceServerError = false
+	deadline := time.Now().Add(time.Second)
+	for ep.mustExecuteRequest(nil).Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("Scheduler did not recover after the storage layer became available")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := SchedulerStatus(); status.Observables < 2 {
+		t.Errorf("Expected at least 2 observables. Got %d instead", status.Observables)
+	}
+}
+
+func TestValidatePackageName(t *testing.T) {
+	valid := []string{"eu.openreq", "com.twitter.android", "org.Example_1.app"}
+	invalid := []string{"", "openreq", "eu..openreq", "eu.openreq.", "1eu.openreq", "eu._openreq", "eu.open-req", "eu.öpenreq"}
+
+	for _, packageName := range valid {
+		if err := ValidatePackageName(packageName); err != nil {
+			t.Errorf("Expected %q to be valid. Got %v instead", packageName, err)
+		}
+	}
+	for _, packageName := range invalid {
+		if err := ValidatePackageName(packageName); err == nil {
+			t.Errorf("Expected %q to be invalid", packageName)
+		}
+	}
+}
+
+func TestParseObserverInterval(t *testing.T) {
+	from := time.Date(2019, 1, 1, 6, 0, 0, 0, time.UTC)
+	for interval, next := range map[string]time.Time{
+		"daily":         time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC),
+		"30 6 * * *":    time.Date(2019, 1, 1, 6, 30, 0, 0, time.UTC),
+		"15 30 6 * * *": time.Date(2019, 1, 1, 6, 30, 15, 0, time.UTC),
+	} {
+		schedule, err := ParseObserverInterval(interval)
+		if err != nil {
+			t.Errorf("Expected %q to be valid. Got %v instead", interval, err)
+			continue
+		}
+		if schedule.Next(from) != next {
+			t.Errorf("Expected %q to fire at %v. Got %v instead", interval, next, schedule.Next(from))
+		}
+	}
+	for _, interval := range []string{"", "sometimes", "* * *", "60 * * * *", "0 0 0 0 * * *"} {
+		if _, err := ParseObserverInterval(interval); err == nil {
+			t.Errorf("Expected %q to be invalid", interval)
+		}
+	}
 }
@@ -0,0 +1,525 @@
+// Package orchestration is the Go client of the API of the ri-orchestration-app. It shares the models with the
+// orchestrator, so the client is versioned together with the API (see Version).
+//
+//	client := orchestration.NewClient("https://orchestrator.example.com", orchestration.WithAPIKey(key))
+//	run, err := client.RunNow(ctx, "com.whatsapp")
+package orchestration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the API implemented by the client, info.version of swagger.yaml
+const Version = "1.0.0"
+
+// BasePath of the API
+const BasePath = "/hitec/orchestration/app"
+
+// status of a run
+const (
+	RunQueued    = "queued"
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// ErrRunNotFinished is returned by FollowRun if the progress stream ended before the run finished, e.g. because the connection dropped
+var ErrRunNotFinished = errors.New("progress stream ended before the run finished")
+
+// Error is the error of a response that is not successful
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("orchestrator responded with %d", e.StatusCode)
+	}
+	return fmt.Sprintf("orchestrator responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a response of an unknown resource, e.g. an app that is not observed
+func IsNotFound(err error) bool {
+	return statusCodeOf(err) == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a response of a conflict, e.g. a run of the app is already pending
+func IsConflict(err error) bool {
+	return statusCodeOf(err) == http.StatusConflict
+}
+
+func statusCodeOf(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// Client of the orchestration API. It is safe for concurrent use
+type Client struct {
+	baseURL    string
+	apiKey     string
+	token      string
+	httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithAPIKey authenticates the requests with an API key (header X-API-Key)
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithToken authenticates the requests with a bearer token
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient sends the requests with the given HTTP client instead of http.DefaultClient. Progress streams are
+// open until the run finished, so the client should not have a timeout; use the context of the calls instead
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// NewClient returns a client of the orchestrator at baseURL, e.g. http://localhost:9702
+func NewClient(baseURL string, options ...Option) *Client {
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: http.DefaultClient}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, query url.Values, contentType string, body io.Reader) (*http.Request, error) {
+	target := c.baseURL + BasePath + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "ri-orchestration-app-client/"+Version)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request and returns the body of the response. A response that is not successful is returned as *Error
+// together with its body
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var response Response
+		json.Unmarshal(data, &response)
+		return data, &Error{StatusCode: res.StatusCode, Message: response.Message}
+	}
+	return data, nil
+}
+
+// call sends a request without body and decodes its JSON response into value, if any
+func (c *Client) call(ctx context.Context, method string, path string, query url.Values, value interface{}) error {
+	req, err := c.newRequest(ctx, method, path, query, "", nil)
+	if err != nil {
+		return err
+	}
+	data, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if value == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, value)
+}
+
+func appPath(packageName string) string {
+	return "/observe/google-play/package-name/" + url.PathEscape(packageName)
+}
+
+// ObservableFilter selects observables by a project or tag
+type ObservableFilter struct {
+	Project string
+	Tag     string
+}
+
+func (f ObservableFilter) query() url.Values {
+	query := url.Values{}
+	if f.Project != "" {
+		query.Set("project", f.Project)
+	}
+	if f.Tag != "" {
+		query.Set("tag", f.Tag)
+	}
+	return query
+}
+
+// Observables returns the observed apps with their effective schedule
+func (c *Client) Observables(ctx context.Context, filter ObservableFilter) ([]ObservableStatus, error) {
+	var observables []ObservableStatus
+	err := c.call(ctx, http.MethodGet, "/observe/google-play", filter.query(), &observables)
+	return observables, err
+}
+
+// Observable returns an observed app with its effective schedule
+func (c *Client) Observable(ctx context.Context, packageName string) (ObservableStatus, error) {
+	var observable ObservableStatus
+	err := c.call(ctx, http.MethodGet, appPath(packageName), nil, &observable)
+	return observable, err
+}
+
+// ObserveOptions are the optional settings of an observed app. Empty fields keep the current settings
+type ObserveOptions struct {
+	TimeZone    string
+	Jitter      string
+	CatchUp     string
+	MinInterval string
+	MaxInterval string
+	Projects    []string
+	Tags        []string
+	// Discover is propose or auto
+	Discover      string
+	DiscoverDepth int
+	DiscoverCount int
+}
+
+func (o ObserveOptions) query() url.Values {
+	query := url.Values{}
+	for name, value := range map[string]string{"time_zone": o.TimeZone, "jitter": o.Jitter, "catch_up": o.CatchUp,
+		"min_interval": o.MinInterval, "max_interval": o.MaxInterval, "discover": o.Discover} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	for name, value := range map[string]int{"discover_depth": o.DiscoverDepth, "discover_count": o.DiscoverCount} {
+		if value != 0 {
+			query.Set(name, strconv.Itoa(value))
+		}
+	}
+	query["project"] = o.Projects
+	query["tag"] = o.Tags
+	return query
+}
+
+// Observe observes an app at an interval (e.g. daily, 6h or a cron expression) or changes its interval and settings
+func (c *Client) Observe(ctx context.Context, packageName string, interval string, options ObserveOptions) error {
+	return c.call(ctx, http.MethodPost, appPath(packageName)+"/interval/"+url.PathEscape(interval), options.query(), nil)
+}
+
+// Unobserve stops observing an app and removes it from the storage layer. Its run history is kept
+func (c *Client) Unobserve(ctx context.Context, packageName string) error {
+	return c.call(ctx, http.MethodDelete, appPath(packageName), nil, nil)
+}
+
+// Pause pauses an observed app. A non-zero resumeAt resumes it automatically
+func (c *Client) Pause(ctx context.Context, packageName string, resumeAt time.Time) (ObservableStatus, error) {
+	query := url.Values{}
+	if !resumeAt.IsZero() {
+		query.Set("resume_at", resumeAt.Format(time.RFC3339))
+	}
+	var observable ObservableStatus
+	err := c.call(ctx, http.MethodPost, appPath(packageName)+"/pause", query, &observable)
+	return observable, err
+}
+
+// Resume resumes a paused app
+func (c *Client) Resume(ctx context.Context, packageName string) (ObservableStatus, error) {
+	var observable ObservableStatus
+	err := c.call(ctx, http.MethodPost, appPath(packageName)+"/resume", nil, &observable)
+	return observable, err
+}
+
+// RunNow queues a manual run of an observed app. If a run of the app is pending, the error is a conflict (see IsConflict)
+func (c *Client) RunNow(ctx context.Context, packageName string) (Run, error) {
+	var run Run
+	err := c.call(ctx, http.MethodPost, appPath(packageName)+"/run", nil, &run)
+	return run, err
+}
+
+// Process starts a run that crawls, processes and stores an app once, whether it is observed or not. Returns the run id, see FollowRun
+func (c *Client) Process(ctx context.Context, packageName string) (string, error) {
+	var response Response
+	err := c.call(ctx, http.MethodPost, "/process/google-play/package-name/"+url.PathEscape(packageName), nil, &response)
+	return response.RunID, err
+}
+
+// RunListOptions selects runs of the history. Limit is the size of a page (default 100)
+type RunListOptions struct {
+	PackageName string
+	Project     string
+	Tag         string
+	Trigger     string
+	Status      string
+	Limit       int
+	// Before is the cursor of the page, see RunPage.Next
+	Before string
+}
+
+// RunPage is a page of the run history, newest first. Next is the cursor of the next page, empty on the last page
+type RunPage struct {
+	Runs []Run
+	Next string
+}
+
+// Runs returns a page of the run history
+func (c *Client) Runs(ctx context.Context, options RunListOptions) (RunPage, error) {
+	if options.Limit < 1 {
+		options.Limit = 100
+	}
+	query := url.Values{"limit": {strconv.Itoa(options.Limit)}}
+	for name, value := range map[string]string{"package_name": options.PackageName, "project": options.Project, "tag": options.Tag,
+		"trigger": options.Trigger, "status": options.Status, "before": options.Before} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	page := RunPage{}
+	if err := c.call(ctx, http.MethodGet, "/runs", query, &page.Runs); err != nil {
+		return page, err
+	}
+	if len(page.Runs) == options.Limit {
+		page.Next = page.Runs[len(page.Runs)-1].ID
+	}
+	return page, nil
+}
+
+// EachRun calls fn for every run of the history, newest first, until fn returns an error
+func (c *Client) EachRun(ctx context.Context, options RunListOptions, fn func(Run) error) error {
+	for {
+		page, err := c.Runs(ctx, options)
+		if err != nil {
+			return err
+		}
+		for _, run := range page.Runs {
+			if err := fn(run); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		options.Before = page.Next
+	}
+}
+
+// Run returns a run of the history
+func (c *Client) Run(ctx context.Context, runID string) (Run, error) {
+	var run Run
+	err := c.call(ctx, http.MethodGet, "/runs/"+url.PathEscape(runID), nil, &run)
+	return run, err
+}
+
+// FollowRun streams the progress of a run to fn until the run finished and returns the finished run.
+// If the stream ends before, it returns the run in its current state and ErrRunNotFinished
+func (c *Client) FollowRun(ctx context.Context, runID string, fn func(Progress)) (Run, error) {
+	err := c.events(ctx, "/runs/"+url.PathEscape(runID)+"/progress", nil, func(event string, data []byte) bool {
+		var progress Progress
+		if event == "progress" && fn != nil && json.Unmarshal(data, &progress) == nil {
+			fn(progress)
+		}
+		return true
+	})
+	if err != nil {
+		return Run{}, err
+	}
+	run, err := c.Run(ctx, runID)
+	if err != nil {
+		return run, err
+	}
+	if run.Status != RunSucceeded && run.Status != RunFailed {
+		return run, fmt.Errorf("run %s is %s: %w", run.ID, run.Status, ErrRunNotFinished)
+	}
+	return run, nil
+}
+
+// FollowProgress streams the progress of all runs, or the runs of an app, to fn until fn returns false or ctx is done
+func (c *Client) FollowProgress(ctx context.Context, packageName string, fn func(Progress) bool) error {
+	query := url.Values{}
+	if packageName != "" {
+		query.Set("package_name", packageName)
+	}
+	err := c.events(ctx, "/runs/progress", query, func(event string, data []byte) bool {
+		var progress Progress
+		if event != "progress" || json.Unmarshal(data, &progress) != nil {
+			return true
+		}
+		return fn(progress)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// events reads the Server-Sent Events of a stream until it ends or handle returns false
+func (c *Client) events(ctx context.Context, path string, query url.Values, handle func(event string, data []byte) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodGet, path, query, "", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var response Response
+		json.NewDecoder(res.Body).Decode(&response)
+		return &Error{StatusCode: res.StatusCode, Message: response.Message}
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	event := "message"
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			event = "message"
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if !handle(event, []byte(strings.TrimPrefix(line, "data: "))) {
+				return nil
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// DeadLetters returns the apps whose last runs failed
+func (c *Client) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	var deadLetters []DeadLetter
+	err := c.call(ctx, http.MethodGet, "/dead-letters", nil, &deadLetters)
+	return deadLetters, err
+}
+
+// RetryDeadLetter queues a manual run of an app of the dead-letter queue
+func (c *Client) RetryDeadLetter(ctx context.Context, packageName string) (Run, error) {
+	var run Run
+	err := c.call(ctx, http.MethodPost, "/dead-letters/"+url.PathEscape(packageName)+"/retry", nil, &run)
+	return run, err
+}
+
+// DiscardDeadLetter removes an app from the dead-letter queue
+func (c *Client) DiscardDeadLetter(ctx context.Context, packageName string) error {
+	return c.call(ctx, http.MethodDelete, "/dead-letters/"+url.PathEscape(packageName), nil, nil)
+}
+
+// Projects returns the projects with their count of observed apps
+func (c *Client) Projects(ctx context.Context) ([]Project, error) {
+	var projects []Project
+	err := c.call(ctx, http.MethodGet, "/projects", nil, &projects)
+	return projects, err
+}
+
+// Health returns the readiness of the orchestrator. A degraded orchestrator is not an error, see Health.Status
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	return c.health(ctx, "/health/ready")
+}
+
+// DownstreamHealth returns the health of the services the orchestrator depends on
+func (c *Client) DownstreamHealth(ctx context.Context) (Health, error) {
+	return c.health(ctx, "/health/downstream")
+}
+
+func (c *Client) health(ctx context.Context, path string) (Health, error) {
+	var health Health
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil, "", nil)
+	if err != nil {
+		return health, err
+	}
+	data, err := c.do(req)
+	if err != nil && statusCodeOf(err) != http.StatusServiceUnavailable {
+		return health, err
+	}
+	if json.Unmarshal(data, &health) != nil || health.Status == "" {
+		return health, err
+	}
+	return health, nil
+}
+
+// Import imports a JSON list or CSV file (format json or csv) of observables. It is applied only if all rows are
+// valid; the report tells the status of every row, also if the import failed
+func (c *Client) Import(ctx context.Context, format string, observables io.Reader) (ImportReport, error) {
+	var report ImportReport
+	contentType := "application/json"
+	if format == "csv" {
+		contentType = "text/csv"
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/observables/import", nil, contentType, observables)
+	if err != nil {
+		return report, err
+	}
+	data, err := c.do(req)
+	json.Unmarshal(data, &report)
+	return report, err
+}
+
+// ImportObservables imports a list of observables, see Import
+func (c *Client) ImportObservables(ctx context.Context, observables []ObservableGooglePlay) (ImportReport, error) {
+	data, err := json.Marshal(observables)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	return c.Import(ctx, "json", bytes.NewReader(data))
+}
+
+// Export writes all observables as JSON or CSV (format json or csv) to w
+func (c *Client) Export(ctx context.Context, format string, w io.Writer) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/observables/export", url.Values{"format": {format}}, "", nil)
+	if err != nil {
+		return err
+	}
+	data, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ExportObservables returns all observables
+func (c *Client) ExportObservables(ctx context.Context) ([]ObservableGooglePlay, error) {
+	var buffer bytes.Buffer
+	if err := c.Export(ctx, "json", &buffer); err != nil {
+		return nil, err
+	}
+	var observables []ObservableGooglePlay
+	err := json.Unmarshal(buffer.Bytes(), &observables)
+	return observables, err
+}
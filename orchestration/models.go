@@ -0,0 +1,195 @@
+package orchestration
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ObservableGooglePlay model
+type ObservableGooglePlay struct {
+	// Tenant is only known to the orchestrator, every tenant has its own storage layer
+	Tenant      string     `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	PackageName string     `json:"package_name" bson:"package_name"`
+	Interval    string     `json:"interval" bson:"interval"`
+	TimeZone    string     `json:"time_zone,omitempty" bson:"time_zone,omitempty"`
+	Jitter      string     `json:"jitter,omitempty" bson:"jitter,omitempty"`
+	Paused      bool       `json:"paused" bson:"paused"`
+	ResumeAt    *time.Time `json:"resume_at,omitempty" bson:"resume_at,omitempty"`
+	// CatchUp is the policy for runs missed while the orchestrator was down: once (default), each or skip
+	CatchUp       string     `json:"catch_up,omitempty" bson:"catch_up,omitempty"`
+	ObservedSince *time.Time `json:"observed_since,omitempty" bson:"observed_since,omitempty"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty" bson:"last_success_at,omitempty"`
+	// LastRunAt is the end of the last successful run the delay of the interval adaptive counts from
+	LastRunAt *time.Time `json:"last_run_at,omitempty" bson:"last_run_at,omitempty"`
+	// MinInterval and MaxInterval bound the delay between two runs of the interval adaptive
+	MinInterval string         `json:"min_interval,omitempty" bson:"min_interval,omitempty"`
+	MaxInterval string         `json:"max_interval,omitempty" bson:"max_interval,omitempty"`
+	Adaptive    *AdaptiveState `json:"adaptive,omitempty" bson:"adaptive,omitempty"`
+	Projects    []string       `json:"projects,omitempty" bson:"projects,omitempty"`
+	Tags        []string       `json:"tags,omitempty" bson:"tags,omitempty"`
+	// Discover proposes (propose) or observes (auto) the similar apps of the app page as competitors
+	Discover       string `json:"discover,omitempty" bson:"discover,omitempty"`
+	DiscoverDepth  int    `json:"discover_depth,omitempty" bson:"discover_depth,omitempty"`
+	DiscoverCount  int    `json:"discover_count,omitempty" bson:"discover_count,omitempty"`
+	DiscoveredFrom string `json:"discovered_from,omitempty" bson:"discovered_from,omitempty"`
+	DiscoveryLevel int    `json:"discovery_level,omitempty" bson:"discovery_level,omitempty"`
+}
+
+// AdaptiveState model
+type AdaptiveState struct {
+	Delay          string    `json:"delay" bson:"delay"`
+	NewReviewRatio float64   `json:"new_review_ratio" bson:"new_review_ratio"`
+	Reason         string    `json:"reason" bson:"reason"`
+	AdjustedAt     time.Time `json:"adjusted_at" bson:"adjusted_at"`
+}
+
+// ObservableStatus model
+type ObservableStatus struct {
+	ObservableGooglePlay
+	State    string            `json:"state"`
+	Schedule EffectiveSchedule `json:"schedule"`
+}
+
+// EffectiveSchedule model
+type EffectiveSchedule struct {
+	CronExpression string     `json:"cron_expression,omitempty"`
+	Delay          string     `json:"delay,omitempty"`
+	TimeZone       string     `json:"time_zone"`
+	JitterOffset   string     `json:"jitter_offset,omitempty"`
+	NextRun        *time.Time `json:"next_run,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// Run model of a single execution of the observation pipeline
+type Run struct {
+	ID          string     `json:"id"`
+	Tenant      string     `json:"tenant,omitempty"`
+	PackageName string     `json:"package_name"`
+	Trigger     string     `json:"trigger"`
+	Status      string     `json:"status"`
+	QueuedAt    time.Time  `json:"queued_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	MissedAt    *time.Time `json:"missed_at,omitempty"`
+	RunResult
+}
+
+// RunResult model
+type RunResult struct {
+	CrawledReviews     int     `json:"crawled_reviews"`
+	NewReviews         int     `json:"new_reviews"`
+	ClassifiedReviews  int     `json:"classified_reviews"`
+	PageCrawled        bool    `json:"page_crawled"`
+	DiscoveredApps     int     `json:"discovered_apps,omitempty"`
+	PushedRequirements int     `json:"pushed_requirements,omitempty"`
+	BugReports         int     `json:"bug_reports"`
+	FeatureRequests    int     `json:"feature_requests"`
+	OneStarReviews     int     `json:"one_star_reviews"`
+	PageRating         float64 `json:"page_rating,omitempty"`
+	AppVersion         string  `json:"app_version,omitempty"`
+	// ReviewsPerRating counts the classified reviews per star rating, index 0 are 1-star reviews
+	ReviewsPerRating []int  `json:"reviews_per_rating,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Progress model of a step of a run
+type Progress struct {
+	RunID       string    `json:"run_id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	PackageName string    `json:"package_name"`
+	Step        string    `json:"step"`
+	Status      string    `json:"status"`
+	Count       int       `json:"count,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// DeadLetter model of an app whose last runs failed
+type DeadLetter struct {
+	Tenant        string     `json:"tenant,omitempty"`
+	PackageName   string     `json:"package_name"`
+	RunID         string     `json:"run_id"`
+	Trigger       string     `json:"trigger"`
+	Error         string     `json:"error"`
+	Failures      int        `json:"failures"`
+	FirstFailedAt *time.Time `json:"first_failed_at,omitempty"`
+	FailedAt      *time.Time `json:"failed_at,omitempty"`
+}
+
+// Event model of a domain event of the pipeline
+type Event struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Tenant      string          `json:"tenant,omitempty"`
+	PackageName string          `json:"package_name,omitempty"`
+	RunID       string          `json:"run_id,omitempty"`
+	OccurredAt  time.Time       `json:"occurred_at"`
+	Data        json.RawMessage `json:"data,omitempty"`
+}
+
+// Labels model
+type Labels struct {
+	Projects []string `json:"projects"`
+	Tags     []string `json:"tags"`
+}
+
+// Project model
+type Project struct {
+	Name        string `json:"name"`
+	Observables int    `json:"observables"`
+}
+
+// BulkReport model of an operation on all apps of a project
+type BulkReport struct {
+	Project string       `json:"project"`
+	Results []BulkResult `json:"results"`
+}
+
+// BulkResult model
+type BulkResult struct {
+	PackageName string `json:"package_name"`
+	Status      bool   `json:"status"`
+	Message     string `json:"message"`
+}
+
+// ImportReport model
+type ImportReport struct {
+	Applied bool              `json:"applied"`
+	Rows    []ImportRowReport `json:"rows"`
+}
+
+// ImportRowReport model
+type ImportRowReport struct {
+	Row         int    `json:"row"`
+	PackageName string `json:"package_name"`
+	Interval    string `json:"interval"`
+	Status      string `json:"status"`
+	Message     string `json:"message,omitempty"`
+}
+
+// IntervalPreview model
+type IntervalPreview struct {
+	Interval       string      `json:"interval"`
+	CronExpression string      `json:"cron_expression"`
+	Next           []time.Time `json:"next"`
+}
+
+// Response model. RunID identifies the progress of a one-time processing in the progress stream of all runs
+type Response struct {
+	Message string `json:"message"`
+	Status  bool   `json:"status"`
+	RunID   string `json:"run_id,omitempty"`
+}
+
+// Health model
+type Health struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// ComponentStatus model
+type ComponentStatus struct {
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	Observables int    `json:"observables,omitempty"`
+}
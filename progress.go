@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * live progress of runs as Server-Sent Events. The pipeline reports the start and the end of each step with its count
+ * or error; the job queue reports the state changes of a run. Progress is not kept: a subscriber only gets the progress
+ * reported while it is connected, and the state of the run it subscribed to. Slow subscribers miss progress rather
+ * than delaying the pipeline.
+ */
+
+const (
+	stepRun             = "run"
+	stepCrawlPage       = "crawl_page"
+	stepCrawlReviews    = "crawl_reviews"
+	stepFilterReviews   = "filter_reviews"
+	stepClassifyReviews = "classify_reviews"
+	stepStoreReviews    = "store_reviews"
+	stepPostProcess     = "post_process"
+
+	progressStarted  = "started"
+	progressFinished = "finished"
+	progressFailed   = "failed"
+
+	progressBufferSize = 64
+)
+
+// progressHeartbeat is the interval of the comments that keep idle streams open
+var progressHeartbeat = 15 * time.Second
+
+// progressSubscriber receives the progress of the runs of a tenant, optionally of a single app or run
+type progressSubscriber struct {
+	tenant      string
+	packageName string
+	runID       string
+	progress    chan Progress
+}
+
+func (s *progressSubscriber) matches(progress Progress) bool {
+	return progress.Tenant == s.tenant &&
+		(s.packageName == "" || progress.PackageName == s.packageName) &&
+		(s.runID == "" || progress.RunID == s.runID)
+}
+
+var progressSubscribers = map[*progressSubscriber]bool{}
+var progressMutex sync.Mutex
+
+func subscribeProgress(subscriber *progressSubscriber) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	subscriber.progress = make(chan Progress, progressBufferSize)
+	progressSubscribers[subscriber] = true
+}
+
+func unsubscribeProgress(subscriber *progressSubscriber) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	delete(progressSubscribers, subscriber)
+}
+
+// publishProgress passes progress to the matching subscribers without waiting for them
+func publishProgress(progress Progress) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	for subscriber := range progressSubscribers {
+		if !subscriber.matches(progress) {
+			continue
+		}
+		select {
+		case subscriber.progress <- progress:
+		default:
+		}
+	}
+}
+
+// progressReporter reports the progress of the steps of a run. The zero value reports nothing
+type progressReporter struct {
+	runID       string
+	tenant      string
+	packageName string
+}
+
+func progressOf(run Run) progressReporter {
+	return progressReporter{runID: run.ID, tenant: run.Tenant, packageName: run.PackageName}
+}
+
+func (p progressReporter) report(step string, status string, count int, err string) {
+	if p.runID == "" {
+		return
+	}
+	publishProgress(Progress{RunID: p.runID, Tenant: p.tenant, PackageName: p.packageName, Step: step, Status: status, Count: count, Error: err, At: time.Now()})
+}
+
+func (p progressReporter) start(step string) {
+	p.report(step, progressStarted, 0, "")
+}
+
+func (p progressReporter) finish(step string, count int) {
+	p.report(step, progressFinished, count, "")
+}
+
+func (p progressReporter) fail(step string, err string) {
+	p.report(step, progressFailed, 0, err)
+}
+
+// reportRun reports a state change of a run
+func reportRun(run Run) {
+	progressOf(run).report(stepRun, run.Status, run.ClassifiedReviews, run.Error)
+}
+
+// runFinished is true if the run reached its final state
+func runFinished(run Run) bool {
+	return run.Status == runSucceeded || run.Status == runFailed
+}
+
+// streamProgress writes the progress of the subscriber as Server-Sent Events until the client disconnects, or the run finished if the subscriber follows a single run
+func streamProgress(w http.ResponseWriter, r *http.Request, subscriber *progressSubscriber, run *Run) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "streaming is not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if run != nil {
+		writeServerSentEvent(w, "run", *run)
+		if runFinished(*run) {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(progressHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// the final state may have been missed by a slow client
+			if run != nil {
+				if current, ok := RunOf(run.ID); ok && runFinished(current) {
+					writeServerSentEvent(w, "run", current)
+					flusher.Flush()
+					return
+				}
+			}
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case progress := <-subscriber.progress:
+			writeServerSentEvent(w, "progress", progress)
+			if run != nil && progress.Step == stepRun && (progress.Status == runSucceeded || progress.Status == runFailed) {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event string, data interface{}) {
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+// getProgress streams the progress of all runs of the tenant. Query parameter: package_name
+func getProgress(w http.ResponseWriter, r *http.Request) {
+	subscriber := &progressSubscriber{tenant: tenantOf(r), packageName: r.URL.Query().Get("package_name")}
+	subscribeProgress(subscriber)
+	defer unsubscribeProgress(subscriber)
+	streamProgress(w, r, subscriber, nil)
+}
+
+// getRunProgress streams the state and the progress of a single run until it finished
+func getRunProgress(w http.ResponseWriter, r *http.Request) {
+	runID := mux.Vars(r)["run_id"]
+	subscriber := &progressSubscriber{tenant: tenantOf(r), runID: runID}
+	// subscribe before the state is loaded, so no progress between both is missed
+	subscribeProgress(subscriber)
+	defer unsubscribeProgress(subscriber)
+
+	run, ok := RunOf(runID)
+	if !ok || run.Tenant != tenantOf(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "unknown run"})
+		return
+	}
+	streamProgress(w, r, subscriber, &run)
+}
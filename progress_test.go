@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readServerSentEvents passes the events of a stream to a channel until the stream ends or is closed
+func readServerSentEvents(t *testing.T, url string) (<-chan [2]string, io.Closer) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("Expected an event stream. Got %s instead", res.Header.Get("Content-Type"))
+	}
+	events := make(chan [2]string, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(res.Body)
+		var event string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				events <- [2]string{event, strings.TrimPrefix(line, "data: ")}
+			}
+		}
+	}()
+	return events, res.Body
+}
+
+func TestRunProgress(t *testing.T) {
+	induceServerError = false
+	server := httptest.NewServer(router)
+	defer server.Close()
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.progress.app/interval/daily"}.mustExecuteRequest(nil))
+
+	events, stream := readServerSentEvents(t, server.URL+"/hitec/orchestration/app/runs/progress?package_name=com.progress.app")
+	defer stream.Close()
+	run := runNow(t, "com.progress.app")
+
+	var steps []string
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case event := <-events:
+			var progress Progress
+			json.Unmarshal([]byte(event[1]), &progress)
+			if progress.RunID != run.ID {
+				t.Fatalf("Expected the progress of the run. Got %s instead", event[1])
+			}
+			steps = append(steps, progress.Step+" "+progress.Status)
+			done = progress.Step == stepRun && progress.Status == runSucceeded
+		case <-timeout:
+			t.Fatalf("Expected the run to finish. Got %v", steps)
+		}
+	}
+	// the app page of an app without discovery, digests, rating alerts or issue sinks is not crawled
+	expected := "run queued,run running,crawl_reviews started,crawl_reviews finished,filter_reviews started,filter_reviews finished," +
+		"classify_reviews started,classify_reviews finished,store_reviews started,store_reviews finished,post_process started,post_process finished,run succeeded"
+	if strings.Join(steps, ",") != expected {
+		t.Errorf("Expected the steps of the pipeline. Got %v instead", steps)
+	}
+
+	// the stream of a finished run only contains its state
+	var single [][2]string
+	events, stream = readServerSentEvents(t, server.URL+"/hitec/orchestration/app/runs/"+run.ID+"/progress")
+	defer stream.Close()
+	for event := range events {
+		single = append(single, event)
+	}
+	if len(single) != 1 || single[0][0] != "run" || !strings.Contains(single[0][1], `"status":"succeeded"`) {
+		t.Errorf("Expected the state of the finished run. Got %v instead", single)
+	}
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/runs/unknown/progress"}.mustExecuteRequest(nil))
+}
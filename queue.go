@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * job queue of the observation pipeline. Scheduled and manual runs are executed by a fixed number of workers.
+ * An app is never queued twice, so a manual run cannot overlap with a scheduled one.
+ * Runs of a tenant that reached its concurrency quota wait in a backlog of the tenant until one of its runs finished.
+ */
+
+var errRunPending = errors.New("a run of this app is already queued or running")
+var errQueueFull = errors.New("job queue is full")
+
+// JobQueue executes the runs of the observation pipeline
+type JobQueue struct {
+	jobs    chan []Run
+	mutex   sync.Mutex
+	pending map[string]string // observable key -> run id
+	active  map[string]int    // tenant -> runs in the channel or executed
+	backlog map[string][][]Run
+}
+
+var jobQueue *JobQueue
+
+// StartJobQueue starts the workers (RUN_WORKERS, default 2) of the job queue. Every replica prunes its run history once per hour,
+// followers execute manual runs too
+func StartJobQueue() {
+	workers, err := strconv.Atoi(getEnv("RUN_WORKERS", "2"))
+	if err != nil || workers < 1 {
+		log.Fatalf("invalid RUN_WORKERS %q", getEnv("RUN_WORKERS", "2"))
+	}
+
+	jobQueue = NewJobQueue(workers, 1000)
+	go func() {
+		for range time.Tick(time.Hour) {
+			pruneRuns(time.Now().Add(-runHistoryRetention))
+		}
+	}()
+}
+
+// NewJobQueue creates a queue holding up to size jobs and starts its workers
+func NewJobQueue(workers int, size int) *JobQueue {
+	q := &JobQueue{jobs: make(chan []Run, size), pending: map[string]string{}, active: map[string]int{}, backlog: map[string][][]Run{}}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue adds a run of the observation pipeline of an app of a tenant to the queue
+func (q *JobQueue) Enqueue(tenant string, packageName string, trigger string) (Run, error) {
+	runs, err := q.enqueue(tenant, packageName, trigger, []*time.Time{nil})
+	if err != nil {
+		return Run{}, err
+	}
+	return runs[0], nil
+}
+
+// EnqueueCatchUp adds a catch-up run for each missed fire time of an app. The runs are executed one after another
+func (q *JobQueue) EnqueueCatchUp(tenant string, packageName string, missed []time.Time) ([]Run, error) {
+	slots := make([]*time.Time, len(missed))
+	for i := range missed {
+		slots[i] = &missed[i]
+	}
+	return q.enqueue(tenant, packageName, triggerCatchUp, slots)
+}
+
+func (q *JobQueue) enqueue(tenant string, packageName string, trigger string, slots []*time.Time) ([]Run, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	key := observableKey(tenant, packageName)
+	if _, ok := q.pending[key]; ok {
+		return nil, errRunPending
+	}
+
+	now := time.Now()
+	var runs []Run
+	for _, slot := range slots {
+		runs = append(runs, Run{ID: newRunID(now), Tenant: tenant, PackageName: packageName, Trigger: trigger, Status: runQueued, QueuedAt: now, MissedAt: slot})
+	}
+	// the runs are queued in the history before a worker can pick them up, so their state is never overwritten by queued
+	for _, run := range runs {
+		SaveRun(run)
+		reportRun(run)
+	}
+	if limit := maxConcurrentRunsOf(tenant); limit > 0 && q.active[tenant] >= limit {
+		if len(q.backlog[tenant]) >= cap(q.jobs) {
+			deleteRuns(runs)
+			return nil, errQueueFull
+		}
+		q.backlog[tenant] = append(q.backlog[tenant], runs)
+	} else {
+		select {
+		case q.jobs <- runs:
+		default:
+			deleteRuns(runs)
+			return nil, errQueueFull
+		}
+		q.active[tenant]++
+	}
+	q.pending[key] = runs[0].ID
+	return runs, nil
+}
+
+func (q *JobQueue) work() {
+	for runs := range q.jobs {
+		for _, run := range runs {
+			q.execute(run)
+		}
+		q.done(runs[0])
+	}
+}
+
+// done releases the app and passes the concurrency slot of its tenant to the next run of the backlog
+func (q *JobQueue) done(run Run) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.pending, observableKey(run.Tenant, run.PackageName))
+	backlog := q.backlog[run.Tenant]
+	if len(backlog) == 0 {
+		q.active[run.Tenant]--
+		return
+	}
+	next := backlog[0]
+	if len(backlog) == 1 {
+		delete(q.backlog, run.Tenant)
+	} else {
+		q.backlog[run.Tenant] = backlog[1:]
+	}
+	// the slot stays with the tenant. Sending must not block the worker that consumes the channel
+	go func() { q.jobs <- next }()
+}
+
+func (q *JobQueue) execute(run Run) {
+	startedAt := time.Now()
+	run.Status = runRunning
+	run.StartedAt = &startedAt
+	SaveRun(run)
+	reportRun(run)
+
+	run.RunResult = updateApp(run.Tenant, run.PackageName, progressOf(run))
+
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	run.Status = runSucceeded
+	if run.Error != "" {
+		run.Status = runFailed
+		log.Printf("ERR %s run %s of %s failed: %s\n", run.Trigger, run.ID, observableKey(run.Tenant, run.PackageName), run.Error)
+	}
+
+	UpdateObservable(run.Tenant, run.PackageName, func(observable *ObservableGooglePlay) {
+		// a failed run must not push the next adaptive run back, see AdaptiveDue
+		if run.Status != runSucceeded {
+			return
+		}
+		observable.LastRunAt = &finishedAt
+		observable.LastSuccessAt = &finishedAt
+		if isAdaptive(*observable) {
+			recent := Runs(RunFilter{Tenant: run.Tenant, PackageName: run.PackageName, Status: runSucceeded, Limit: adaptiveWindow - 1})
+			AdjustAdaptiveDelay(observable, append([]Run{run}, recent...), finishedAt)
+		}
+	})
+	SaveRun(run)
+	if run.Status == runSucceeded {
+		EvaluateAlerts(run.Tenant, run.PackageName, finishedAt)
+		ResolveDeadLetter(run.Tenant, run.PackageName)
+	} else {
+		RecordDeadLetter(run)
+	}
+	reportRun(run)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * Inbound rate limiting: a token bucket per client identity and route, and a daily quota of process runs per client.
+ * Rate limiting is disabled if RATE_LIMITS_FILE is not set. Idle buckets and the quotas of past days are removed once per hour.
+ */
+
+// RateLimit of a token bucket. Rate is the number of requests refilled per second, Burst the bucket size
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// ClientLimits overrides the limits for a single client
+type ClientLimits struct {
+	Routes            map[string]RateLimit `json:"routes"`
+	ProcessDailyQuota *int                 `json:"process_daily_quota"`
+}
+
+// RateLimitConfig model of the RATE_LIMITS_FILE. Routes are keyed by their path template
+type RateLimitConfig struct {
+	Default           *RateLimit              `json:"default"`
+	Routes            map[string]RateLimit    `json:"routes"`
+	ProcessDailyQuota int                     `json:"process_daily_quota"`
+	Clients           map[string]ClientLimits `json:"clients"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // an idle bucket is full again from then on and equals a new one
+}
+
+// RateLimiter keeps the token buckets of all clients
+type RateLimiter struct {
+	config  RateLimitConfig
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// rateLimiter is nil if rate limiting is disabled
+var rateLimiter *RateLimiter
+
+const bucketQuotas = "quotas"
+
+// LoadRateLimiter configures the rate limiting from the RATE_LIMITS_FILE
+func LoadRateLimiter() error {
+	path := os.Getenv("RATE_LIMITS_FILE")
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config RateLimitConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid rate limits file: %v", err)
+	}
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("invalid rate limits file: %v", err)
+	}
+	rateLimiter = NewRateLimiter(config)
+	go func() {
+		for now := range time.Tick(time.Hour) {
+			rateLimiter.evictIdle(now)
+			pruneQuotas(now)
+		}
+	}()
+	return nil
+}
+
+// validate rejects limits whose bucket can never hold a token
+func (c RateLimitConfig) validate() error {
+	check := func(name string, limit RateLimit) error {
+		if limit.Rate < 0 {
+			return fmt.Errorf("rate of %s must not be negative", name)
+		}
+		if limit.Rate > 0 && limit.Burst < 1 {
+			return fmt.Errorf("burst of %s must be at least 1", name)
+		}
+		return nil
+	}
+	if c.Default != nil {
+		if err := check("the default", *c.Default); err != nil {
+			return err
+		}
+	}
+	for route, limit := range c.Routes {
+		if err := check(route, limit); err != nil {
+			return err
+		}
+	}
+	for client, clientLimits := range c.Clients {
+		for route, limit := range clientLimits.Routes {
+			if err := check(route+" of "+client, limit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NewRateLimiter creates a rate limiter
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{config: config, buckets: map[string]*tokenBucket{}}
+}
+
+func (l *RateLimiter) limitOf(client string, route string) (RateLimit, bool) {
+	if clientLimits, ok := l.config.Clients[client]; ok {
+		if limit, ok := clientLimits.Routes[route]; ok {
+			return limit, true
+		}
+	}
+	if limit, ok := l.config.Routes[route]; ok {
+		return limit, true
+	}
+	if l.config.Default != nil {
+		return *l.config.Default, true
+	}
+	return RateLimit{}, false
+}
+
+// Allow takes a token of the bucket of client and route. If the bucket is empty, it returns the time until the next token is available
+func (l *RateLimiter) Allow(client string, route string, now time.Time) (bool, time.Duration) {
+	limit, ok := l.limitOf(client, route)
+	if !ok || limit.Rate <= 0 {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := client + " " + route
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.Burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limit.Burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		bucket.full = now.Add(time.Duration((limit.Burst - bucket.tokens) / limit.Rate * float64(time.Second)))
+		return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	bucket.full = now.Add(time.Duration((limit.Burst - bucket.tokens) / limit.Rate * float64(time.Second)))
+	return true, 0
+}
+
+// evictIdle removes the buckets that are full again, the next request of their client creates a new one
+func (l *RateLimiter) evictIdle(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, bucket := range l.buckets {
+		if !now.Before(bucket.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ProcessDailyQuota returns the number of process runs a client may trigger per day, 0 means unlimited
+func (l *RateLimiter) ProcessDailyQuota(client string) int {
+	if clientLimits, ok := l.config.Clients[client]; ok && clientLimits.ProcessDailyQuota != nil {
+		return *clientLimits.ProcessDailyQuota
+	}
+	return l.config.ProcessDailyQuota
+}
+
+// ConsumeProcessQuota counts a process run of the client. Returns false and the time until the quota resets if it is exhausted
+func (l *RateLimiter) ConsumeProcessQuota(client string, now time.Time) (bool, time.Duration) {
+	quota := l.ProcessDailyQuota(client)
+	if quota <= 0 {
+		return true, 0
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	resetIn := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+	allowed := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketQuotas))
+		if err != nil {
+			return err
+		}
+		key := []byte(client + "/" + day)
+		used := 0
+		if data := bucket.Get(key); data != nil {
+			used, _ = strconv.Atoi(string(data))
+		}
+		if used >= quota {
+			return nil
+		}
+		allowed = true
+		return bucket.Put(key, []byte(strconv.Itoa(used+1)))
+	})
+	if err != nil {
+		fmt.Println("ERR could not count the process quota", err)
+		return true, 0
+	}
+	return allowed, resetIn
+}
+
+// pruneQuotas removes the process quotas of past days
+func pruneQuotas(now time.Time) {
+	if db == nil {
+		return
+	}
+	today := now.UTC().Format("2006-01-02")
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketQuotas))
+		if bucket == nil {
+			return nil
+		}
+		var stale [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			key := string(k)
+			if key[strings.LastIndex(key, "/")+1:] < today {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not prune the process quotas: %v\n", err)
+	}
+}
+
+// clientOf identifies the client by its authenticated name within its tenant (see observableKey) or, without authentication, by its IP address
+func clientOf(r *http.Request) string {
+	if identity := IdentityOf(r); identity != nil && authenticator != nil {
+		return observableKey(identity.Tenant, identity.Name)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitMiddleware rejects requests with 429 if the client exceeded the rate limit of the route
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		if ok, retryAfter := rateLimiter.Allow(clientOf(r), route, time.Now()); !ok {
+			respondTooManyRequests(w, retryAfter, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withProcessQuota rejects requests with 429 if the client exhausted its daily quota of process runs. Requests with an invalid package name
+// do not count, the handler rejects them
+func withProcessQuota(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimiter != nil && ValidatePackageName(mux.Vars(r)["package_name"]) == nil {
+			if ok, retryAfter := rateLimiter.ConsumeProcessQuota(clientOf(r), time.Now()); !ok {
+				respondTooManyRequests(w, retryAfter, "daily quota of process runs exhausted")
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func respondTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(Response{Status: false, Message: message})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		Default: &RateLimit{Rate: 1, Burst: 2},
+		Clients: map[string]ClientLimits{"ci": {Routes: map[string]RateLimit{"/process": {Rate: 10, Burst: 10}}}},
+	})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("script", "/process", now); !ok {
+			t.Fatal("Expected the burst to be allowed")
+		}
+	}
+	ok, retryAfter := limiter.Allow("script", "/process", now)
+	if ok || retryAfter != time.Second {
+		t.Errorf("Expected the client to wait for one second. Got %v, %v instead", ok, retryAfter)
+	}
+	if ok, _ := limiter.Allow("script", "/process", now.Add(time.Second)); !ok {
+		t.Error("Expected a token to be refilled")
+	}
+	if ok, _ := limiter.Allow("other", "/process", now); !ok {
+		t.Error("Expected clients to have separate buckets")
+	}
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.Allow("ci", "/process", now); !ok {
+			t.Fatal("Expected the client override to be applied")
+		}
+	}
+
+	limiter.evictIdle(now.Add(2 * time.Second))
+	if _, ok := limiter.buckets["script /process"]; !ok || len(limiter.buckets) != 1 {
+		t.Error("Expected a bucket that is not full yet to be kept")
+	}
+	limiter.evictIdle(now.Add(3 * time.Second))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("Expected the idle buckets to be evicted. Got %d instead", len(limiter.buckets))
+	}
+
+	invalid := RateLimitConfig{Clients: map[string]ClientLimits{"ci": {Routes: map[string]RateLimit{"/process": {Rate: 1}}}}}
+	if err := invalid.validate(); err == nil {
+		t.Error("Expected a bucket without burst to be rejected")
+	}
+}
+
+func TestProcessQuota(t *testing.T) {
+	induceServerError = false
+	unlimited := 0
+	rateLimiter = NewRateLimiter(RateLimitConfig{
+		ProcessDailyQuota: 1,
+		Clients:           map[string]ClientLimits{"trusted": {ProcessDailyQuota: &unlimited}},
+	})
+	defer func() { rateLimiter = nil }()
+
+	assertStatus(t, http.StatusBadRequest, endpoint{method: "POST", url: "/hitec/orchestration/app/process/google-play/package-name/openreq"}.mustExecuteRequest(nil))
+	ep := endpoint{method: "POST", url: "/hitec/orchestration/app/process/google-play/package-name/eu.openreq"}
+	assertSuccess(t, ep.mustExecuteRequest(nil))
+	rr := ep.mustExecuteRequest(nil)
+	assertStatus(t, http.StatusTooManyRequests, rr)
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rateLimiter.ConsumeProcessQuota("trusted", time.Now()); !ok {
+			t.Fatal("Expected the quota override to be applied")
+		}
+	}
+	pruneQuotas(time.Now().Add(48 * time.Hour))
+	assertSuccess(t, ep.mustExecuteRequest(nil))
+}
+
+func TestClientOf(t *testing.T) {
+	defer func() { authenticator = nil }()
+	authenticator = &Authenticator{}
+	clients := map[string]bool{}
+	for _, tenant := range []string{defaultTenant, "acme"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), identityContextKey, &Identity{Name: "ci", Tenant: tenant}))
+		clients[clientOf(r)] = true
+	}
+	if !clients["ci"] || !clients["acme/ci"] {
+		t.Errorf("Expected the clients of different tenants to be told apart. Got %v instead", clients)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * export of feature requests as OpenReq requirements. The kept reviews (see reviews.go) classified as feature request
+ * are exported on demand and, if the tenant has a requirements_url (REQUIREMENTS_URL for the default tenant), pushed
+ * to it after each run. Requirements that could not be pushed are pushed with the next run.
+ * The source review id, the app and the rating of a review are kept as requirement parts.
+ */
+
+const (
+	requirementStatus = "submitted"
+	requirementType   = "requirement"
+
+	maxRequirementNameLength = 80
+	maxRequirementsPerPush   = 100
+)
+
+// requirementsMutex serializes the pushes of requirements, so a requirement is pushed only once
+var requirementsMutex sync.Mutex
+
+// RequirementOf converts a feature request into an OpenReq requirement
+func RequirementOf(featureRequest KeptReview) Requirement {
+	review := featureRequest.Review
+	id := "review-" + review.ReviewID
+	classifiedAt := featureRequest.ClassifiedAt.UnixNano() / int64(time.Millisecond)
+	return Requirement{
+		ID:              id,
+		Name:            summaryOf(review.Title, review.Body, maxRequirementNameLength),
+		Text:            review.Body,
+		CreatedAt:       classifiedAt,
+		ModifiedAt:      classifiedAt,
+		Status:          requirementStatus,
+		RequirementType: requirementType,
+		RequirementParts: []RequirementPart{
+			{ID: id + "-review_id", Name: "review_id", Text: review.ReviewID},
+			{ID: id + "-package_name", Name: "package_name", Text: review.PackageName},
+			{ID: id + "-rating", Name: "rating", Text: strconv.Itoa(review.Rating)},
+			{ID: id + "-perma_link", Name: "perma_link", Text: review.PermaLink},
+		},
+	}
+}
+
+// FeatureRequestFilter selects feature requests of a tenant. Other empty fields match every feature request
+type FeatureRequestFilter struct {
+	Tenant      string
+	PackageName string
+	// PackageNames restricts the feature requests to a set of apps, e.g. the ones of a project
+	PackageNames map[string]bool
+	Since        *time.Time
+	Unpushed     bool
+}
+
+// FeatureRequests returns the kept feature requests matching the filter, oldest first
+func FeatureRequests(filter FeatureRequestFilter) []KeptReview {
+	featureRequests := []KeptReview{}
+	if db == nil {
+		return featureRequests
+	}
+	prefix := []byte(filter.Tenant + "/")
+	if filter.PackageName != "" {
+		prefix = []byte(reviewPrefix(filter.Tenant, filter.PackageName))
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(bucketReviews)).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var featureRequest KeptReview
+			if err := json.Unmarshal(v, &featureRequest); err != nil {
+				return err
+			}
+			if !featureRequest.Review.FeatureRequest ||
+				!matchesPackageNames(filter.PackageNames, featureRequest.Review.PackageName) ||
+				(filter.Since != nil && featureRequest.ClassifiedAt.Before(*filter.Since)) ||
+				(filter.Unpushed && featureRequest.PushedAt != nil) {
+				continue
+			}
+			featureRequests = append(featureRequests, featureRequest)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the feature requests: %v\n", err)
+	}
+	sort.SliceStable(featureRequests, func(i, j int) bool {
+		return featureRequests[i].ClassifiedAt.Before(featureRequests[j].ClassifiedAt)
+	})
+	return featureRequests
+}
+
+// PushRequirements pushes the feature requests of a tenant that were not pushed yet to its requirements endpoint. Returns the number of pushed requirements and ok if all could be pushed
+func PushRequirements(tenant *Tenant) (int, bool) {
+	if tenant.RequirementsURL == "" {
+		return 0, true
+	}
+	requirementsMutex.Lock()
+	defer requirementsMutex.Unlock()
+
+	featureRequests := FeatureRequests(FeatureRequestFilter{Tenant: tenant.ID, Unpushed: true})
+	pushed := 0
+	for start := 0; start < len(featureRequests); start += maxRequirementsPerPush {
+		end := start + maxRequirementsPerPush
+		if end > len(featureRequests) {
+			end = len(featureRequests)
+		}
+		batch := featureRequests[start:end]
+		requirements := make([]Requirement, len(batch))
+		for i, featureRequest := range batch {
+			requirements[i] = RequirementOf(featureRequest)
+		}
+		if ok := RESTPostRequirements(tenant, requirements); !ok {
+			return pushed, false
+		}
+
+		now := time.Now()
+		for _, featureRequest := range batch {
+			featureRequest.PushedAt = &now
+			key := keyOfReview(featureRequest)
+			if err := storePut(bucketReviews, key, featureRequest); err != nil {
+				log.Printf("ERR could not mark feature request %s as pushed: %v\n", key, err)
+			}
+		}
+		pushed += len(batch)
+	}
+	return pushed, true
+}
+
+// exportRequirements pushes the kept feature requests if the tenant has a requirements endpoint. Returns the number of pushed requirements
+func exportRequirements(tenant *Tenant) int {
+	pushed, ok := PushRequirements(tenant)
+	if !ok {
+		log.Printf("could not push all requirements of tenant %q, pushing them with the next run\n", tenant.ID)
+	}
+	return pushed
+}
+
+// getRequirements exports the kept feature requests as OpenReq requirements. Query parameters: package_name, project, tag, since (RFC 3339), unpushed
+func getRequirements(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	filter := FeatureRequestFilter{Tenant: tenantOf(r), PackageName: query.Get("package_name"), PackageNames: packageNamesOf(observableFilterOf(r)), Unpushed: query.Get("unpushed") == "true"}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			respondBadRequest(w, fmt.Errorf("invalid since %q: use RFC 3339", since))
+			return
+		}
+		filter.Since = &t
+	}
+
+	requirements := []Requirement{}
+	for _, featureRequest := range FeatureRequests(filter) {
+		requirements = append(requirements, RequirementOf(featureRequest))
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(requirements)
+}
+
+// postPushRequirements pushes the requirements that were not pushed yet to the requirements endpoint of the tenant
+func postPushRequirements(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tenant, _ := TenantOf(tenantOf(r))
+	if tenant.RequirementsURL == "" {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "no requirements endpoint configured"})
+		return
+	}
+	pushed, ok := PushRequirements(tenant)
+	if !ok {
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: fmt.Sprintf("pushed %d requirements, requirements endpoint unreachable", pushed)})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{Status: true, Message: fmt.Sprintf("pushed %d requirements", pushed)})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExportRequirements(t *testing.T) {
+	induceServerError = false
+	var pushed []Requirement
+	var pushes int
+	var pushedMutex sync.Mutex
+	endpointOfRequirements := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushedMutex.Lock()
+		defer pushedMutex.Unlock()
+		if r.Header.Get("Authorization") != "" || r.Header.Get("Content-Type") != TYPE_JSON {
+			t.Errorf("Expected JSON without the credentials of the tenant. Got %v instead", r.Header)
+		}
+		if pushes++; pushes == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var requirements []Requirement
+		json.NewDecoder(r.Body).Decode(&requirements)
+		for _, requirement := range requirements {
+			if requirement.ID == "review-requirement-1" {
+				pushed = append(pushed, requirement)
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer endpointOfRequirements.Close()
+
+	push := endpoint{method: "POST", url: "/hitec/orchestration/app/requirements/push"}
+	assertStatus(t, http.StatusConflict, push.mustExecuteRequest(nil))
+	os.Setenv("REQUIREMENTS_URL", endpointOfRequirements.URL)
+	defer os.Unsetenv("REQUIREMENTS_URL")
+	os.Setenv("BEARER_TOKEN", "downstream-token")
+	defer os.Unsetenv("BEARER_TOKEN")
+
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.requirements.app/interval/daily"}.mustExecuteRequest(nil))
+	if run := runNow(t, "com.requirements.app"); run.Error != "" || run.PushedRequirements != 0 {
+		t.Errorf("Expected the run to succeed although the push failed. Got %+v instead", run)
+	}
+	assertSuccess(t, push.mustExecuteRequest(nil))
+	runNow(t, "com.requirements.app")
+
+	pushedMutex.Lock()
+	if len(pushed) != 1 {
+		t.Fatalf("Expected the feature request of com.requirements.app to be pushed once. Got %+v instead", pushed)
+	}
+	requirement := pushed[0]
+	pushedMutex.Unlock()
+	parts := map[string]string{}
+	for _, part := range requirement.RequirementParts {
+		parts[part.Name] = part.Text
+	}
+	if requirement.Name != "Dark mode" || requirement.Text != "Please add a dark mode" || parts["review_id"] != "requirement-1" || parts["package_name"] != "com.requirements.app" || parts["rating"] != "4" {
+		t.Errorf("Expected the review to be converted into a requirement. Got %+v instead", requirement)
+	}
+
+	var requirements []Requirement
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/requirements?package_name=com.requirements.app"}.mustExecuteRequest(nil).Body).Decode(&requirements)
+	if len(requirements) != 1 || requirements[0].ID != requirement.ID {
+		t.Errorf("Expected the feature request to be exported on demand. Got %+v instead", requirements)
+	}
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/requirements?unpushed=true"}.mustExecuteRequest(nil).Body).Decode(&requirements)
+	if len(requirements) != 0 {
+		t.Errorf("Expected no unpushed requirements. Got %+v instead", requirements)
+	}
+	assertStatus(t, http.StatusBadRequest, endpoint{method: "GET", url: "/hitec/orchestration/app/requirements?since=yesterday"}.mustExecuteRequest(nil))
+
+	pruneReviews(time.Now())
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/requirements?package_name=com.requirements.app"}.mustExecuteRequest(nil).Body).Decode(&requirements)
+	if len(requirements) != 0 {
+		t.Errorf("Expected the pushed feature request to be pruned. Got %+v instead", requirements)
+	}
+}
+
+func TestPruneUnpushedRequirements(t *testing.T) {
+	KeepReviews(defaultTenant, []AppReviewGooglePlay{{ReviewID: "unpushed-1", PackageName: "com.requirements.unpushed", FeatureRequest: true}})
+	filter := FeatureRequestFilter{Tenant: defaultTenant, PackageName: "com.requirements.unpushed"}
+
+	os.Setenv("REQUIREMENTS_URL", "http://requirements.example.com")
+	pruneReviews(time.Now())
+	os.Unsetenv("REQUIREMENTS_URL")
+	if featureRequests := FeatureRequests(filter); len(featureRequests) != 1 {
+		t.Errorf("Expected the unpushed feature request to be kept until it is pushed. Got %+v instead", featureRequests)
+	}
+
+	pruneReviews(time.Now())
+	if featureRequests := FeatureRequests(filter); len(featureRequests) != 0 {
+		t.Errorf("Expected the feature request to be pruned without a requirements endpoint. Got %+v instead", featureRequests)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -9,13 +10,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"log"
 )
 
+// baseURL of the default tenant (see TenantOf)
 var baseURL = os.Getenv("BASE_URL")
-var bearerToken = "Bearer " + os.Getenv("BEARER_TOKEN")
 
 const (
 	// analytics layer
@@ -29,6 +31,8 @@ const (
 	// storage layer
 	endpointPostObserveAppGooglePlay            = "/ri-storage-app/hitec/repository/app/observe/app/google-play/package-name/%s/interval/%s"
 	endpointGetObservablesGooglePlay            = "/ri-storage-app/hitec/repository/app/observable/google-play"
+	endpointDeleteObservableGooglePlay          = "/ri-storage-app/hitec/repository/app/observable/google-play/package-name/%s"
+	endpointPostPauseObservableGooglePlay       = "/ri-storage-app/hitec/repository/app/observable/google-play/package-name/%s/pause"
 	endpointPostAppReviewGooglePlay             = "/ri-storage-app/hitec/repository/app/store/app-review/google-play/"
 	endpointPostAppPageGooglePlay               = "/ri-storage-app/hitec/repository/app/store/app-page/google-play/"
 	endpointPosNonExistingtAppReviewsGooglePlay = "/ri-storage-app/hitec/repository/app/non-existing/app-review/google-play"
@@ -43,6 +47,17 @@ const (
 	TYPE_JSON     = "application/json"
 )
 
+// downstreamServices are probed for the downstream health, by component name
+var downstreamServices = map[string]string{
+	"analytics_classification": "/ri-analytics-classification-google-play-review/",
+	"collection_reviews":       "/ri-collection-explicit-feedback-google-play-review/",
+	"collection_page":          "/ri-collection-explicit-feedback-google-play-page/",
+	"storage":                  "/ri-storage-app/",
+}
+
+// downstreamTimeout is how long a downstream service may take to respond to a probe
+var downstreamTimeout = 5 * time.Second
+
 var client = getHTTPClient()
 
 func getHTTPClient() *http.Client {
@@ -63,7 +78,8 @@ func getHTTPClient() *http.Client {
 		},
 		Timeout: timeout,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			req.Header.Add(AUTHORIZATION, bearerToken)
+			// keep the credentials of the tenant that sent the original request
+			req.Header.Set(AUTHORIZATION, via[0].Header.Get(AUTHORIZATION))
 			return nil
 		},
 	}
@@ -72,11 +88,11 @@ func getHTTPClient() *http.Client {
 }
 
 // RESTPostStoreObserveAppGooglePlay returns ok
-func RESTPostStoreObserveAppGooglePlay(packageName string, interval string) bool {
+func RESTPostStoreObserveAppGooglePlay(tenant *Tenant, packageName string, interval string) bool {
 	endpoint := fmt.Sprintf(endpointPostObserveAppGooglePlay, packageName, interval)
-	url := baseURL + endpoint
+	url := tenant.url(endpoint)
 	req, _ := http.NewRequest(POST, url, nil)
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	res, err := client.Do(req)
 	if err != nil {
@@ -90,110 +106,196 @@ func RESTPostStoreObserveAppGooglePlay(packageName string, interval string) bool
 	return false
 }
 
-// RESTGetObservablesGooglePlay retrieve all observables from the storage layer
-func RESTGetObservablesGooglePlay() []ObservableGooglePlay {
+// RESTDeleteObservableGooglePlay removes an observable from the storage layer. Returns ok if it was removed. Not found is
+// not ok: the storage layer would still return it, and the reconcile would observe it again
+func RESTDeleteObservableGooglePlay(tenant *Tenant, packageName string) bool {
+	url := tenant.url(fmt.Sprintf(endpointDeleteObservableGooglePlay, packageName))
+	req, _ := http.NewRequest(DELETE, url, nil)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
+	req.Header.Add(ACCEPT, TYPE_JSON)
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("ERR %v\n", err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		log.Printf("ERR storage layer responded with %d, could not remove the observable %s\n", res.StatusCode, packageName)
+		return false
+	}
+	return true
+}
+
+// RESTPostPauseObservableGooglePlay stores the paused state and resume time of an observable in the storage layer. Returns ok if it was stored
+func RESTPostPauseObservableGooglePlay(tenant *Tenant, packageName string, paused bool, resumeAt *time.Time) bool {
+	requestBody := new(bytes.Buffer)
+	json.NewEncoder(requestBody).Encode(ObservableGooglePlay{PackageName: packageName, Paused: paused, ResumeAt: resumeAt})
+	url := tenant.url(fmt.Sprintf(endpointPostPauseObservableGooglePlay, packageName))
+	req, _ := http.NewRequest(POST, url, requestBody)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
+	req.Header.Set("Content-Type", TYPE_JSON)
+	req.Header.Add(ACCEPT, TYPE_JSON)
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("ERR %v\n", err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		log.Printf("ERR storage layer responded with %d, could not store the paused state of %s\n", res.StatusCode, packageName)
+		return false
+	}
+	return true
+}
+
+// RESTProbeDownstream probes the downstream services of a tenant concurrently. A service is ok if it responds without a server error
+func RESTProbeDownstream(tenant *Tenant) map[string]ComponentStatus {
+	statuses := map[string]ComponentStatus{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, path := range downstreamServices {
+		wg.Add(1)
+		go func(name string, path string) {
+			defer wg.Done()
+			status := ComponentStatus{Status: statusOK, Message: "reachable"}
+			ctx, cancel := context.WithTimeout(context.Background(), downstreamTimeout)
+			defer cancel()
+			req, _ := http.NewRequest(GET, tenant.url(path), nil)
+			req.Header.Set(AUTHORIZATION, tenant.authorization())
+			res, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				status = ComponentStatus{Status: statusDegraded, Message: err.Error()}
+			} else {
+				res.Body.Close()
+				if res.StatusCode >= 500 {
+					status = ComponentStatus{Status: statusDegraded, Message: fmt.Sprintf("responded with %d", res.StatusCode)}
+				}
+			}
+			mutex.Lock()
+			statuses[name] = status
+			mutex.Unlock()
+		}(name, path)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// RESTGetObservablesGooglePlay retrieve all observables from the storage layer. Returns ok if the storage layer could be reached
+func RESTGetObservablesGooglePlay(tenant *Tenant) ([]ObservableGooglePlay, bool) {
 	var obserables []ObservableGooglePlay
 
-	url := baseURL + endpointGetObservablesGooglePlay
+	url := tenant.url(endpointGetObservablesGooglePlay)
 	req, _ := http.NewRequest(GET, url, bytes.NewBuffer(nil))
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	res, err := client.Do(req)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return obserables
+		return obserables, false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		fmt.Println("ERR storage layer responded with", res.StatusCode)
+		return obserables, false
 	}
 
 	err = json.NewDecoder(res.Body).Decode(&obserables)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return obserables
+		return obserables, false
 	}
 
-	return obserables
+	return obserables, true
 }
 
-// RESTGetAppPageGooglePlay retrieve all reviews from the collection layer
-func RESTGetAppPageGooglePlay(packageName string) AppPageGooglePlay {
+// RESTGetAppPageGooglePlay retrieve the app page from the collection layer. Returns ok if the MS could be reached
+func RESTGetAppPageGooglePlay(tenant *Tenant, packageName string) (AppPageGooglePlay, bool) {
 	var appPage AppPageGooglePlay
 
 	endpoint := fmt.Sprintf(endpointPostCrawlAppPageGooglePlay, packageName)
-	url := baseURL + endpoint
+	url := tenant.url(endpoint)
 	req, _ := http.NewRequest(GET, url, bytes.NewBuffer(nil))
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	res, err := client.Do(req)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return appPage
+		return appPage, false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		fmt.Println("ERR collection layer responded with", res.StatusCode)
+		return appPage, false
 	}
 
 	err = json.NewDecoder(res.Body).Decode(&appPage)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return appPage
+		return appPage, false
 	}
 
-	return appPage
+	return appPage, true
 }
 
-// RESTGetAppReviewsGooglePlay retrieve all reviews from the collection layer
-func RESTGetAppReviewsGooglePlay(packageName string, limit int) []AppReviewGooglePlay {
+// RESTGetAppReviewsGooglePlay retrieve all reviews from the collection layer. Returns ok if the MS could be reached
+func RESTGetAppReviewsGooglePlay(tenant *Tenant, packageName string, limit int) ([]AppReviewGooglePlay, bool) {
 	var reviews []AppReviewGooglePlay
 
 	endpoint := fmt.Sprintf(endpointPostCrawlAppReviewsGooglePlay, packageName, limit)
-	url := baseURL + endpoint
+	url := tenant.url(endpoint)
 	req, _ := http.NewRequest(GET, url, bytes.NewBuffer(nil))
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	res, err := client.Do(req)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return reviews
+		return reviews, false
 	}
+	defer res.Body.Close()
 
 	err = json.NewDecoder(res.Body).Decode(&reviews)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return reviews
+		return reviews, false
 	}
 
-	return reviews
+	return reviews, true
 }
 
-// RESTPostProcessAppReviewsGooglePlay sends the crawled reviews to the processing layer and retrieves app reviews including their ml classes
-func RESTPostProcessAppReviewsGooglePlay(reviews []AppReviewGooglePlay) []AppReviewGooglePlay {
+// RESTPostProcessAppReviewsGooglePlay sends the crawled reviews to the processing layer and retrieves app reviews including their ml classes. Returns ok if the MS could be reached
+func RESTPostProcessAppReviewsGooglePlay(tenant *Tenant, reviews []AppReviewGooglePlay) ([]AppReviewGooglePlay, bool) {
 	var appReviews []AppReviewGooglePlay
 
 	requestBody := new(bytes.Buffer)
 	json.NewEncoder(requestBody).Encode(reviews)
-	url := baseURL + endpointPostClassifyAppReviews
+	url := tenant.url(endpointPostClassifyAppReviews)
 	req, _ := http.NewRequest(POST, url, requestBody)
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	res, err := client.Do(req)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return appReviews
+		return appReviews, false
 	}
+	defer res.Body.Close()
 
 	err = json.NewDecoder(res.Body).Decode(&appReviews)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return appReviews
+		return appReviews, false
 	}
 
-	return appReviews
+	return appReviews, true
 }
 
 // RESTPostStoreProcessedAppReviewsGooglePlay sends the processed app reviews to the storage layer. Returns ok MS could be reached
-func RESTPostStoreProcessedAppReviewsGooglePlay(appReviews []AppReviewGooglePlay) bool {
+func RESTPostStoreProcessedAppReviewsGooglePlay(tenant *Tenant, appReviews []AppReviewGooglePlay) bool {
 	requestBody := new(bytes.Buffer)
-	json.NewEncoder(requestBody).Encode(reviews)
-	url := baseURL + endpointPostAppReviewGooglePlay
+	json.NewEncoder(requestBody).Encode(appReviews)
+	url := tenant.url(endpointPostAppReviewGooglePlay)
 
 	req, _ := http.NewRequest(POST, url, requestBody)
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	_, err := client.Do(req)
 	if err != nil {
@@ -205,12 +307,12 @@ func RESTPostStoreProcessedAppReviewsGooglePlay(appReviews []AppReviewGooglePlay
 }
 
 // RESTPostStoreAppPageGooglePlay sends the crawled app page to the storage layer. Returns ok MS could be reached
-func RESTPostStoreAppPageGooglePlay(appPage AppPageGooglePlay) bool {
+func RESTPostStoreAppPageGooglePlay(tenant *Tenant, appPage AppPageGooglePlay) bool {
 	requestBody := new(bytes.Buffer)
 	json.NewEncoder(requestBody).Encode(appPage)
-	url := baseURL + endpointPostAppPageGooglePlay
+	url := tenant.url(endpointPostAppPageGooglePlay)
 	req, _ := http.NewRequest(POST, url, requestBody)
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	_, err := client.Do(req)
 	if err != nil {
@@ -221,27 +323,50 @@ func RESTPostStoreAppPageGooglePlay(appPage AppPageGooglePlay) bool {
 	return true
 }
 
-// RESTPostNonExistingAppReviewsGooglePlay sends the crawled app reviews and gets a list of app reviews in return that do not yet exist in the db.
-func RESTPostNonExistingAppReviewsGooglePlay(appReviews []AppReviewGooglePlay) []AppReviewGooglePlay {
+// RESTPostRequirements sends OpenReq requirements to the requirements endpoint of the tenant. Returns ok if the endpoint accepted them.
+// The endpoint is not part of the OpenReq infrastructure, hence the bearer token of the tenant is not sent to it
+func RESTPostRequirements(tenant *Tenant, requirements []Requirement) bool {
+	requestBody := new(bytes.Buffer)
+	json.NewEncoder(requestBody).Encode(requirements)
+	req, _ := http.NewRequest(POST, tenant.RequirementsURL, requestBody)
+	req.Header.Set("Content-Type", TYPE_JSON)
+	req.Header.Add(ACCEPT, TYPE_JSON)
+	res, err := externalClient.Do(req)
+	if err != nil {
+		fmt.Println("ERR", err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		fmt.Println("ERR requirements endpoint responded with", res.StatusCode)
+		return false
+	}
+
+	return true
+}
+
+// RESTPostNonExistingAppReviewsGooglePlay sends the crawled app reviews and gets a list of app reviews in return that do not yet exist in the db. Returns ok if the MS could be reached
+func RESTPostNonExistingAppReviewsGooglePlay(tenant *Tenant, appReviews []AppReviewGooglePlay) ([]AppReviewGooglePlay, bool) {
 	var nonExistingAppReviews []AppReviewGooglePlay
 
 	requestBody := new(bytes.Buffer)
 	json.NewEncoder(requestBody).Encode(appReviews)
-	url := baseURL + endpointPosNonExistingtAppReviewsGooglePlay
+	url := tenant.url(endpointPosNonExistingtAppReviewsGooglePlay)
 	req, _ := http.NewRequest(POST, url, requestBody)
-	req.Header.Set(AUTHORIZATION, bearerToken)
+	req.Header.Set(AUTHORIZATION, tenant.authorization())
 	req.Header.Add(ACCEPT, TYPE_JSON)
 	res, err := client.Do(req)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return nonExistingAppReviews
+		return nonExistingAppReviews, false
 	}
+	defer res.Body.Close()
 
 	err = json.NewDecoder(res.Body).Decode(&nonExistingAppReviews)
 	if err != nil {
 		fmt.Println("ERR", err)
-		return nonExistingAppReviews
+		return nonExistingAppReviews, false
 	}
 
-	return nonExistingAppReviews
+	return nonExistingAppReviews, true
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * classified reviews kept locally for the digests and the export of feature requests as requirements. The storage
+ * layer cannot be queried for classified reviews.
+ * A review is kept once under tenant/package name/classified at/review id, so the reviews of an app over a period are
+ * read as a range of keys.
+ */
+
+const (
+	bucketReviews = "reviews"
+)
+
+// reviewPrefix returns the prefix of the keys of the kept reviews of an app. Tenant ids and package names contain no /
+func reviewPrefix(tenant string, packageName string) string {
+	return tenant + "/" + packageName + "/"
+}
+
+func reviewKey(tenant string, packageName string, classifiedAt time.Time, reviewID string) string {
+	return fmt.Sprintf("%s%016x/%s", reviewPrefix(tenant, packageName), classifiedAt.UnixNano(), reviewID)
+}
+
+func keyOfReview(kept KeptReview) string {
+	return reviewKey(kept.Tenant, kept.Review.PackageName, kept.ClassifiedAt, kept.Review.ReviewID)
+}
+
+// KeepReviews stores the classified reviews of a tenant. Reviews that are already kept are skipped
+func KeepReviews(tenant string, reviews []AppReviewGooglePlay) {
+	if db == nil || len(reviews) == 0 {
+		return
+	}
+	now := time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketReviews))
+		known := map[string]map[string]bool{}
+		for _, review := range reviews {
+			if known[review.PackageName] == nil {
+				known[review.PackageName] = reviewIDsOf(bucket, tenant, review.PackageName)
+			}
+			if known[review.PackageName][review.ReviewID] {
+				continue
+			}
+			known[review.PackageName][review.ReviewID] = true
+			kept := KeptReview{Tenant: tenant, Review: review, ClassifiedAt: now}
+			data, err := json.Marshal(kept)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(keyOfReview(kept)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not keep the reviews of tenant %q: %v\n", tenant, err)
+	}
+}
+
+// reviewIDsOf returns the ids of the kept reviews of an app
+func reviewIDsOf(bucket *bolt.Bucket, tenant string, packageName string) map[string]bool {
+	ids := map[string]bool{}
+	prefix := []byte(reviewPrefix(tenant, packageName))
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		// the review id follows the prefix and the 16 hex digits of the time
+		ids[string(k[len(prefix)+17:])] = true
+	}
+	return ids
+}
+
+// KeptReviews returns the kept reviews of an app classified from from to to, oldest first
+func KeptReviews(tenant string, packageName string, from time.Time, to time.Time) []KeptReview {
+	reviews := []KeptReview{}
+	if db == nil {
+		return reviews
+	}
+	prefix := []byte(reviewPrefix(tenant, packageName))
+	first := []byte(fmt.Sprintf("%s%016x", prefix, from.UnixNano()))
+	last := []byte(fmt.Sprintf("%s%016x/\xff", prefix, to.UnixNano()))
+	err := db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(bucketReviews)).Cursor()
+		for k, v := cursor.Seek(first); k != nil && bytes.Compare(k, last) <= 0; k, v = cursor.Next() {
+			var kept KeptReview
+			if err := json.Unmarshal(v, &kept); err != nil {
+				return err
+			}
+			reviews = append(reviews, kept)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the kept reviews of %s: %v\n", observableKey(tenant, packageName), err)
+	}
+	return reviews
+}
+
+// pruneReviews deletes the reviews classified before the given time. Feature requests of tenants with a requirements endpoint
+// are kept until they were pushed as requirements
+func pruneReviews(before time.Time) {
+	if db == nil {
+		return
+	}
+	pushesRequirements := func(id string) bool {
+		tenant, ok := TenantOf(id)
+		return ok && tenant.RequirementsURL != ""
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketReviews))
+		var stale [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var kept KeptReview
+			if err := json.Unmarshal(v, &kept); err != nil || !kept.ClassifiedAt.Before(before) ||
+				(kept.Review.FeatureRequest && kept.PushedAt == nil && pushesRequirements(kept.Tenant)) {
+				return nil
+			}
+			stale = append(stale, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not prune the kept reviews: %v\n", err)
+	}
+}
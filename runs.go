@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenReqEU/ri-orchestration-app/orchestration"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * run history of the observation pipeline
+ */
+
+const (
+	bucketRuns = "runs"
+
+	triggerScheduled = "scheduled"
+	triggerManual    = "manual"
+	triggerCatchUp   = "catch-up"
+	// triggerProcess is a one-time processing of an app, see postProcessAppGooglePlay
+	triggerProcess = "process"
+
+	runQueued    = orchestration.RunQueued
+	runRunning   = orchestration.RunRunning
+	runSucceeded = orchestration.RunSucceeded
+	runFailed    = orchestration.RunFailed
+)
+
+// runHistoryRetention is how long runs are kept in the history
+var runHistoryRetention = 30 * 24 * time.Hour
+
+var runCounter uint32
+
+// newRunID returns a unique id. Ids sort in the order the runs were created
+func newRunID(now time.Time) string {
+	return fmt.Sprintf("%016x%04x", now.UnixNano(), atomic.AddUint32(&runCounter, 1)&0xffff)
+}
+
+// SaveRun adds or updates a run in the history. The events of its state change are written in the same transaction
+func SaveRun(run Run) {
+	if db == nil {
+		return
+	}
+	events := runEvents(run)
+	err := db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketRuns)).Put([]byte(run.ID), data); err != nil {
+			return err
+		}
+		return putEvents(tx, events...)
+	})
+	if err != nil {
+		log.Printf("ERR could not save run %s: %v\n", run.ID, err)
+		return
+	}
+	if broker != nil && len(events) > 0 {
+		wakeRelay()
+	}
+}
+
+// RunOf returns a run of the history
+func RunOf(id string) (Run, bool) {
+	var run Run
+	if db == nil {
+		return run, false
+	}
+	ok, err := storeGet(bucketRuns, id, &run)
+	if err != nil {
+		log.Printf("ERR could not load run %s: %v\n", id, err)
+	}
+	return run, ok
+}
+
+// RunFilter selects runs of the history of a tenant. Other empty fields match every run
+type RunFilter struct {
+	Tenant      string
+	PackageName string
+	// PackageNames restricts the runs to a set of apps, e.g. the ones of a project
+	PackageNames map[string]bool
+	Trigger      string
+	Status       string
+	Limit        int
+	// Before is the ID of a run, only older runs are returned. It pages through the history
+	Before string
+}
+
+func (f RunFilter) matches(run Run) bool {
+	return f.Tenant == run.Tenant &&
+		(f.PackageName == "" || f.PackageName == run.PackageName) &&
+		(f.PackageNames == nil || f.PackageNames[run.PackageName]) &&
+		(f.Trigger == "" || f.Trigger == run.Trigger) &&
+		(f.Status == "" || f.Status == run.Status)
+}
+
+// Runs returns the runs matching the filter, newest first
+func Runs(filter RunFilter) []Run {
+	runs := []Run{}
+	if db == nil {
+		return runs
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(bucketRuns)).Cursor()
+		k, v := cursor.Last()
+		if filter.Before != "" {
+			// the IDs of the runs are ordered by the time they were queued
+			if k, v = cursor.Seek([]byte(filter.Before)); k == nil {
+				k, v = cursor.Last()
+			} else {
+				k, v = cursor.Prev()
+			}
+		}
+		for ; k != nil; k, v = cursor.Prev() {
+			var run Run
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+			if !filter.matches(run) {
+				continue
+			}
+			runs = append(runs, run)
+			if filter.Limit > 0 && len(runs) >= filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the run history: %v\n", err)
+	}
+	return runs
+}
+
+// pruneRuns deletes all runs that were queued before the given time
+func pruneRuns(before time.Time) {
+	if db == nil {
+		return
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketRuns))
+		// keys are collected first, deleting while iterating a cursor skips keys
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var run Run
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+			if !run.QueuedAt.Before(before) {
+				break
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not prune the run history: %v\n", err)
+	}
+}
+
+// deleteRuns removes runs from the history, e.g. runs that could not be queued
+func deleteRuns(runs []Run) {
+	if db == nil {
+		return
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketRuns))
+		for _, run := range runs {
+			if err := bucket.Delete([]byte(run.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not delete runs from the history: %v\n", err)
+	}
+}
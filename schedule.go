@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// maxJitter is the largest jitter window of an observable
+const maxJitter = 24 * time.Hour
+
+// locationSchedule evaluates a schedule in a time zone
+type locationSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func (s locationSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.In(s.location))
+}
+
+// jitterSchedule shifts every fire time of a schedule by a constant offset
+type jitterSchedule struct {
+	schedule cron.Schedule
+	offset   time.Duration
+}
+
+func (s jitterSchedule) Next(t time.Time) time.Time {
+	next := s.schedule.Next(t.Add(-s.offset))
+	if next.IsZero() {
+		return next
+	}
+	return next.Add(s.offset)
+}
+
+// ScheduleOf returns the effective schedule of an observable: its interval evaluated in its time zone and shifted by its jitter offset
+func ScheduleOf(observable ObservableGooglePlay) (cron.Schedule, error) {
+	if isAdaptive(observable) {
+		if _, _, err := adaptiveBounds(observable); err != nil {
+			return nil, err
+		}
+		return pollSchedule{}, nil
+	}
+
+	schedule, err := ParseObserverInterval(observable.Interval)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := locationOf(observable)
+	if err != nil {
+		return nil, err
+	}
+	schedule = locationSchedule{schedule: schedule, location: location}
+
+	offset, err := jitterOffsetOf(observable)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		schedule = jitterSchedule{schedule: schedule, offset: offset}
+	}
+	return schedule, nil
+}
+
+// ValidateScheduleSettings checks the time zone, the jitter and the adaptive bounds of an observable
+func ValidateScheduleSettings(observable ObservableGooglePlay) error {
+	if _, err := locationOf(observable); err != nil {
+		return err
+	}
+	if isAdaptive(observable) {
+		if _, _, err := adaptiveBounds(observable); err != nil {
+			return err
+		}
+	}
+	_, err := jitterOffsetOf(observable)
+	return err
+}
+
+func locationOf(observable ObservableGooglePlay) (*time.Location, error) {
+	if observable.TimeZone == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(observable.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: use an IANA time zone like Europe/Berlin", observable.TimeZone)
+	}
+	return location, nil
+}
+
+// jitterOffsetOf derives a deterministic offset within the jitter window from the package name,
+// so that observables with the same interval do not fire at the same time
+func jitterOffsetOf(observable ObservableGooglePlay) (time.Duration, error) {
+	if observable.Jitter == "" {
+		return 0, nil
+	}
+	jitter, err := time.ParseDuration(observable.Jitter)
+	if err != nil || jitter < 0 || jitter > maxJitter {
+		return 0, fmt.Errorf("invalid jitter %q: use a duration between 0s and %v like 30m", observable.Jitter, maxJitter)
+	}
+	if jitter < time.Second {
+		return 0, nil
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(observable.PackageName))
+	seconds := int64(jitter / time.Second)
+	return time.Duration(int64(hash.Sum32())%seconds) * time.Second, nil
+}
+
+// EffectiveScheduleOf describes when an observable runs
+func EffectiveScheduleOf(observable ObservableGooglePlay, now time.Time) EffectiveSchedule {
+	effective := EffectiveSchedule{CronExpression: getObserverInterval(observable.Interval), TimeZone: observable.TimeZone}
+	if effective.TimeZone == "" {
+		effective.TimeZone = time.Local.String()
+	}
+	if isAdaptive(observable) {
+		effective.CronExpression = ""
+		if _, _, err := adaptiveBounds(observable); err != nil {
+			effective.Error = err.Error()
+			return effective
+		}
+		effective.Delay = adaptiveDelay(observable).String()
+		next := AdaptiveDue(observable)
+		if next.Before(now) {
+			next = pollSchedule{}.Next(now)
+		}
+		effective.NextRun = &next
+		return effective
+	}
+
+	offset, err := jitterOffsetOf(observable)
+	if err != nil {
+		effective.Error = err.Error()
+		return effective
+	}
+	effective.JitterOffset = offset.String()
+
+	schedule, err := ScheduleOf(observable)
+	if err != nil {
+		effective.Error = err.Error()
+		return effective
+	}
+	if next := schedule.Next(now); !next.IsZero() {
+		effective.NextRun = &next
+	}
+	return effective
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleOf(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	schedule, err := ScheduleOf(ObservableGooglePlay{PackageName: "eu.openreq", Interval: "daily", TimeZone: "Europe/Berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2026, 1, 11, 0, 0, 0, 0, berlin)
+	if next := schedule.Next(now); !next.Equal(expected) {
+		t.Errorf("Expected the next run at midnight in Berlin (%v). Got %v instead", expected, next)
+	}
+
+	observable := ObservableGooglePlay{PackageName: "eu.openreq", Interval: "daily", TimeZone: "UTC", Jitter: "1h"}
+	offset, _ := jitterOffsetOf(observable)
+	if offset < 0 || offset >= time.Hour {
+		t.Fatalf("Expected the jitter offset to be within the window. Got %v instead", offset)
+	}
+	if other, _ := jitterOffsetOf(observable); other != offset {
+		t.Error("Expected the jitter offset to be deterministic")
+	}
+	schedule, _ = ScheduleOf(observable)
+	expected = time.Date(2026, 1, 11, 0, 0, 0, 0, time.UTC).Add(offset)
+	if next := schedule.Next(now); !next.Equal(expected) {
+		t.Errorf("Expected the next run at %v. Got %v instead", expected, next)
+	}
+	if next := schedule.Next(expected.Add(-time.Second)); !next.Equal(expected) {
+		t.Errorf("Expected the run shortly before the jittered time to still be pending. Got %v instead", next)
+	}
+
+	if err := ValidateScheduleSettings(ObservableGooglePlay{TimeZone: "Mars/Olympus"}); err == nil {
+		t.Error("Expected an unknown time zone to be invalid")
+	}
+	if err := ValidateScheduleSettings(ObservableGooglePlay{Jitter: "48h"}); err == nil {
+		t.Error("Expected a too large jitter to be invalid")
+	}
+}
@@ -6,16 +6,24 @@ package main
 var exists = struct{}{}
 
 type set struct {
-	m map[string]string
+	m map[string]ObservableGooglePlay
 }
 
 // NewSet is a custom implementation for imitating a set in golang
 func NewSet() *set {
 	s := &set{}
-	s.m = make(map[string]string)
+	s.m = make(map[string]ObservableGooglePlay)
 	return s
 }
 
-func (s *set) Add(value string, interval string) {
-	s.m[value] = interval
+func (s *set) Add(observable ObservableGooglePlay) {
+	s.m[keyOf(observable)] = observable
+}
+
+func (s *set) list() []ObservableGooglePlay {
+	var observables []ObservableGooglePlay
+	for _, observable := range s.m {
+		observables = append(observables, observable)
+	}
+	return observables
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * Local snapshot of the observables. It is used as a fallback while the storage layer is unreachable.
+ *
+ * Conflict rules when the storage layer and the snapshot disagree:
+ *  1. an observable known to both: the interval and the paused state of the storage layer win, unless the observable
+ *     was written to the snapshot after the storage layer was asked. Settings the storage layer does not know
+ *     (e.g. time zone and jitter) are taken from the snapshot
+ *  2. an observable only known to the storage layer: it is added to the snapshot
+ *  3. an observable only known to the snapshot: it was deleted in the storage layer, which wins on deletes, hence it
+ *     is removed from the snapshot. Observables written to the snapshot after the storage layer was asked are kept,
+ *     every observable is stored in the storage layer before it is written to the snapshot
+ *
+ * Every tenant is reconciled with its own storage layer.
+ */
+
+// rememberedAt is when an observable was last written to the local snapshot by this orchestrator, see conflict rule 3
+var rememberedAt = map[string]time.Time{}
+var rememberedMutex sync.Mutex
+
+// LoadSnapshot returns all observables of the local snapshot of all tenants
+func LoadSnapshot() []ObservableGooglePlay {
+	var observables []ObservableGooglePlay
+	if db == nil {
+		return observables
+	}
+
+	err := storeForEach(bucketObservables, func(key string, data []byte) error {
+		var observable ObservableGooglePlay
+		if err := json.Unmarshal(data, &observable); err != nil {
+			return err
+		}
+		observables = append(observables, observable)
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the local snapshot: %v\n", err)
+	}
+	return observables
+}
+
+// SaveSnapshot replaces the local snapshot of a tenant with the given observables. Added and removed observables are published as events
+func SaveSnapshot(tenant string, observables []ObservableGooglePlay) {
+	if db == nil {
+		return
+	}
+
+	changed := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketObservables))
+		stale := map[string]ObservableGooglePlay{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			var observable ObservableGooglePlay
+			if err := json.Unmarshal(v, &observable); err != nil {
+				return err
+			}
+			if observable.Tenant == tenant {
+				stale[string(k)] = observable
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var events []Event
+		for _, observable := range observables {
+			if _, ok := stale[keyOf(observable)]; ok {
+				delete(stale, keyOf(observable))
+			} else {
+				events = append(events, newEvent(eventObservableAdded, tenant, observable.PackageName, "", observable))
+			}
+			data, err := json.Marshal(observable)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(keyOf(observable)), data); err != nil {
+				return err
+			}
+		}
+		for k, observable := range stale {
+			if err := bucket.Delete([]byte(k)); err != nil {
+				return err
+			}
+			events = append(events, newEvent(eventObservableRemoved, tenant, observable.PackageName, "", nil))
+		}
+		changed = len(events) > 0
+		return putEvents(tx, events...)
+	})
+	if err != nil {
+		log.Printf("ERR could not save the local snapshot: %v\n", err)
+		return
+	}
+	if changed && broker != nil {
+		wakeRelay()
+	}
+}
+
+// RememberObservable adds or updates a single observable in the local snapshot. An added observable is published as event
+func RememberObservable(observable ObservableGooglePlay) {
+	if db == nil {
+		return
+	}
+	rememberedMutex.Lock()
+	rememberedAt[keyOf(observable)] = time.Now()
+	rememberedMutex.Unlock()
+
+	added := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketObservables))
+		data, err := json.Marshal(observable)
+		if err != nil {
+			return err
+		}
+		added = bucket.Get([]byte(keyOf(observable))) == nil
+		if err := bucket.Put([]byte(keyOf(observable)), data); err != nil {
+			return err
+		}
+		if !added {
+			return nil
+		}
+		return putEvents(tx, newEvent(eventObservableAdded, observable.Tenant, observable.PackageName, "", observable))
+	})
+	if err != nil {
+		log.Printf("ERR could not update the local snapshot: %v\n", err)
+		return
+	}
+	if added && broker != nil {
+		wakeRelay()
+	}
+}
+
+// ForgetObservable removes a single observable from the local snapshot. The removal is published as event
+func ForgetObservable(observable ObservableGooglePlay) {
+	if db == nil {
+		return
+	}
+	rememberedMutex.Lock()
+	delete(rememberedAt, keyOf(observable))
+	rememberedMutex.Unlock()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(bucketObservables)).Delete([]byte(keyOf(observable))); err != nil {
+			return err
+		}
+		return putEvents(tx, newEvent(eventObservableRemoved, observable.Tenant, observable.PackageName, "", nil))
+	})
+	if err != nil {
+		log.Printf("ERR could not update the local snapshot: %v\n", err)
+		return
+	}
+	if broker != nil {
+		wakeRelay()
+	}
+}
+
+// reconcileObservables merges the observables of the storage layer of a tenant, fetched at fetchedAt, with its local snapshot (see the conflict rules above)
+func reconcileObservables(tenant string, remote []ObservableGooglePlay, local []ObservableGooglePlay, fetchedAt time.Time) []ObservableGooglePlay {
+	var observables []ObservableGooglePlay
+	known := map[string]bool{}
+	snapshot := map[string]ObservableGooglePlay{}
+	for _, observable := range local {
+		snapshot[observable.PackageName] = observable
+	}
+	rememberedMutex.Lock()
+	defer rememberedMutex.Unlock()
+	now := time.Now()
+	for _, observable := range remote {
+		observable.Tenant = tenant
+		known[observable.PackageName] = true
+		if merged, ok := snapshot[observable.PackageName]; ok {
+			if !rememberedAt[keyOf(merged)].After(fetchedAt) {
+				merged.Interval = observable.Interval
+				merged.Paused = observable.Paused
+				merged.ResumeAt = observable.ResumeAt
+			}
+			observable = merged
+		} else {
+			observable.ObservedSince = &now
+		}
+		observables = append(observables, observable)
+	}
+
+	for _, observable := range local {
+		if known[observable.PackageName] {
+			continue
+		}
+		if rememberedAt[keyOf(observable)].After(fetchedAt) {
+			observables = append(observables, observable)
+			continue
+		}
+		log.Printf("observable %s was deleted in the storage layer, removing it from the snapshot\n", keyOf(observable))
+	}
+
+	return observables
+}
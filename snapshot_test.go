@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotFallback(t *testing.T) {
+	SaveSnapshot(defaultTenant, []ObservableGooglePlay{{PackageName: "org.snapshot", Interval: "weekly"}})
+	observerMutex.Lock()
+	observableAppsGooglePlay = NewSet()
+	observerMutex.Unlock()
+
+	induceServerError = true
+	if ok := RestartObservation(); ok {
+		t.Error("Expected the storage layer to be unreachable")
+	}
+	if interval := observableAppsGooglePlay.m["org.snapshot"].Interval; interval != "weekly" {
+		t.Errorf("Expected the observable of the snapshot to be scheduled. Got interval %q instead", interval)
+	}
+	if status := SchedulerStatus(); status.Status != statusDegraded {
+		t.Errorf("Expected the scheduler to be degraded. Got %s instead", status.Status)
+	}
+
+	induceServerError = false
+	if ok := RestartObservation(); !ok {
+		t.Error("Expected the storage layer to be reachable")
+	}
+	if _, ok := observableAppsGooglePlay.m["eu.openreq"]; !ok {
+		t.Error("Expected the observables of the storage layer to be scheduled")
+	}
+	if _, ok := observableAppsGooglePlay.m["org.snapshot"]; ok {
+		t.Error("Expected the observable deleted in the storage layer to be removed")
+	}
+}
+
+func TestReconcileObservables(t *testing.T) {
+	fetchedAt := time.Now()
+	remote := []ObservableGooglePlay{{PackageName: "eu.openreq", Interval: "daily"}}
+	local := []ObservableGooglePlay{{PackageName: "eu.openreq", Interval: "monthly", TimeZone: "Europe/Berlin"}, {PackageName: "org.deleted", Interval: "hourly"}, {PackageName: "org.added", Interval: "weekly"}}
+	RememberObservable(local[2])
+
+	observables := reconcileObservables(defaultTenant, remote, local, fetchedAt)
+	if len(observables) != 2 {
+		t.Fatalf("Expected 2 observables. Got %+v instead", observables)
+	}
+	if observables[0].Interval != "daily" {
+		t.Errorf("Expected the interval of the storage layer to win. Got %s instead", observables[0].Interval)
+	}
+	if observables[0].TimeZone != "Europe/Berlin" {
+		t.Errorf("Expected the time zone of the snapshot to be kept. Got %q instead", observables[0].TimeZone)
+	}
+	if observables[1].PackageName != "org.added" {
+		t.Errorf("Expected the observable deleted in the storage layer to be removed and the one added meanwhile to be kept. Got %s instead", observables[1].PackageName)
+	}
+	ForgetObservable(local[2])
+
+	RememberObservable(ObservableGooglePlay{PackageName: "eu.openreq", Interval: "monthly"})
+	if observables := reconcileObservables(defaultTenant, remote, local[:1], fetchedAt); observables[0].Interval != "monthly" {
+		t.Errorf("Expected the interval written after the storage layer was asked to win. Got %s instead", observables[0].Interval)
+	}
+	rememberedMutex.Lock()
+	delete(rememberedAt, "eu.openreq")
+	rememberedMutex.Unlock()
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"os"
 
@@ -13,13 +16,95 @@ import (
 
 func main() {
 	log.SetOutput(os.Stdout)
+	if err := LoadAuthenticator(); err != nil {
+		log.Fatal(err)
+	}
+	if err := LoadTenants(); err != nil {
+		log.Fatal(err)
+	}
+	if err := LoadIssueSinks(); err != nil {
+		log.Fatal(err)
+	}
+	if err := LoadRateLimiter(); err != nil {
+		log.Fatal(err)
+	}
+	if err := OpenStore(storePath); err != nil {
+		log.Fatal(err)
+	}
+	if err := StartEvents(); err != nil {
+		log.Fatal(err)
+	}
+	StartJobQueue()
+	StartWebhooks()
+	StartDigests()
+	if err := StartLeaderElection(); err != nil {
+		log.Fatal(err)
+	}
+	EnsureObservation()
 	log.Fatal(http.ListenAndServe(":9702", makeRouter()))
 }
 
+const maxPreviewCount = 100
+
 func makeRouter() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}/interval/{interval}", postObserveAppGooglePlay).Methods("POST")
-	router.HandleFunc("/hitec/orchestration/app/process/google-play/package-name/{package_name}", postProcessAppGooglePlay).Methods("POST")
+	router.Use(authMiddleware)
+	router.Use(rateLimitMiddleware)
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}/interval/{interval}", requireRole(roleAdmin, postObserveAppGooglePlay)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/process/google-play/package-name/{package_name}", requireRole(roleOperator, withProcessQuota(postProcessAppGooglePlay))).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play", requireRole(roleViewer, getObservablesGooglePlay)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}", requireRole(roleViewer, getObservableGooglePlay)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}", requireRole(roleAdmin, deleteObservableGooglePlay)).Methods("DELETE")
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}/pause", requireRole(roleOperator, postPauseObservableGooglePlay)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}/resume", requireRole(roleOperator, postResumeObservableGooglePlay)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}/run", requireRole(roleOperator, postRunObservableGooglePlay)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/observe/google-play/package-name/{package_name}/labels", requireRole(roleAdmin, putLabelsObservableGooglePlay)).Methods("PUT")
+	router.HandleFunc("/hitec/orchestration/app/projects", requireRole(roleViewer, getProjects)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/projects/{project}/pause", requireRole(roleOperator, postPauseProject)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/projects/{project}/resume", requireRole(roleOperator, postResumeProject)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/projects/{project}/run", requireRole(roleOperator, postRunProject)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/projects/{project}/interval/{interval}", requireRole(roleAdmin, postIntervalProject)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/discovery/proposals", requireRole(roleViewer, getProposals)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/discovery/proposals/{package_name}/approve", requireRole(roleAdmin, postApproveProposal)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/discovery/proposals/{package_name}/reject", requireRole(roleAdmin, postRejectProposal)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/webhooks", requireRole(roleAdmin, postWebhook)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/webhooks", requireRole(roleViewer, getWebhooks)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/webhooks/{webhook_id}", requireRole(roleViewer, getWebhook)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/webhooks/{webhook_id}", requireRole(roleAdmin, deleteWebhook)).Methods("DELETE")
+	router.HandleFunc("/hitec/orchestration/app/webhooks/{webhook_id}/deliveries", requireRole(roleViewer, getDeliveries)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/issues", requireRole(roleViewer, getIssues)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/issues/sinks", requireRole(roleViewer, getIssueSinks)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/issues/reviews/{review_id}", requireRole(roleViewer, getIssueOfReview)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/requirements", requireRole(roleViewer, getRequirements)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/requirements/push", requireRole(roleOperator, postPushRequirements)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/events", requireRole(roleViewer, getEvents)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/events/outbox", requireRole(roleAdmin, getOutbox)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/alerts", requireRole(roleViewer, getAlerts)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/digests", requireRole(roleAdmin, postDigest)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/digests", requireRole(roleViewer, getDigests)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/digests/preview", requireRole(roleViewer, getDigestPreview)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/digests/{digest_id}", requireRole(roleAdmin, deleteDigest)).Methods("DELETE")
+	router.HandleFunc("/hitec/orchestration/app/digests/{digest_id}/reports", requireRole(roleViewer, getDigestReports)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/digests/{digest_id}/reports/{report_id}", requireRole(roleViewer, getDigestReport)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/alerts/rules", requireRole(roleAdmin, postAlertRule)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/alerts/rules", requireRole(roleViewer, getAlertRules)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/alerts/rules/{rule_id}", requireRole(roleViewer, getAlertRule)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/alerts/rules/{rule_id}", requireRole(roleAdmin, deleteAlertRule)).Methods("DELETE")
+	router.HandleFunc("/hitec/orchestration/app/alerts/rules/{rule_id}/silence", requireRole(roleOperator, postSilenceAlertRule)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/alerts/rules/{rule_id}/silence", requireRole(roleOperator, deleteSilenceAlertRule)).Methods("DELETE")
+	router.HandleFunc("/hitec/orchestration/app/observables/import", requireRole(roleAdmin, postImportObservables)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/observables/export", requireRole(roleViewer, getExportObservables)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/runs", requireRole(roleViewer, getRuns)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/runs/progress", requireRole(roleViewer, getProgress)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/runs/{run_id}", requireRole(roleViewer, getRun)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/runs/{run_id}/progress", requireRole(roleViewer, getRunProgress)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/dead-letters", requireRole(roleViewer, getDeadLetters)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/dead-letters/{package_name}/retry", requireRole(roleOperator, postRetryDeadLetter)).Methods("POST")
+	router.HandleFunc("/hitec/orchestration/app/dead-letters/{package_name}", requireRole(roleOperator, deleteDeadLetter)).Methods("DELETE")
+	router.HandleFunc("/hitec/orchestration/app/observe/interval/preview", requireRole(roleViewer, getIntervalPreview)).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/health/ready", getReadiness).Methods("GET")
+	router.HandleFunc("/hitec/orchestration/app/health/downstream", requireRole(roleViewer, getDownstreamHealth)).Methods("GET")
+	routeUI(router)
 	return router
 }
 
@@ -36,24 +121,93 @@ func postObserveAppGooglePlay(w http.ResponseWriter, r *http.Request) {
 	packageName := params["package_name"]
 	interval := params["interval"] // possible intervals: minutely, hourly, daily, monthly
 
-	// 1. store app to observe
-	ok := RESTPostStoreObserveAppGooglePlay(packageName, interval)
 	w.Header().Set("Content-Type", "application/json")
+	if err := ValidatePackageName(packageName); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	if _, err := ParseObserverInterval(interval); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	tenant, _ := TenantOf(tenantOf(r))
+	observable, _ := ObservableOf(tenant.ID, packageName)
+	observable.Tenant = tenant.ID
+	observable.PackageName = packageName
+	observable.Interval = interval
+	if observable.ObservedSince == nil {
+		now := time.Now()
+		observable.ObservedSince = &now
+	}
+	applyScheduleSettings(&observable, r.URL.Query())
+	if err := ValidateScheduleSettings(observable); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	if err := ValidateCatchUpPolicy(observable); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	if err := applyDiscoverySettings(&observable, r.URL.Query()); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	if err := ValidateDiscoverySettings(observable); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	if query := r.URL.Query(); len(query["project"]) > 0 || len(query["tag"]) > 0 {
+		observable.Projects = normalizeLabels(append(observable.Projects, query["project"]...))
+		observable.Tags = normalizeLabels(append(observable.Tags, query["tag"]...))
+		if err := ValidateLabels(observable); err != nil {
+			respondBadRequest(w, err)
+			return
+		}
+	}
+
+	// 1. store app to observe
+	ok := RESTPostStoreObserveAppGooglePlay(tenant, packageName, interval)
 	if !ok {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(Response{Status: false, Message: "storage layer unreachable"})
 		return
 	}
 
+	RememberObservable(observable)
+
 	// 2. notify the observer (crawler)
-	RestartObservation()
+	EnsureObservation()
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(Response{Status: true, Message: "observation successfully initiated"})
 }
 
+// postProcessAppGooglePlay starts a run (trigger process) that crawls, processes and stores an app once, whether it is observed or not.
+// Responds 202 with the run id right away, the client follows the progress of the run (GET /runs/{run_id}/progress)
+func postProcessAppGooglePlay(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	packageName := params["package_name"]
+	w.Header().Set("Content-Type", "application/json")
+	if err := ValidatePackageName(packageName); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	tenant, _ := TenantOf(tenantOf(r))
+
+	now := time.Now()
+	run := Run{ID: newRunID(now), Tenant: tenant.ID, PackageName: packageName, Trigger: triggerProcess, Status: runRunning, QueuedAt: now, StartedAt: &now}
+	SaveRun(run)
+	reportRun(run)
+	go processAppGooglePlay(tenant, run)
+
+	w.Header().Set("Location", "/hitec/orchestration/app/runs/"+run.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(Response{Status: true, Message: "processing started", RunID: run.ID})
+}
+
 /*
-* This method calls for each step the reponsible MS
+* This method calls for each step the reponsible MS. A failed step is reported, the remaining steps continue without its data.
+* The run fails if a step failed
 *
 * Steps:
 *  1. crawl app page
@@ -62,37 +216,331 @@ func postObserveAppGooglePlay(w http.ResponseWriter, r *http.Request) {
 *  3. process reviews
 *  4. store processed app reviews
  */
-func postProcessAppGooglePlay(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("postProcessAppGooglePlay called")
-	params := mux.Vars(r)
-	packageName := params["package_name"]
+func processAppGooglePlay(tenant *Tenant, run Run) {
+	packageName := run.PackageName
+	progress := progressOf(run)
 
 	//  1. crawl app page
-	fmt.Println("1. crawl app page")
-	appPage := RESTGetAppPageGooglePlay(packageName)
+	progress.start(stepCrawlPage)
+	appPage, ok := RESTGetAppPageGooglePlay(tenant, packageName)
 
 	//  2. store app page
-	fmt.Println("2. store app page")
-	ok := RESTPostStoreAppPageGooglePlay(appPage)
-	fmt.Println("Could store app page", ok)
+	if ok {
+		ok = RESTPostStoreAppPageGooglePlay(tenant, appPage)
+		DiscoverCompetitors(tenant, appPage)
+	}
+	run.PageCrawled = ok
+	if ok {
+		progress.finish(stepCrawlPage, 0)
+	} else {
+		progress.fail(stepCrawlPage, "could not crawl and store the app page")
+	}
 
 	//  3. crawl app reviews
-	fmt.Println("3. crawl app reviews")
-	crawledAppReviews := RESTGetAppReviewsGooglePlay(packageName, 0)
-	nonExistingAppReviews := RESTPostNonExistingAppReviewsGooglePlay(crawledAppReviews) // just consider app reviews that are not processed yet
+	failStep := func(step string, err string) {
+		progress.fail(step, err)
+		if run.Error == "" {
+			run.Error = err
+		}
+	}
+	progress.start(stepCrawlReviews)
+	crawledAppReviews, ok := RESTGetAppReviewsGooglePlay(tenant, packageName, 0)
+	if ok {
+		run.CrawledReviews = len(crawledAppReviews)
+		progress.finish(stepCrawlReviews, run.CrawledReviews)
+	} else {
+		failStep(stepCrawlReviews, "collection layer unreachable, could not crawl app reviews")
+	}
+	progress.start(stepFilterReviews)
+	nonExistingAppReviews, ok := RESTPostNonExistingAppReviewsGooglePlay(tenant, crawledAppReviews) // just consider app reviews that are not processed yet
+	if ok {
+		run.NewReviews = len(nonExistingAppReviews)
+		progress.finish(stepFilterReviews, run.NewReviews)
+	} else {
+		failStep(stepFilterReviews, "storage layer unreachable, could not filter existing app reviews")
+	}
 
 	//  4. process reviews
-	fmt.Println("4. process reviews")
-	processedAppReviess := RESTPostProcessAppReviewsGooglePlay(nonExistingAppReviews)
+	progress.start(stepClassifyReviews)
+	processedAppReviess, ok := RESTPostProcessAppReviewsGooglePlay(tenant, nonExistingAppReviews)
+	if ok {
+		run.ClassifiedReviews = len(processedAppReviess)
+		progress.finish(stepClassifyReviews, run.ClassifiedReviews)
+	} else {
+		failStep(stepClassifyReviews, "analytics layer unreachable, could not classify app reviews")
+	}
 
 	//  5. store processed app reviews
-	fmt.Println("5. store processed app reviews")
-	if ok := RESTPostStoreProcessedAppReviewsGooglePlay(processedAppReviess); !ok {
+	progress.start(stepStoreReviews)
+	if ok := RESTPostStoreProcessedAppReviewsGooglePlay(tenant, processedAppReviess); ok {
+		progress.finish(stepStoreReviews, len(processedAppReviess))
+		progress.start(stepPostProcess)
+		NotifyWebhooks(tenant.ID, packageName, processedAppReviess)
+		SyncIssues(tenant.ID, packageName, appPage.CurrentSoftwareVersion, processedAppReviess)
+		KeepReviews(tenant.ID, processedAppReviess)
+		run.PushedRequirements = exportRequirements(tenant)
+		progress.finish(stepPostProcess, 0)
+	} else {
+		failStep(stepStoreReviews, "storage service is not available")
+	}
+
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	run.Status = runSucceeded
+	if run.Error != "" {
+		run.Status = runFailed
+		log.Printf("ERR %s run %s of %s failed: %s\n", run.Trigger, run.ID, observableKey(run.Tenant, run.PackageName), run.Error)
+	}
+	SaveRun(run)
+	reportRun(run)
+}
+
+// getReadiness reports whether the scheduler could load the observables
+func getReadiness(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: statusOK, Components: map[string]ComponentStatus{}}
+	health.Components["scheduler"] = SchedulerStatus()
+	health.Components["leader"] = LeaderStatus()
+	for _, component := range health.Components {
+		if component.Status != statusOK {
+			health.Status = statusDegraded
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// getDownstreamHealth reports whether the downstream services of the tenant are reachable
+func getDownstreamHealth(w http.ResponseWriter, r *http.Request) {
+	tenant, _ := TenantOf(tenantOf(r))
+	health := Health{Status: statusOK, Components: RESTProbeDownstream(tenant)}
+	for _, component := range health.Components {
+		if component.Status != statusOK {
+			health.Status = statusDegraded
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(health)
+}
+
+// applyScheduleSettings sets the time zone, the jitter, the catch-up policy and the adaptive bounds of an observable if they are given as query parameters. Empty values reset them
+func applyScheduleSettings(observable *ObservableGooglePlay, query url.Values) {
+	if _, ok := query["time_zone"]; ok {
+		observable.TimeZone = query.Get("time_zone")
+	}
+	if _, ok := query["jitter"]; ok {
+		observable.Jitter = query.Get("jitter")
+	}
+	if _, ok := query["catch_up"]; ok {
+		observable.CatchUp = query.Get("catch_up")
+	}
+	if _, ok := query["min_interval"]; ok {
+		observable.MinInterval = query.Get("min_interval")
+	}
+	if _, ok := query["max_interval"]; ok {
+		observable.MaxInterval = query.Get("max_interval")
+	}
+	if !isAdaptive(*observable) {
+		observable.Adaptive = nil
+	}
+}
+
+// getObservablesGooglePlay returns all observables with their effective schedule. Query parameters: project, tag
+func getObservablesGooglePlay(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ObservableStatuses(observableFilterOf(r)))
+}
+
+// getObservableGooglePlay returns a single observable with its effective schedule
+func getObservableGooglePlay(w http.ResponseWriter, r *http.Request) {
+	packageName := mux.Vars(r)["package_name"]
+	w.Header().Set("Content-Type", "application/json")
+
+	observable, ok := ObservableOf(tenantOf(r), packageName)
+	respondObservable(w, observable, ok)
+}
+
+// deleteObservableGooglePlay stops observing an app and removes it from the storage layer. Its run history is kept
+func deleteObservableGooglePlay(w http.ResponseWriter, r *http.Request) {
+	packageName := mux.Vars(r)["package_name"]
+	w.Header().Set("Content-Type", "application/json")
+	tenant, _ := TenantOf(tenantOf(r))
+	if _, ok := ObservableOf(tenant.ID, packageName); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "app is not observed"})
+		return
+	}
+	if ok := RESTDeleteObservableGooglePlay(tenant, packageName); !ok {
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "storage layer could not remove the observable"})
+		return
+	}
+	RemoveObservable(tenant.ID, packageName)
+	ResolveDeadLetter(tenant.ID, packageName)
+	// reschedules the remaining observables, the cron job of the removed one stops
+	EnsureObservation()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{Status: true, Message: "observation removed"})
+}
+
+// postPauseObservableGooglePlay pauses an observed app. The optional query parameter resume_at (RFC 3339) resumes it automatically
+func postPauseObservableGooglePlay(w http.ResponseWriter, r *http.Request) {
+	packageName := mux.Vars(r)["package_name"]
+	w.Header().Set("Content-Type", "application/json")
+
+	resumeAt, err := resumeAtOf(r)
+	if err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+
+	observable, err := PauseObservable(tenantOf(r), packageName, resumeAt)
+	respondPausedObservable(w, observable, err)
+}
+
+// postResumeObservableGooglePlay resumes a paused app
+func postResumeObservableGooglePlay(w http.ResponseWriter, r *http.Request) {
+	packageName := mux.Vars(r)["package_name"]
+	w.Header().Set("Content-Type", "application/json")
+
+	observable, err := ResumeObservable(tenantOf(r), packageName)
+	respondPausedObservable(w, observable, err)
+}
+
+// postRunObservableGooglePlay queues a manual run of the observation pipeline of an observed app. The schedule is not affected
+func postRunObservableGooglePlay(w http.ResponseWriter, r *http.Request) {
+	packageName := mux.Vars(r)["package_name"]
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := ObservableOf(tenantOf(r), packageName); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "app is not observed"})
+		return
+	}
+
+	run, err := jobQueue.Enqueue(tenantOf(r), packageName, triggerManual)
+	respondEnqueued(w, run, err)
+}
+
+// respondEnqueued responds with a queued run, or why it could not be queued
+func respondEnqueued(w http.ResponseWriter, run Run, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(run)
+	case errRunPending:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+	}
+}
+
+// getRuns returns the run history, newest first. Query parameters: package_name, project, tag, trigger, status, limit (default 100), before (run ID)
+func getRuns(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	filter := RunFilter{Tenant: tenantOf(r), PackageName: query.Get("package_name"), Trigger: query.Get("trigger"), Status: query.Get("status"), Limit: 100, Before: query.Get("before")}
+	filter.PackageNames = packageNamesOf(observableFilterOf(r))
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			respondBadRequest(w, fmt.Errorf("limit must be a positive number"))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Runs(filter))
+}
+
+// getRun returns a single run of the history
+func getRun(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	run, ok := RunOf(mux.Vars(r)["run_id"])
+	if !ok || run.Tenant != tenantOf(r) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "unknown run"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(run)
+}
+
+func respondObservable(w http.ResponseWriter, observable ObservableGooglePlay, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: "app is not observed"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(StatusOf(observable, time.Now()))
+}
+
+// respondPausedObservable responds the observable after it was paused or resumed
+func respondPausedObservable(w http.ResponseWriter, observable ObservableGooglePlay, err error) {
+	switch err {
+	case nil:
+		respondObservable(w, observable, true)
+	case errNotObserved:
+		respondObservable(w, observable, false)
+	default:
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(Response{Status: false, Message: "storage service is not available"})
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+	}
+}
+
+// getIntervalPreview returns the next fire times of a proposed interval (query parameters interval, count and optionally time_zone, jitter and package_name)
+func getIntervalPreview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	interval := r.URL.Query().Get("interval")
+	count := 5
+	if value := r.URL.Query().Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 1 || count > maxPreviewCount {
+			respondBadRequest(w, fmt.Errorf("count must be a number between 1 and %d", maxPreviewCount))
+			return
+		}
+	}
+
+	if interval == intervalAdaptive {
+		respondBadRequest(w, fmt.Errorf("adaptive intervals have no fixed fire times, they follow the review velocity of the app"))
+		return
+	}
+	observable := ObservableGooglePlay{PackageName: r.URL.Query().Get("package_name"), Interval: interval}
+	applyScheduleSettings(&observable, r.URL.Query())
+	schedule, err := ScheduleOf(observable)
+	if err != nil {
+		respondBadRequest(w, err)
 		return
 	}
 
+	preview := IntervalPreview{Interval: interval, CronExpression: getObserverInterval(interval)}
+	next := time.Now()
+	for i := 0; i < count; i++ {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		preview.Next = append(preview.Next, next)
+	}
+
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(Response{Status: true, Message: "crawled, processed, and stored app reviews"})
+	json.NewEncoder(w).Encode(preview)
+}
+
+func respondBadRequest(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
 }
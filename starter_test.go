@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -16,6 +21,7 @@ import (
 var router *mux.Router
 var induceServerError = false
 var stopTestServer func()
+var storeDir string
 
 func TestMain(m *testing.M) {
 	fmt.Println("--- Start Tests")
@@ -34,6 +40,20 @@ func setup() {
 	fmt.Println("--- --- setup")
 	router = makeRouter()
 	setupMockClient()
+	setupStore()
+	broker = &MemoryBroker{size: 10000}
+	jobQueue = NewJobQueue(2, 100)
+}
+
+func setupStore() {
+	dir, err := ioutil.TempDir("", "orchestrator")
+	if err != nil {
+		panic(err)
+	}
+	storeDir = dir
+	if err := OpenStore(filepath.Join(dir, "orchestrator.db")); err != nil {
+		panic(err)
+	}
 }
 
 func setupMockClient() {
@@ -61,6 +81,10 @@ func makeMockHandler() http.Handler {
 	mockCollectionExplicitFeedbackGooglePlayPage(r)
 	mockStorageApp(r)
 	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if induceServerError {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		fmt.Println(errors.Errorf("Service method not mocked: %s", r.URL))
 		w.WriteHeader(http.StatusNotFound)
 	})
@@ -70,46 +94,92 @@ func makeMockHandler() http.Handler {
 func mockAnalyticsClassificationGooglePlayReview(r *mux.Router) {
 	// endpointPostClassifyAppReviews = "/ri-analytics-classification-google-play-review/hitec/classify/domain/google-play-reviews/"
 	r.HandleFunc("/ri-analytics-classification-google-play-review/hitec/classify/domain/google-play-reviews/", func(w http.ResponseWriter, request *http.Request) {
-		respond(w, http.StatusOK, `[]`)
+		echoReviews(w, request)
 	})
 }
 
 func mockCollectionExplicitFeedbackGooglePlayReview(r *mux.Router) {
 	// endpointPostCrawlAppReviewsGooglePlay = "/ri-collection-explicit-feedback-google-play-review/hitec/crawl/app-reviews/google-play/%s/limit/%d"
 	r.HandleFunc("/ri-collection-explicit-feedback-google-play-review/hitec/crawl/app-reviews/google-play/{package_name}/limit/{limit}", func(w http.ResponseWriter, request *http.Request) {
-		respond(w, http.StatusOK, `[]`)
+		reviews := reviewsOf[mux.Vars(request)["package_name"]]
+		if reviews == nil {
+			reviews = []AppReviewGooglePlay{}
+		}
+		respond(w, http.StatusOK, reviews)
 	})
 }
 
 func mockCollectionExplicitFeedbackGooglePlayPage(r *mux.Router) {
 	// endpointPostCrawlAppPageGooglePlay = "/ri-collection-explicit-feedback-google-play-page/hitec/crawl/app-page/google-play/%s"
 	r.HandleFunc("/ri-collection-explicit-feedback-google-play-page/hitec/crawl/app-page/google-play/{package_name}", func(w http.ResponseWriter, request *http.Request) {
-		respond(w, http.StatusOK, `[]`)
+		packageName := mux.Vars(request)["package_name"]
+		respond(w, http.StatusOK, AppPageGooglePlay{PackageName: packageName, CurrentSoftwareVersion: "1.0.0", SimilarApps: similarAppsOf[packageName]})
 	})
 }
 
 func mockStorageApp(r *mux.Router) {
 	// endpointPostObserveAppGooglePlay = "/ri-storage-app/hitec/repository/app/observe/app/google-play/package-name/%s/interval/%s"
 	r.HandleFunc("/ri-storage-app/hitec/repository/app/observe/app/google-play/package-name/{package_name}/interval/{interval}", func(w http.ResponseWriter, request *http.Request) {
+		vars := mux.Vars(request)
+		if strings.HasPrefix(vars["package_name"], "org.unstorable") {
+			respond(w, http.StatusInternalServerError, nil)
+			return
+		}
+		storageObservables.Lock()
+		storageObservablesOf(request)[vars["package_name"]] = vars["interval"]
+		storageObservables.Unlock()
 		respond(w, http.StatusOK, nil)
 	})
 
 	// endpointGetObservablesGooglePlay = "/ri-storage-app/hitec/repository/app/observable/google-play"
 	r.HandleFunc("/ri-storage-app/hitec/repository/app/observable/google-play", func(w http.ResponseWriter, request *http.Request) {
-		respond(w, http.StatusOK, []interface{}{
-			map[string]string{
-				"package_name": "eu.openreq",
-				"interval":     "30 3-6,20-23 * * *",
-			},
-			map[string]string{
-				"package_name": "com.twitter.android",
-				"interval":     "daily",
-			},
-		})
+		observables := []ObservableGooglePlay{}
+		storageObservables.Lock()
+		for packageName, interval := range storageObservablesOf(request) {
+			paused := storageObservables.paused[packageName]
+			observables = append(observables, ObservableGooglePlay{PackageName: packageName, Interval: interval, Paused: paused.Paused, ResumeAt: paused.ResumeAt})
+		}
+		storageObservables.Unlock()
+		respond(w, http.StatusOK, observables)
 	})
 
+	// endpointPostPauseObservableGooglePlay = "/ri-storage-app/hitec/repository/app/observable/google-play/package-name/%s/pause"
+	r.HandleFunc("/ri-storage-app/hitec/repository/app/observable/google-play/package-name/{package_name}/pause", func(w http.ResponseWriter, request *http.Request) {
+		var paused ObservableGooglePlay
+		json.NewDecoder(request.Body).Decode(&paused)
+		storageObservables.Lock()
+		defer storageObservables.Unlock()
+		if _, ok := storageObservablesOf(request)[mux.Vars(request)["package_name"]]; !ok {
+			respond(w, http.StatusNotFound, nil)
+			return
+		}
+		storageObservables.paused[mux.Vars(request)["package_name"]] = paused
+		respond(w, http.StatusOK, nil)
+	}).Methods("POST")
+
+	// endpointDeleteObservableGooglePlay = "/ri-storage-app/hitec/repository/app/observable/google-play/package-name/%s"
+	r.HandleFunc("/ri-storage-app/hitec/repository/app/observable/google-play/package-name/{package_name}", func(w http.ResponseWriter, request *http.Request) {
+		storageObservables.Lock()
+		defer storageObservables.Unlock()
+		observables := storageObservablesOf(request)
+		if _, ok := observables[mux.Vars(request)["package_name"]]; !ok {
+			respond(w, http.StatusNotFound, nil)
+			return
+		}
+		delete(observables, mux.Vars(request)["package_name"])
+		respond(w, http.StatusOK, nil)
+	}).Methods("DELETE")
+
 	// endpointPostAppReviewGooglePlay = "/ri-storage-app/hitec/repository/app/store/app-review/google-play/"
 	r.HandleFunc("/ri-storage-app/hitec/repository/app/store/app-review/google-play/", func(w http.ResponseWriter, request *http.Request) {
+		var reviews []AppReviewGooglePlay
+		json.NewDecoder(request.Body).Decode(&reviews)
+		if len(reviews) > 0 && strings.HasPrefix(reviews[0].PackageName, "org.unstored") {
+			// the connection drops, the storage layer is unreachable
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
 		respond(w, http.StatusOK, nil)
 	})
 
@@ -120,10 +190,27 @@ func mockStorageApp(r *mux.Router) {
 
 	// endpointPosNonExistingtAppReviewsGooglePlay = "/ri-storage-app/hitec/repository/app/non-existing/app-review/google-play"
 	r.HandleFunc("/ri-storage-app/hitec/repository/app/non-existing/app-review/google-play", func(w http.ResponseWriter, request *http.Request) {
-		respond(w, http.StatusOK, `[]`)
+		echoReviews(w, request)
 	})
 }
 
+// storageObservables are the observables of the mock storage layer by the authorization of a tenant: package name -> interval.
+// Their paused state is kept by package name
+var storageObservables = struct {
+	sync.Mutex
+	m      map[string]map[string]string
+	paused map[string]ObservableGooglePlay
+}{m: map[string]map[string]string{}, paused: map[string]ObservableGooglePlay{}}
+
+// storageObservablesOf returns the observables of the tenant of the request. The storage layer of every tenant starts with two observables
+func storageObservablesOf(request *http.Request) map[string]string {
+	authorization := request.Header.Get(AUTHORIZATION)
+	if _, ok := storageObservables.m[authorization]; !ok {
+		storageObservables.m[authorization] = map[string]string{"eu.openreq": "30 3-6,20-23 * * *", "com.twitter.android": "daily"}
+	}
+	return storageObservables.m[authorization]
+}
+
 func respond(writer http.ResponseWriter, statusCode int, body interface{}) {
 	var bodyData []byte
 	var err error
@@ -153,11 +240,14 @@ func respond(writer http.ResponseWriter, statusCode int, body interface{}) {
 func tearDown() {
 	fmt.Println("--- --- tear down")
 	stopTestServer()
+	CloseStore()
+	os.RemoveAll(storeDir)
 }
 
 type endpoint struct {
-	method string
-	url    string
+	method  string
+	url     string
+	headers map[string]string
 }
 
 func (e endpoint) withVars(vs ...interface{}) endpoint {
@@ -165,10 +255,20 @@ func (e endpoint) withVars(vs ...interface{}) endpoint {
 	return e
 }
 
+func (e endpoint) withHeader(key string, value string) endpoint {
+	headers := map[string]string{key: value}
+	for k, v := range e.headers {
+		headers[k] = v
+	}
+	e.headers = headers
+	return e
+}
+
 func (e endpoint) executeRequest(payload interface{}) (error, *httptest.ResponseRecorder) {
 	body := new(bytes.Buffer)
-	err := json.NewEncoder(body).Encode(payload)
-	if err != nil {
+	if raw, ok := payload.([]byte); ok {
+		body.Write(raw)
+	} else if err := json.NewEncoder(body).Encode(payload); err != nil {
 		return err, nil
 	}
 
@@ -177,6 +277,10 @@ func (e endpoint) executeRequest(payload interface{}) (error, *httptest.Response
 		return err, nil
 	}
 
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
@@ -201,6 +305,11 @@ func assertSuccess(t *testing.T, rr *httptest.ResponseRecorder) {
 		t.Errorf("Status code differs. Expected success.\n Got status %d (%s) instead", rr.Code, http.StatusText(rr.Code))
 	}
 }
+func assertStatus(t *testing.T, expected int, rr *httptest.ResponseRecorder) {
+	if rr.Code != expected {
+		t.Errorf("Status code differs. Expected %d (%s).\n Got status %d (%s) instead", expected, http.StatusText(expected), rr.Code, http.StatusText(rr.Code))
+	}
+}
 func assertFailure(t *testing.T, rr *httptest.ResponseRecorder) {
 	if isSuccess(rr.Code) {
 		t.Errorf("Status code differs. Expected failure.\n Got status %d (%s) instead", rr.Code, http.StatusText(rr.Code))
@@ -214,6 +323,11 @@ func TestPostObserveAppGooglePlay(t *testing.T) {
 	assertSuccess(t, ep.withVars("com.whatsapp", "monthly").mustExecuteRequest(nil))
 	assertSuccess(t, ep.withVars("com.whatsapp", "monthly").mustExecuteRequest(nil)) // noop; re-adding the same observable
 	assertSuccess(t, ep.withVars("com.whatsapp", "daily").mustExecuteRequest(nil))   // update the observable
+	assertStatus(t, http.StatusBadRequest, ep.withVars("whatsapp", "daily").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, ep.withVars("com.1whatsapp", "daily").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, ep.withVars("com.whatsapp", "every-day").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, ep.withVars("com.whatsapp", "61 * * * *").mustExecuteRequest(nil))
+	assertSuccess(t, ep.withVars("com.whatsapp", "30 3 * * 1").mustExecuteRequest(nil))
 
 	induceServerError = true
 	assertFailure(t, ep.withVars("com.whatsapp", "daily").mustExecuteRequest(nil))
@@ -224,7 +338,210 @@ func TestPostProcessAppGooglePlay(t *testing.T) {
 	ep := endpoint{method: "POST", url: "/hitec/orchestration/app/process/google-play/package-name/%s"}
 	assertFailure(t, ep.withVars("").mustExecuteRequest(nil))
 	assertSuccess(t, ep.withVars("eu.openreq").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, ep.withVars("openreq").mustExecuteRequest(nil))
 
+	subscriber := &progressSubscriber{tenant: defaultTenant, packageName: "eu.openreq"}
+	subscribeProgress(subscriber)
+	defer unsubscribeProgress(subscriber)
 	induceServerError = true
-	assertSuccess(t, ep.withVars("eu.openreq").mustExecuteRequest(nil))
+	rr := ep.withVars("eu.openreq").mustExecuteRequest(nil)
+	assertStatus(t, http.StatusAccepted, rr)
+	var response Response
+	json.NewDecoder(rr.Body).Decode(&response)
+	if response.RunID == "" || rr.Header().Get("Location") != "/hitec/orchestration/app/runs/"+response.RunID {
+		t.Fatalf("Expected the run of the processing. Got %+v at %s instead", response, rr.Header().Get("Location"))
+	}
+	run := waitForRun(t, response.RunID)
+	induceServerError = false
+	if run.Trigger != triggerProcess || run.Status != runFailed {
+		t.Errorf("Expected a failed process run in the history. Got %+v instead", run)
+	}
+
+	failed := map[string]bool{}
+	for len(subscriber.progress) > 0 {
+		if progress := <-subscriber.progress; progress.RunID == response.RunID && progress.Status == progressFailed {
+			failed[progress.Step] = true
+		}
+	}
+	if !failed[stepCrawlReviews] || !failed[stepRun] {
+		t.Errorf("Expected the failed crawl to fail the run. Got the failed steps %v instead", failed)
+	}
+}
+
+func TestGetObservablesGooglePlay(t *testing.T) {
+	induceServerError = false
+	observe := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.spotify.music/interval/daily?time_zone=%s&jitter=%s"}
+	assertStatus(t, http.StatusBadRequest, observe.withVars("Mars/Olympus", "1h").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, observe.withVars("Europe/Berlin", "forever").mustExecuteRequest(nil))
+	assertSuccess(t, observe.withVars("Europe/Berlin", "1h").mustExecuteRequest(nil))
+
+	rr := endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play/package-name/com.spotify.music"}.mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	var status ObservableStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Schedule.TimeZone != "Europe/Berlin" || status.Schedule.CronExpression != "@daily" || status.Schedule.NextRun == nil {
+		t.Errorf("Expected the effective schedule to be shown. Got %+v instead", status.Schedule)
+	}
+
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play"}.mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	var statuses []ObservableStatus
+	if err := json.NewDecoder(rr.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) < 3 {
+		t.Errorf("Expected the observables of the storage layer and the added one. Got %d instead", len(statuses))
+	}
+
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play/package-name/org.unknown"}.mustExecuteRequest(nil))
+}
+
+func TestPauseObservableGooglePlay(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.paused.app/interval/daily"}.mustExecuteRequest(nil))
+	pause := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/%s/pause%s"}
+	resume := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/%s/resume"}
+
+	assertStatus(t, http.StatusNotFound, pause.withVars("org.unknown", "").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, pause.withVars("com.paused.app", "?resume_at=tomorrow").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, pause.withVars("com.paused.app", "?resume_at=2000-01-01T00:00:00Z").mustExecuteRequest(nil))
+
+	rr := pause.withVars("com.paused.app", "").mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	var status ObservableStatus
+	json.NewDecoder(rr.Body).Decode(&status)
+	if status.State != statePaused || status.Schedule.NextRun != nil {
+		t.Errorf("Expected the app to be paused without a next run. Got %+v instead", status)
+	}
+
+	// the paused state is stored in the storage layer and survives a reload of the observables
+	storageObservables.Lock()
+	stored := storageObservables.paused["com.paused.app"]
+	storageObservables.Unlock()
+	if !stored.Paused {
+		t.Error("Expected the paused state in the storage layer")
+	}
+	RestartObservation()
+	if observable, _ := ObservableOf(defaultTenant, "com.paused.app"); !observable.Paused || observable.Interval != "daily" {
+		t.Errorf("Expected the app to stay paused. Got %+v instead", observable)
+	}
+
+	induceServerError = true
+	assertStatus(t, http.StatusInternalServerError, resume.withVars("com.paused.app").mustExecuteRequest(nil))
+	induceServerError = false
+	if observable, _ := ObservableOf(defaultTenant, "com.paused.app"); !observable.Paused {
+		t.Error("Expected the app to stay paused if the storage layer is unreachable")
+	}
+
+	rr = resume.withVars("com.paused.app").mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	json.NewDecoder(rr.Body).Decode(&status)
+	if status.State != stateActive || status.Schedule.NextRun == nil {
+		t.Errorf("Expected the app to be active. Got %+v instead", status)
+	}
+
+	// an elapsed resume time resumes the app on its next scheduled run
+	past := time.Now().Add(-time.Minute)
+	PauseObservable(defaultTenant, "com.paused.app", &past)
+	runScheduled(defaultTenant, "com.paused.app")
+	if observable, _ := ObservableOf(defaultTenant, "com.paused.app"); observable.Paused {
+		t.Error("Expected the app to be resumed automatically")
+	}
+}
+
+// isPending is true while a run of an app is queued or running
+func (q *JobQueue) isPending(tenant string, packageName string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, ok := q.pending[observableKey(tenant, packageName)]
+	return ok
+}
+
+// waitForRun waits until a run finished and its app left the job queue, i.e. its alerts and dead letter are up to date
+func waitForRun(t *testing.T, id string) Run {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		run, ok := RunOf(id)
+		if ok && (run.Status == runSucceeded || run.Status == runFailed) && !jobQueue.isPending(run.Tenant, run.PackageName) {
+			return run
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Run %s did not finish. Last state: %+v", id, run)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPostRunObservableGooglePlay(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.run.now/interval/monthly"}.mustExecuteRequest(nil))
+	ep := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/%s/run"}
+	assertStatus(t, http.StatusNotFound, ep.withVars("org.unknown").mustExecuteRequest(nil))
+
+	rr := ep.withVars("com.run.now").mustExecuteRequest(nil)
+	assertStatus(t, http.StatusAccepted, rr)
+	var run Run
+	json.NewDecoder(rr.Body).Decode(&run)
+	if run.Trigger != triggerManual || run.PackageName != "com.run.now" {
+		t.Errorf("Expected a manual run of com.run.now. Got %+v instead", run)
+	}
+	if run = waitForRun(t, run.ID); run.Status != runSucceeded {
+		t.Errorf("Expected the run to succeed. Got %+v instead", run)
+	}
+	first := run.ID
+
+	induceServerError = true
+	rr = ep.withVars("com.run.now").mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&run)
+	run = waitForRun(t, run.ID)
+	induceServerError = false
+	if run.Status != runFailed || run.Error == "" {
+		t.Errorf("Expected the run to fail. Got %+v instead", run)
+	}
+
+	rr = endpoint{method: "GET", url: "/hitec/orchestration/app/runs?package_name=com.run.now&trigger=manual"}.mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	var runs []Run
+	json.NewDecoder(rr.Body).Decode(&runs)
+	// the history of the store is kept between test runs, only the newest runs are the ones of this test
+	if len(runs) < 2 || runs[0].ID != run.ID || runs[1].ID != first {
+		t.Errorf("Expected both runs in the history, newest first. Got %+v instead", runs)
+	}
+	assertSuccess(t, endpoint{method: "GET", url: "/hitec/orchestration/app/runs/" + run.ID}.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/runs/unknown"}.mustExecuteRequest(nil))
+}
+
+func TestJobQueue(t *testing.T) {
+	queue := NewJobQueue(0, 1)
+	if _, err := queue.Enqueue(defaultTenant, "eu.openreq", triggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue(defaultTenant, "eu.openreq", triggerManual); err != errRunPending {
+		t.Errorf("Expected a pending run to be rejected. Got %v instead", err)
+	}
+	if _, err := queue.Enqueue(defaultTenant, "com.twitter.android", triggerManual); err != errQueueFull {
+		t.Errorf("Expected a full queue to be rejected. Got %v instead", err)
+	}
+}
+
+func TestGetIntervalPreview(t *testing.T) {
+	ep := endpoint{method: "GET", url: "/hitec/orchestration/app/observe/interval/preview?interval=%s&count=%d"}
+	rr := ep.withVars("daily", 3).mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+
+	var preview IntervalPreview
+	if err := json.NewDecoder(rr.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Next) != 3 {
+		t.Fatalf("Expected 3 fire times. Got %d instead", len(preview.Next))
+	}
+	if preview.Next[1].Sub(preview.Next[0]) != 24*time.Hour || preview.Next[0].Hour() != 0 {
+		t.Errorf("Expected daily fire times at midnight. Got %v instead", preview.Next)
+	}
+
+	assertStatus(t, http.StatusBadRequest, ep.withVars("0+25+*+*+*", 3).mustExecuteRequest(nil))
+	assertStatus(t, http.StatusBadRequest, ep.withVars("daily", 0).mustExecuteRequest(nil))
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * local key-value store of the orchestrator (embedded bolt db)
+ */
+var db *bolt.DB
+var storePath = getEnv("STORE_PATH", "orchestrator.db")
+
+const (
+	bucketObservables = "observables"
+)
+
+var buckets = []string{
+	bucketObservables,
+	bucketRuns,
+	bucketProposals,
+	bucketWebhooks,
+	bucketDeliveries,
+	bucketIssues,
+	bucketIssueLinks,
+	bucketAlertRules,
+	bucketAlerts,
+	bucketDigests,
+	bucketDigestReports,
+	bucketReviews,
+	bucketOutbox,
+	bucketDeadLetters,
+}
+
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// OpenStore opens (or creates) the local store and its buckets
+func OpenStore(path string) error {
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CloseStore closes the local store
+func CloseStore() error {
+	if db == nil {
+		return nil
+	}
+	err := db.Close()
+	db = nil
+	return err
+}
+
+func storePut(bucket string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+	})
+}
+
+// storeGet decodes the value of key into value. Returns false if the key does not exist
+func storeGet(bucket string, key string, value interface{}) (bool, error) {
+	var data []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(bucket)).Get([]byte(key)); v != nil {
+			data = append(data, v...)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+func storeDelete(bucket string, key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+}
+
+// storeForEach calls fn for every value of the bucket in key order
+func storeForEach(bucket string, fn func(key string, data []byte) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
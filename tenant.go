@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+ * Multi-tenancy. Every tenant has its own observables, downstream base URL and credentials, concurrency quota and
+ * run history. The tenant of a request is resolved from its identity (field tenant of an API key, claim tenant of a JWT)
+ * and every API only sees the data of that tenant.
+ * Without TENANTS_FILE there is a single default tenant that uses BASE_URL, BEARER_TOKEN and REQUIREMENTS_URL.
+ */
+
+// defaultTenant is the id of the single tenant if multi-tenancy is disabled
+const defaultTenant = ""
+
+const maxTenantIDLength = 64
+
+// Tenant model of the TENANTS_FILE
+type Tenant struct {
+	ID          string `json:"id"`
+	BaseURL     string `json:"base_url"`
+	BearerToken string `json:"bearer_token"`
+	// MaxConcurrentRuns limits the runs of the tenant that are executed at the same time, 0 means unlimited
+	MaxConcurrentRuns int `json:"max_concurrent_runs"`
+	// RequirementsURL receives the feature requests of the tenant as OpenReq requirements, empty disables the push
+	RequirementsURL string `json:"requirements_url,omitempty"`
+}
+
+// tenants is nil if multi-tenancy is disabled
+var tenants map[string]*Tenant
+
+// LoadTenants configures the tenants from the environment (TENANTS_FILE). Requires authentication to resolve the tenant of a request
+func LoadTenants() error {
+	tenantsFile := os.Getenv("TENANTS_FILE")
+	if tenantsFile == "" {
+		return nil
+	}
+	if authenticator == nil {
+		return fmt.Errorf("TENANTS_FILE requires authentication, set API_KEYS_FILE or JWKS_FILE")
+	}
+
+	t, err := NewTenants(tenantsFile)
+	if err != nil {
+		return err
+	}
+	tenants = t
+	return nil
+}
+
+// NewTenants reads the tenants of a file
+func NewTenants(tenantsFile string) (map[string]*Tenant, error) {
+	data, err := ioutil.ReadFile(tenantsFile)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid tenants file: %v", err)
+	}
+
+	t := map[string]*Tenant{}
+	for _, tenant := range list {
+		if err := validateTenant(tenant); err != nil {
+			return nil, err
+		}
+		if _, ok := t[tenant.ID]; ok {
+			return nil, fmt.Errorf("duplicate tenant %q", tenant.ID)
+		}
+		t[tenant.ID] = tenant
+	}
+	return t, nil
+}
+
+func validateTenant(tenant *Tenant) error {
+	if tenant.ID == "" || len(tenant.ID) > maxTenantIDLength || strings.ContainsAny(tenant.ID, "/ ") {
+		return fmt.Errorf("invalid tenant id %q: use 1 to %d characters without / and spaces", tenant.ID, maxTenantIDLength)
+	}
+	if tenant.BaseURL == "" {
+		return fmt.Errorf("tenant %q needs a base_url", tenant.ID)
+	}
+	if tenant.MaxConcurrentRuns < 0 {
+		return fmt.Errorf("tenant %q: max_concurrent_runs must not be negative", tenant.ID)
+	}
+	return nil
+}
+
+// TenantOf returns the configuration of a tenant
+func TenantOf(id string) (*Tenant, bool) {
+	if tenants == nil {
+		if id != defaultTenant {
+			return nil, false
+		}
+		return &Tenant{ID: defaultTenant, BaseURL: baseURL, BearerToken: os.Getenv("BEARER_TOKEN"), RequirementsURL: os.Getenv("REQUIREMENTS_URL")}, true
+	}
+	tenant, ok := tenants[id]
+	return tenant, ok
+}
+
+// TenantIDs returns the ids of all tenants in order
+func TenantIDs() []string {
+	if tenants == nil {
+		return []string{defaultTenant}
+	}
+	var ids []string
+	for id := range tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// maxConcurrentRunsOf returns the concurrency quota of a tenant, 0 means unlimited
+func maxConcurrentRunsOf(id string) int {
+	if tenant, ok := TenantOf(id); ok {
+		return tenant.MaxConcurrentRuns
+	}
+	return 0
+}
+
+func (t *Tenant) url(endpoint string) string {
+	return t.BaseURL + endpoint
+}
+
+func (t *Tenant) authorization() string {
+	return "Bearer " + t.BearerToken
+}
+
+// tenantOf returns the tenant of an authenticated request
+func tenantOf(r *http.Request) string {
+	if identity := IdentityOf(r); identity != nil {
+		return identity.Tenant
+	}
+	return defaultTenant
+}
+
+// observableKey identifies an observable across tenants. Package names cannot contain a slash
+func observableKey(tenant string, packageName string) string {
+	if tenant == defaultTenant {
+		return packageName
+	}
+	return tenant + "/" + packageName
+}
+
+// keyOf returns the key of an observable in the observables of all tenants
+func keyOf(observable ObservableGooglePlay) string {
+	return observableKey(observable.Tenant, observable.PackageName)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewTenants(t *testing.T) {
+	for _, content := range []string{
+		`[{"id": "acme"}]`,
+		`[{"id": "", "base_url": "http://storage"}]`,
+		`[{"id": "acme", "base_url": "http://storage"}, {"id": "acme", "base_url": "http://other"}]`,
+		`[{"id": "acme", "base_url": "http://storage", "max_concurrent_runs": -1}]`,
+	} {
+		file := filepath.Join(storeDir, "tenants.json")
+		ioutil.WriteFile(file, []byte(content), 0600)
+		if _, err := NewTenants(file); err == nil {
+			t.Errorf("Expected tenants %s to be rejected", content)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	induceServerError = false
+	var authorization string
+	mock := makeMockHandler()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get(AUTHORIZATION)
+		mock.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	tenants = map[string]*Tenant{
+		"acme":   {ID: "acme", BaseURL: baseURL, BearerToken: "acme-token"},
+		"globex": {ID: "globex", BaseURL: s.URL, BearerToken: "globex-token"},
+	}
+	apiKeys, _ := json.Marshal([]APIKey{
+		{Name: "acme-admin", Key: "acme-key", Role: roleAdmin, Tenant: "acme"},
+		{Name: "globex-admin", Key: "globex-key", Role: roleAdmin, Tenant: "globex"},
+		{Name: "nobody", Key: "nobody-key", Role: roleAdmin},
+	})
+	apiKeysFile := filepath.Join(storeDir, "tenant_api_keys.json")
+	ioutil.WriteFile(apiKeysFile, apiKeys, 0600)
+	var err error
+	if authenticator, err = NewAuthenticator(apiKeysFile, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		tenants = nil
+		authenticator = nil
+		RestartObservation()
+	}()
+
+	observe := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.acme.app/interval/daily"}
+	assertSuccess(t, observe.withHeader(headerAPIKey, "acme-key").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusForbidden, observe.withHeader(headerAPIKey, "nobody-key").mustExecuteRequest(nil))
+
+	observable := endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play/package-name/com.acme.app"}
+	assertSuccess(t, observable.withHeader(headerAPIKey, "acme-key").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, observable.withHeader(headerAPIKey, "globex-key").mustExecuteRequest(nil))
+
+	var statuses []ObservableStatus
+	rr := endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play"}.withHeader(headerAPIKey, "globex-key").mustExecuteRequest(nil)
+	json.NewDecoder(rr.Body).Decode(&statuses)
+	for _, status := range statuses {
+		if status.PackageName == "com.acme.app" || status.Tenant != "globex" {
+			t.Errorf("Expected only observables of globex. Got %+v", status)
+		}
+	}
+
+	run := endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.acme.app/run"}
+	assertStatus(t, http.StatusNotFound, run.withHeader(headerAPIKey, "globex-key").mustExecuteRequest(nil))
+	rr = run.withHeader(headerAPIKey, "acme-key").mustExecuteRequest(nil)
+	assertStatus(t, http.StatusAccepted, rr)
+	var queued Run
+	json.NewDecoder(rr.Body).Decode(&queued)
+	waitForRun(t, queued.ID)
+	runOf := endpoint{method: "GET", url: "/hitec/orchestration/app/runs/" + queued.ID}
+	assertSuccess(t, runOf.withHeader(headerAPIKey, "acme-key").mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, runOf.withHeader(headerAPIKey, "globex-key").mustExecuteRequest(nil))
+
+	process := endpoint{method: "POST", url: "/hitec/orchestration/app/process/google-play/package-name/com.globex.app"}
+	rr = process.withHeader(headerAPIKey, "globex-key").mustExecuteRequest(nil)
+	assertSuccess(t, rr)
+	var processing Response
+	json.NewDecoder(rr.Body).Decode(&processing)
+	waitForRun(t, processing.RunID)
+	if authorization != "Bearer globex-token" {
+		t.Errorf("Expected the downstream credentials of globex. Got %q instead", authorization)
+	}
+}
+
+func TestJobQueueTenantQuota(t *testing.T) {
+	tenants = map[string]*Tenant{"acme": {ID: "acme", BaseURL: baseURL, MaxConcurrentRuns: 1}}
+	defer func() { tenants = nil }()
+
+	queue := NewJobQueue(0, 10)
+	first, err := queue.Enqueue("acme", "com.acme.one", triggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue("acme", "com.acme.two", triggerManual); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.jobs) != 1 || len(queue.backlog["acme"]) != 1 {
+		t.Fatalf("Expected the second run to wait for the quota. Got %d queued and %d waiting", len(queue.jobs), len(queue.backlog["acme"]))
+	}
+
+	<-queue.jobs
+	queue.done(first)
+	select {
+	case runs := <-queue.jobs:
+		if runs[0].PackageName != "com.acme.two" {
+			t.Errorf("Expected the waiting run to be queued. Got %s instead", runs[0].PackageName)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the waiting run to be queued once the first finished")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * web admin UI, served from the static assets embedded into the binary. The assets are public; the UI calls the API
+ * with the API key or bearer token entered by the user, so the roles of the API apply.
+ */
+
+const uiPath = "/hitec/orchestration/app/ui/"
+
+//go:embed web
+var webAssets embed.FS
+
+// routeUI serves the web UI below uiPath
+func routeUI(router *mux.Router) {
+	assets, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err)
+	}
+	router.Handle(uiPath[:len(uiPath)-1], http.RedirectHandler(uiPath, http.StatusMovedPermanently)).Methods("GET")
+	router.PathPrefix(uiPath).Handler(http.StripPrefix(uiPath, http.FileServer(http.FS(assets)))).Methods("GET")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUI(t *testing.T) {
+	rr := endpoint{method: "GET", url: "/hitec/orchestration/app/ui"}.mustExecuteRequest(nil)
+	if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != uiPath {
+		t.Errorf("Expected a redirect to the UI. Got %d %s instead", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = endpoint{method: "GET", url: uiPath}.mustExecuteRequest(nil)
+	assertStatus(t, http.StatusOK, rr)
+	if !strings.Contains(rr.Body.String(), "<title>ri-orchestration-app</title>") {
+		t.Errorf("Expected the index page. Got %s instead", rr.Body.String())
+	}
+	rr = endpoint{method: "GET", url: uiPath + "app.js"}.mustExecuteRequest(nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Header().Get("Content-Type"), "javascript") {
+		t.Errorf("Expected the script of the UI. Got %d %s instead", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: uiPath + "missing.js"}.mustExecuteRequest(nil))
+}
+
+func TestDeleteObservable(t *testing.T) {
+	induceServerError = false
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.ui.app/interval/daily"}.mustExecuteRequest(nil))
+	ep := endpoint{method: "DELETE", url: "/hitec/orchestration/app/observe/google-play/package-name/com.ui.app"}
+
+	induceServerError = true
+	assertStatus(t, http.StatusBadGateway, ep.mustExecuteRequest(nil))
+	induceServerError = false
+	if _, ok := ObservableOf(defaultTenant, "com.ui.app"); !ok {
+		t.Fatalf("Expected the app to stay observed if the storage layer is unreachable")
+	}
+
+	entries := len(observer.Entries())
+	assertSuccess(t, ep.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/observe/google-play/package-name/com.ui.app"}.mustExecuteRequest(nil))
+	if len(observer.Entries()) != entries-1 {
+		t.Errorf("Expected the app to be unscheduled. Got %d scheduled apps instead of %d", len(observer.Entries()), entries-1)
+	}
+	for _, observable := range LoadSnapshot() {
+		if observable.PackageName == "com.ui.app" {
+			t.Errorf("Expected the app to be removed from the snapshot")
+		}
+	}
+	assertStatus(t, http.StatusNotFound, ep.mustExecuteRequest(nil))
+
+	// an app the storage layer does not know is not removed, it would be observed again
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.ui.lost/interval/daily"}.mustExecuteRequest(nil))
+	storageObservables.Lock()
+	for _, observables := range storageObservables.m {
+		delete(observables, "com.ui.lost")
+	}
+	storageObservables.Unlock()
+	assertStatus(t, http.StatusBadGateway, endpoint{method: "DELETE", url: "/hitec/orchestration/app/observe/google-play/package-name/com.ui.lost"}.mustExecuteRequest(nil))
+	if _, ok := ObservableOf(defaultTenant, "com.ui.lost"); !ok {
+		t.Errorf("Expected the app to stay observed if the storage layer could not remove it")
+	}
+}
+
+func TestDownstreamHealth(t *testing.T) {
+	ep := endpoint{method: "GET", url: "/hitec/orchestration/app/health/downstream"}
+	var health Health
+
+	induceServerError = false
+	json.NewDecoder(ep.mustExecuteRequest(nil).Body).Decode(&health)
+	if health.Status != statusOK || len(health.Components) != len(downstreamServices) {
+		t.Errorf("Expected all downstream services to be reachable. Got %+v instead", health)
+	}
+
+	induceServerError = true
+	json.NewDecoder(ep.mustExecuteRequest(nil).Body).Decode(&health)
+	induceServerError = false
+	if health.Status != statusDegraded || health.Components["storage"].Status != statusDegraded {
+		t.Errorf("Expected the downstream services to be degraded. Got %+v instead", health)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/robfig/cron"
+)
+
+// ValidatePackageName checks a package name against the naming rules of Android application IDs:
+// at least two segments separated by dots, each segment starts with a letter and consists of letters, digits and underscores only
+func ValidatePackageName(packageName string) error {
+	if packageName == "" {
+		return fmt.Errorf("package name must not be empty")
+	}
+
+	segments := strings.Split(packageName, ".")
+	if len(segments) < 2 {
+		return fmt.Errorf("invalid package name %q: must have at least two segments separated by dots", packageName)
+	}
+	for i, segment := range segments {
+		if segment == "" {
+			return fmt.Errorf("invalid package name %q: segment %d is empty", packageName, i+1)
+		}
+		if !isASCIILetter(rune(segment[0])) {
+			return fmt.Errorf("invalid package name %q: segment %q must start with a letter", packageName, segment)
+		}
+		for _, c := range segment {
+			if !isASCIILetter(c) && !(c >= '0' && c <= '9') && c != '_' {
+				return fmt.Errorf("invalid package name %q: segment %q contains %q, only letters, digits and underscores are allowed", packageName, segment, c)
+			}
+		}
+	}
+	return nil
+}
+
+func isASCIILetter(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ParseObserverInterval parses a named interval (minutely, hourly, daily, weekly, monthly, adaptive), a standard cron expression
+// or a cron expression with six fields that starts with seconds, as stored by earlier versions
+func ParseObserverInterval(interval string) (cron.Schedule, error) {
+	if interval == "" {
+		return nil, fmt.Errorf("interval must not be empty")
+	}
+	if interval == intervalAdaptive {
+		return pollSchedule{}, nil
+	}
+	spec := getObserverInterval(interval)
+	parse := cron.ParseStandard
+	if len(strings.Fields(spec)) == 6 {
+		parse = cron.Parse
+	}
+	schedule, err := parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q: %v. Use minutely, hourly, daily, weekly, monthly, adaptive or a cron expression with five fields (or six fields starting with seconds)", interval, err)
+	}
+	return schedule, nil
+}
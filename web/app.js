@@ -0,0 +1,232 @@
+// admin UI of the orchestrator. It only uses the API, with the credentials kept in the local storage of the browser.
+'use strict';
+
+const api = '/hitec/orchestration/app';
+
+function headers() {
+  const credential = localStorage.getItem('credential');
+  if (!credential) {
+    return {};
+  }
+  if (localStorage.getItem('credentialType') === 'bearer') {
+    return {'Authorization': 'Bearer ' + credential};
+  }
+  return {'X-API-Key': credential};
+}
+
+async function request(method, path) {
+  const res = await fetch(api + path, {method: method, headers: headers()});
+  const body = await res.json().catch(() => null);
+  if (!res.ok) {
+    throw new Error((body && body.message) || res.status + ' ' + res.statusText);
+  }
+  return body;
+}
+
+function show(message, error) {
+  const element = document.getElementById('message');
+  element.textContent = message;
+  element.className = error ? 'error' : '';
+  element.hidden = false;
+}
+
+// act runs an action of the API, shows its result and refreshes the current tab
+async function act(method, path, confirmation) {
+  if (confirmation && !confirm(confirmation)) {
+    return;
+  }
+  try {
+    const body = await request(method, path);
+    show((body && body.message) || (body && body.id ? 'run ' + body.id + ' queued' : 'done'));
+  } catch (err) {
+    show(err.message, true);
+  }
+  refresh();
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text === undefined || text === null ? '' : text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(td, label, handler) {
+  const b = document.createElement('button');
+  b.textContent = label;
+  b.addEventListener('click', handler);
+  td.appendChild(b);
+}
+
+function time(value) {
+  return value ? new Date(value).toLocaleString() : '';
+}
+
+function observablePath(packageName) {
+  return '/observe/google-play/package-name/' + encodeURIComponent(packageName);
+}
+
+async function loadObservables() {
+  const rows = document.getElementById('observables-rows');
+  const observables = await request('GET', '/observe/google-play');
+  rows.innerHTML = '';
+  observables.forEach(observable => {
+    const row = rows.insertRow();
+    cell(row, observable.package_name);
+    cell(row, observable.interval);
+    cell(row, observable.state, observable.state);
+    cell(row, time(observable.schedule.next_run));
+    if (observable.last_run_at) {
+      const succeeded = observable.last_run_at === observable.last_success_at;
+      cell(row, time(observable.last_run_at) + (succeeded ? ' succeeded' : ' failed'), succeeded ? 'succeeded' : 'failed');
+    } else {
+      cell(row, 'never');
+    }
+    cell(row, (observable.projects || []).join(', '));
+    const actions = cell(row, '');
+    const path = observablePath(observable.package_name);
+    button(actions, 'Run now', () => act('POST', path + '/run'));
+    if (observable.paused) {
+      button(actions, 'Resume', () => act('POST', path + '/resume'));
+    } else {
+      button(actions, 'Pause', () => act('POST', path + '/pause'));
+    }
+    button(actions, 'Edit', () => editObservable(observable));
+    button(actions, 'History', () => showRuns(observable.package_name));
+    button(actions, 'Delete', () => act('DELETE', path, 'Stop observing ' + observable.package_name + '?'));
+  });
+}
+
+function editObservable(observable) {
+  const form = document.getElementById('observable-form');
+  form.package_name.value = observable.package_name;
+  form.interval.value = observable.interval;
+  form.interval.focus();
+}
+
+async function loadRuns() {
+  const form = document.getElementById('runs-filter');
+  const query = new URLSearchParams({limit: '100'});
+  if (form.package_name.value) {
+    query.set('package_name', form.package_name.value);
+  }
+  if (form.status.value) {
+    query.set('status', form.status.value);
+  }
+  const rows = document.getElementById('runs-rows');
+  const runs = await request('GET', '/runs?' + query);
+  rows.innerHTML = '';
+  runs.forEach(run => {
+    const row = rows.insertRow();
+    cell(row, time(run.queued_at));
+    cell(row, run.package_name);
+    cell(row, run.trigger);
+    cell(row, run.status, run.status);
+    cell(row, run.crawled_reviews);
+    cell(row, run.new_reviews);
+    cell(row, run.classified_reviews);
+    cell(row, run.bug_reports);
+    cell(row, run.feature_requests);
+    cell(row, run.error);
+  });
+}
+
+function showRuns(packageName) {
+  document.getElementById('runs-filter').package_name.value = packageName;
+  select('runs');
+}
+
+async function loadDeadLetters() {
+  const rows = document.getElementById('dead-letters-rows');
+  const letters = await request('GET', '/dead-letters');
+  rows.innerHTML = '';
+  letters.forEach(letter => {
+    const row = rows.insertRow();
+    cell(row, time(letter.failed_at));
+    cell(row, letter.package_name);
+    cell(row, letter.failures);
+    cell(row, time(letter.first_failed_at));
+    cell(row, letter.error, 'failed');
+    const actions = cell(row, '');
+    const path = '/dead-letters/' + encodeURIComponent(letter.package_name);
+    button(actions, 'Retry', () => act('POST', path + '/retry'));
+    button(actions, 'Discard', () => act('DELETE', path, 'Discard the dead letter of ' + letter.package_name + '?'));
+  });
+}
+
+function healthRows(id, health) {
+  const rows = document.getElementById(id);
+  rows.innerHTML = '';
+  Object.keys(health.components).sort().forEach(name => {
+    const component = health.components[name];
+    const row = rows.insertRow();
+    cell(row, name);
+    cell(row, component.status, component.status);
+    cell(row, component.message);
+  });
+}
+
+async function loadHealth() {
+  // readiness responds with 503 if it is degraded, so it is not read via request
+  const readiness = await fetch(api + '/health/ready').then(res => res.json());
+  healthRows('readiness-rows', readiness);
+  healthRows('downstream-rows', await request('GET', '/health/downstream'));
+}
+
+const loaders = {
+  'observables': loadObservables,
+  'runs': loadRuns,
+  'dead-letters': loadDeadLetters,
+  'health': loadHealth,
+};
+let current = 'observables';
+
+async function refresh() {
+  try {
+    await loaders[current]();
+  } catch (err) {
+    show(err.message, true);
+  }
+}
+
+function select(tab) {
+  current = tab;
+  document.querySelectorAll('nav button').forEach(b => b.classList.toggle('active', b.dataset.tab === tab));
+  document.querySelectorAll('section').forEach(s => s.hidden = s.id !== tab);
+  refresh();
+}
+
+document.querySelectorAll('nav button').forEach(b => b.addEventListener('click', () => select(b.dataset.tab)));
+
+document.getElementById('credentials').addEventListener('submit', event => {
+  event.preventDefault();
+  localStorage.setItem('credentialType', document.getElementById('credential-type').value);
+  localStorage.setItem('credential', document.getElementById('credential').value);
+  refresh();
+});
+document.getElementById('credential-type').value = localStorage.getItem('credentialType') || 'api-key';
+document.getElementById('credential').value = localStorage.getItem('credential') || '';
+
+document.getElementById('observable-form').addEventListener('submit', event => {
+  event.preventDefault();
+  const form = event.target;
+  const query = new URLSearchParams();
+  if (form.project.value) {
+    query.set('project', form.project.value);
+  }
+  if (form.tag.value) {
+    query.set('tag', form.tag.value);
+  }
+  act('POST', observablePath(form.package_name.value) + '/interval/' + encodeURIComponent(form.interval.value) + '?' + query);
+  form.reset();
+});
+
+document.getElementById('runs-filter').addEventListener('submit', event => {
+  event.preventDefault();
+  refresh();
+});
+
+refresh();
+setInterval(refresh, 15000);
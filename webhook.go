@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * webhook notifications of newly classified bug reports and feature requests.
+ * A webhook filters the classified reviews of a run by package name, class, star rating and keyword and POSTs the
+ * matching reviews in batches. Every request is signed: the header X-Signature carries
+ * sha256=hex(HMAC-SHA256(secret, X-Timestamp + "." + body)). Failed deliveries are retried with an exponential backoff
+ * (WEBHOOK_MAX_ATTEMPTS, WEBHOOK_RETRY_BACKOFF) and every attempt is recorded for inspection.
+ */
+
+const (
+	bucketWebhooks   = "webhooks"
+	bucketDeliveries = "deliveries"
+
+	classBugReport      = "bug_report"
+	classFeatureRequest = "feature_request"
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	headerSignature  = "X-Signature"
+	headerTimestamp  = "X-Timestamp"
+	headerWebhookID  = "X-Webhook-ID"
+	headerDeliveryID = "X-Delivery-ID"
+
+	defaultWebhookBatchSize = 50
+	maxWebhookBatchSize     = 500
+)
+
+var webhookMaxAttempts = parseIntEnv("WEBHOOK_MAX_ATTEMPTS", "5")
+var webhookRetryBackoff = parseDurationEnv("WEBHOOK_RETRY_BACKOFF", "10s")
+
+// externalClient calls services outside of the OpenReq infrastructure, i.e. the receivers of webhooks and requirements, issue trackers and event brokers
+var externalClient = &http.Client{Timeout: 30 * time.Second}
+
+// delivering are the ids of the deliveries that are sent by this replica
+var delivering = map[string]bool{}
+var deliveringMutex sync.Mutex
+
+// StartWebhooks resumes the pending deliveries of this replica and prunes old deliveries once per hour
+func StartWebhooks() {
+	ResumeDeliveries()
+	go func() {
+		for range time.Tick(time.Hour) {
+			pruneDeliveries(time.Now().Add(-runHistoryRetention))
+		}
+	}()
+}
+
+// ValidateWebhook checks a webhook and sets its defaults
+func ValidateWebhook(webhook *Webhook) error {
+	if err := validateReceiverURL(webhook.URL); err != nil {
+		return err
+	}
+	for _, packageName := range webhook.PackageNames {
+		if err := ValidatePackageName(packageName); err != nil {
+			return err
+		}
+	}
+	for _, class := range webhook.Classes {
+		if class != classBugReport && class != classFeatureRequest {
+			return fmt.Errorf("invalid class %q: use %s or %s", class, classBugReport, classFeatureRequest)
+		}
+	}
+	if webhook.MinRating < 0 || webhook.MinRating > 5 || webhook.MaxRating < 0 || webhook.MaxRating > 5 {
+		return fmt.Errorf("min_rating and max_rating must be between 1 and 5")
+	}
+	if webhook.MaxRating != 0 && webhook.MinRating > webhook.MaxRating {
+		return fmt.Errorf("min_rating must not be greater than max_rating")
+	}
+	if webhook.BatchSize == 0 {
+		webhook.BatchSize = defaultWebhookBatchSize
+	}
+	if webhook.BatchSize < 1 || webhook.BatchSize > maxWebhookBatchSize {
+		return fmt.Errorf("batch_size must be between 1 and %d", maxWebhookBatchSize)
+	}
+	if webhook.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			return err
+		}
+		webhook.Secret = secret
+	}
+	return nil
+}
+
+func validateReceiverURL(receiverURL string) error {
+	u, err := url.Parse(receiverURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q: use an absolute http or https URL", receiverURL)
+	}
+	return nil
+}
+
+// newSecret returns a random secret to sign requests with
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// matches returns true if a classified review passes all filters of the webhook. Without classes, bug reports and feature requests match
+func (webhook Webhook) matches(review AppReviewGooglePlay) bool {
+	if len(webhook.PackageNames) > 0 && !containsString(webhook.PackageNames, review.PackageName) {
+		return false
+	}
+	classes := webhook.Classes
+	if len(classes) == 0 {
+		classes = []string{classBugReport, classFeatureRequest}
+	}
+	if !(review.BugReport && containsString(classes, classBugReport)) && !(review.FeatureRequest && containsString(classes, classFeatureRequest)) {
+		return false
+	}
+	if (webhook.MinRating != 0 && review.Rating < webhook.MinRating) || (webhook.MaxRating != 0 && review.Rating > webhook.MaxRating) {
+		return false
+	}
+	if len(webhook.Keywords) == 0 {
+		return true
+	}
+	text := strings.ToLower(review.Title + " " + review.Body)
+	for _, keyword := range webhook.Keywords {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifyWebhooks delivers the classified reviews of an app to all matching webhooks of the tenant
+func NotifyWebhooks(tenant string, packageName string, reviews []AppReviewGooglePlay) {
+	if len(reviews) == 0 {
+		return
+	}
+	for _, webhook := range Webhooks(tenant) {
+		var matching []AppReviewGooglePlay
+		for _, review := range reviews {
+			if webhook.matches(review) {
+				matching = append(matching, review)
+			}
+		}
+		for start := 0; start < len(matching); start += webhook.BatchSize {
+			end := start + webhook.BatchSize
+			if end > len(matching) {
+				end = len(matching)
+			}
+			now := time.Now()
+			delivery := Delivery{ID: newRunID(now), WebhookID: webhook.ID, Tenant: tenant, PackageName: packageName, Status: deliveryPending, CreatedAt: now}
+			delivery.Payload, _ = json.Marshal(WebhookPayload{WebhookID: webhook.ID, DeliveryID: delivery.ID, PackageName: packageName, Reviews: matching[start:end]})
+			delivery.Reviews = end - start
+			SaveDelivery(delivery)
+			startDelivery(delivery)
+		}
+	}
+}
+
+// ResumeDeliveries sends the pending deliveries of the store of this replica, e.g. after a restart
+func ResumeDeliveries() {
+	for _, delivery := range Deliveries(DeliveryFilter{AllTenants: true, Status: deliveryPending}) {
+		startDelivery(delivery)
+	}
+}
+
+// startDelivery sends a delivery in the background unless it is sent already
+func startDelivery(delivery Delivery) {
+	deliveringMutex.Lock()
+	defer deliveringMutex.Unlock()
+	if delivering[delivery.ID] {
+		return
+	}
+	delivering[delivery.ID] = true
+	go func() {
+		deliver(delivery)
+		deliveringMutex.Lock()
+		delete(delivering, delivery.ID)
+		deliveringMutex.Unlock()
+	}()
+}
+
+// deliver sends a delivery until it succeeds or the attempts are exhausted
+func deliver(delivery Delivery) {
+	for delivery.Status == deliveryPending {
+		if delivery.NextAttemptAt != nil {
+			time.Sleep(time.Until(*delivery.NextAttemptAt))
+		}
+		webhook, ok := WebhookOf(delivery.Tenant, delivery.WebhookID)
+		if !ok {
+			delivery.Status = deliveryFailed
+			delivery.Attempts = append(delivery.Attempts, DeliveryAttempt{At: time.Now(), Error: "webhook was deleted"})
+			SaveDelivery(delivery)
+			return
+		}
+
+		attempt := sendDelivery(webhook, delivery)
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		delivery.NextAttemptAt = nil
+		switch {
+		case attempt.Error == "":
+			delivery.Status = deliveryDelivered
+		case len(delivery.Attempts) >= webhookMaxAttempts:
+			delivery.Status = deliveryFailed
+			log.Printf("ERR delivery %s of webhook %s failed: %s\n", delivery.ID, webhook.ID, attempt.Error)
+		default:
+			next := time.Now().Add(webhookRetryBackoff * time.Duration(1<<uint(len(delivery.Attempts)-1)))
+			delivery.NextAttemptAt = &next
+		}
+		SaveDelivery(delivery)
+	}
+}
+
+func sendDelivery(webhook Webhook, delivery Delivery) DeliveryAttempt {
+	attempt := DeliveryAttempt{At: time.Now()}
+	req, err := newSignedRequest(webhook.URL, webhook.Secret, delivery.Payload, attempt.At)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set(headerWebhookID, webhook.ID)
+	req.Header.Set(headerDeliveryID, delivery.ID)
+
+	res, err := externalClient.Do(req)
+	attempt.Duration = time.Since(attempt.At).String()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	res.Body.Close()
+	attempt.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("receiver responded with %d", res.StatusCode)
+	}
+	return attempt
+}
+
+// newSignedRequest returns a POST request of a JSON payload signed with the secret
+func newSignedRequest(url string, secret string, payload []byte, now time.Time) (*http.Request, error) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req, err := http.NewRequest(POST, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", TYPE_JSON)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerSignature, "sha256="+signPayload(secret, timestamp, payload))
+	return req, nil
+}
+
+// postSigned POSTs a signed JSON payload to a receiver outside of the OpenReq infrastructure
+func postSigned(url string, secret string, payload []byte) error {
+	req, err := newSignedRequest(url, secret, payload, time.Now())
+	if err != nil {
+		return err
+	}
+	res, err := externalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with %d", res.StatusCode)
+	}
+	return nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the timestamp and the payload
+func signPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SaveWebhook adds or updates a webhook
+func SaveWebhook(webhook Webhook) error {
+	return storePut(bucketWebhooks, observableKey(webhook.Tenant, webhook.ID), webhook)
+}
+
+// WebhookOf returns a webhook of a tenant
+func WebhookOf(tenant string, id string) (Webhook, bool) {
+	var webhook Webhook
+	ok, err := storeGet(bucketWebhooks, observableKey(tenant, id), &webhook)
+	if err != nil {
+		log.Printf("ERR could not load webhook %s: %v\n", id, err)
+	}
+	return webhook, ok && webhook.Tenant == tenant
+}
+
+// Webhooks returns all webhooks of a tenant
+func Webhooks(tenant string) []Webhook {
+	webhooks := []Webhook{}
+	if db == nil {
+		return webhooks
+	}
+	err := storeForEach(bucketWebhooks, func(key string, data []byte) error {
+		var webhook Webhook
+		if err := json.Unmarshal(data, &webhook); err != nil {
+			return err
+		}
+		if webhook.Tenant == tenant {
+			webhooks = append(webhooks, webhook)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the webhooks: %v\n", err)
+	}
+	return webhooks
+}
+
+// SaveDelivery adds or updates a delivery
+func SaveDelivery(delivery Delivery) {
+	if db == nil {
+		return
+	}
+	if err := storePut(bucketDeliveries, delivery.ID, delivery); err != nil {
+		log.Printf("ERR could not save delivery %s: %v\n", delivery.ID, err)
+	}
+}
+
+// DeliveryFilter selects deliveries of a tenant. Other empty fields match every delivery
+type DeliveryFilter struct {
+	Tenant     string
+	AllTenants bool
+	WebhookID  string
+	Status     string
+	Limit      int
+}
+
+func (f DeliveryFilter) matches(delivery Delivery) bool {
+	return (f.AllTenants || f.Tenant == delivery.Tenant) &&
+		(f.WebhookID == "" || f.WebhookID == delivery.WebhookID) &&
+		(f.Status == "" || f.Status == delivery.Status)
+}
+
+// Deliveries returns the deliveries matching the filter, newest first
+func Deliveries(filter DeliveryFilter) []Delivery {
+	deliveries := []Delivery{}
+	if db == nil {
+		return deliveries
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(bucketDeliveries)).Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var delivery Delivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			if !filter.matches(delivery) {
+				continue
+			}
+			deliveries = append(deliveries, delivery)
+			if filter.Limit > 0 && len(deliveries) >= filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERR could not load the deliveries: %v\n", err)
+	}
+	return deliveries
+}
+
+// pruneDeliveries deletes all finished deliveries that were created before the given time
+func pruneDeliveries(before time.Time) {
+	for _, delivery := range Deliveries(DeliveryFilter{AllTenants: true}) {
+		if delivery.Status != deliveryPending && delivery.CreatedAt.Before(before) {
+			if err := storeDelete(bucketDeliveries, delivery.ID); err != nil {
+				log.Printf("ERR could not prune delivery %s: %v\n", delivery.ID, err)
+			}
+		}
+	}
+}
+
+// postWebhook creates a webhook. The response contains the secret, which is not shown again
+func postWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var webhook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		respondBadRequest(w, fmt.Errorf("invalid webhook: %v", err))
+		return
+	}
+	if err := ValidateWebhook(&webhook); err != nil {
+		respondBadRequest(w, err)
+		return
+	}
+	now := time.Now()
+	webhook.ID = newRunID(now)
+	webhook.Tenant = tenantOf(r)
+	webhook.CreatedAt = now
+	if err := SaveWebhook(webhook); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// getWebhooks returns all webhooks without their secrets
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	webhooks := Webhooks(tenantOf(r))
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+// getWebhook returns a single webhook without its secret
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	webhook, ok := WebhookOf(tenantOf(r), mux.Vars(r)["webhook_id"])
+	if !ok {
+		respondUnknownWebhook(w)
+		return
+	}
+	webhook.Secret = ""
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// deleteWebhook deletes a webhook. Its pending deliveries fail
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	webhook, ok := WebhookOf(tenantOf(r), mux.Vars(r)["webhook_id"])
+	if !ok {
+		respondUnknownWebhook(w)
+		return
+	}
+	if err := storeDelete(bucketWebhooks, observableKey(webhook.Tenant, webhook.ID)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Status: false, Message: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Response{Status: true, Message: "webhook deleted"})
+}
+
+// getDeliveries returns the deliveries of a webhook with all attempts, newest first. Query parameters: status, limit (default 100)
+func getDeliveries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	webhook, ok := WebhookOf(tenantOf(r), mux.Vars(r)["webhook_id"])
+	if !ok {
+		respondUnknownWebhook(w)
+		return
+	}
+	filter := DeliveryFilter{Tenant: webhook.Tenant, WebhookID: webhook.ID, Status: r.URL.Query().Get("status"), Limit: 100}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			respondBadRequest(w, fmt.Errorf("limit must be a positive number"))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Deliveries(filter))
+}
+
+func respondUnknownWebhook(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(Response{Status: false, Message: "unknown webhook"})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reviewsOf are the reviews crawled by the mocked collection layer. The mocked analytics and storage layer return them as they are
+var reviewsOf = map[string][]AppReviewGooglePlay{
+	"org.unstored.app": {
+		{ReviewID: "unstored-1", PackageName: "org.unstored.app", Rating: 1, Body: "Crashes", BugReport: true},
+	},
+	"com.webhook.app": {
+		{ReviewID: "1", PackageName: "com.webhook.app", Rating: 1, Body: "App crashes on start", BugReport: true},
+		{ReviewID: "2", PackageName: "com.webhook.app", Rating: 5, Body: "Never crashed", BugReport: true},
+		{ReviewID: "3", PackageName: "com.webhook.app", Rating: 1, Body: "Please add a crash reporter", FeatureRequest: true},
+		{ReviewID: "4", PackageName: "com.webhook.app", Rating: 2, Title: "Crash after update", BugReport: true},
+	},
+	"com.requirements.app": {
+		{ReviewID: "requirement-1", PackageName: "com.requirements.app", Rating: 4, Title: "Dark mode", Body: "Please add a dark mode", PermaLink: "https://play.google.com/review/requirement-1", FeatureRequest: true},
+		{ReviewID: "requirement-2", PackageName: "com.requirements.app", Rating: 1, Body: "Crashes on start", BugReport: true},
+	},
+	"com.alerts.app": {
+		{ReviewID: "alert-1", PackageName: "com.alerts.app", Rating: 1, Body: "Crashes all the time", BugReport: true},
+		{ReviewID: "alert-2", PackageName: "com.alerts.app", Rating: 2, Body: "Crashes on login", BugReport: true},
+		{ReviewID: "alert-3", PackageName: "com.alerts.app", Rating: 5, Body: "Great app"},
+	},
+	"com.alerts.retry": {
+		{ReviewID: "alert-retry-1", PackageName: "com.alerts.retry", Rating: 1, Body: "Crashes all the time", BugReport: true},
+	},
+	"com.alerts.sinks": {
+		{ReviewID: "alert-sinks-1", PackageName: "com.alerts.sinks", Rating: 1, Body: "Crashes all the time", BugReport: true},
+	},
+	"com.digest.app": {
+		{ReviewID: "digest-1", PackageName: "com.digest.app", Rating: 1, Body: "Crashes whenever I rotate the screen while watching a video", ThumbsUp: 12, BugReport: true},
+		{ReviewID: "digest-2", PackageName: "com.digest.app", Rating: 4, Body: "Please add offline mode", ThumbsUp: 30, FeatureRequest: true},
+		{ReviewID: "digest-3", PackageName: "com.digest.app", Rating: 5, Body: "Great"},
+	},
+	"com.events.app": {
+		{ReviewID: "event-1", PackageName: "com.events.app", Rating: 1, Body: "Crashes on start", BugReport: true},
+		{ReviewID: "event-2", PackageName: "com.events.app", Rating: 4, Body: "Please add a widget", FeatureRequest: true},
+	},
+	"com.issues.app": {
+		{ReviewID: "issue-1", PackageName: "com.issues.app", Rating: 1, Body: "The app crashes when I open the camera", PermaLink: "https://play.google.com/review/issue-1", BugReport: true},
+		{ReviewID: "issue-2", PackageName: "com.issues.app", Rating: 2, Body: "App crashes when I open the camera!", BugReport: true},
+		{ReviewID: "issue-3", PackageName: "com.issues.app", Rating: 3, Title: "Login", Body: "The login button does nothing", BugReport: true},
+		{ReviewID: "issue-4", PackageName: "com.issues.app", Rating: 4, Body: "Please add a dark mode", FeatureRequest: true},
+	},
+}
+
+func echoReviews(w http.ResponseWriter, r *http.Request) {
+	var reviews []AppReviewGooglePlay
+	json.NewDecoder(r.Body).Decode(&reviews)
+	if reviews == nil {
+		reviews = []AppReviewGooglePlay{}
+	}
+	respond(w, http.StatusOK, reviews)
+}
+
+func TestWebhooks(t *testing.T) {
+	induceServerError = false
+	backoff := webhookRetryBackoff
+	webhookRetryBackoff = 10 * time.Millisecond
+	defer func() { webhookRetryBackoff = backoff }()
+
+	var webhook Webhook
+	var requests int32
+	var received []AppReviewGooglePlay
+	var receivedMutex sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(headerSignature) != "sha256="+signPayload(webhook.Secret, r.Header.Get(headerTimestamp), body) {
+			t.Error("Expected a valid signature")
+		}
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+		receivedMutex.Lock()
+		received = append(received, payload.Reviews...)
+		receivedMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	ep := endpoint{method: "POST", url: "/hitec/orchestration/app/webhooks"}
+	assertStatus(t, http.StatusBadRequest, ep.mustExecuteRequest(Webhook{URL: "chat.example.com"}))
+	assertStatus(t, http.StatusBadRequest, ep.mustExecuteRequest(Webhook{URL: receiver.URL, Classes: []string{"praise"}}))
+
+	rr := ep.mustExecuteRequest(Webhook{URL: receiver.URL, PackageNames: []string{"com.webhook.app"}, Classes: []string{classBugReport}, MaxRating: 2, Keywords: []string{"crash"}, BatchSize: 1})
+	assertStatus(t, http.StatusCreated, rr)
+	json.NewDecoder(rr.Body).Decode(&webhook)
+	if webhook.Secret == "" {
+		t.Fatal("Expected a generated secret")
+	}
+
+	assertSuccess(t, endpoint{method: "POST", url: "/hitec/orchestration/app/observe/google-play/package-name/com.webhook.app/interval/daily"}.mustExecuteRequest(nil))
+	if run := runNow(t, "com.webhook.app"); run.ClassifiedReviews != 4 {
+		t.Errorf("Expected 4 classified reviews. Got %+v instead", run)
+	}
+
+	deliveries := endpoint{method: "GET", url: "/hitec/orchestration/app/webhooks/" + webhook.ID + "/deliveries?status=" + deliveryDelivered}
+	deadline := time.Now().Add(2 * time.Second)
+	var delivered []Delivery
+	for len(delivered) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		json.NewDecoder(deliveries.mustExecuteRequest(nil).Body).Decode(&delivered)
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("Expected a delivery per matching review. Got %+v instead", delivered)
+	}
+	if attempts := len(delivered[0].Attempts) + len(delivered[1].Attempts); attempts != 3 {
+		t.Errorf("Expected the failed attempt to be retried. Got %d attempts", attempts)
+	}
+	receivedMutex.Lock()
+	defer receivedMutex.Unlock()
+	if len(received) != 2 {
+		t.Errorf("Expected the bug reports 1 and 4. Got %+v instead", received)
+	}
+
+	var webhooks []Webhook
+	json.NewDecoder(endpoint{method: "GET", url: "/hitec/orchestration/app/webhooks"}.mustExecuteRequest(nil).Body).Decode(&webhooks)
+	for _, w := range webhooks {
+		if w.Secret != "" {
+			t.Error("Expected the secret to be hidden")
+		}
+	}
+
+	webhookOf := endpoint{method: "DELETE", url: "/hitec/orchestration/app/webhooks/" + webhook.ID}
+	assertSuccess(t, webhookOf.mustExecuteRequest(nil))
+	assertStatus(t, http.StatusNotFound, endpoint{method: "GET", url: "/hitec/orchestration/app/webhooks/" + webhook.ID}.mustExecuteRequest(nil))
+}
+
+func TestSignPayload(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	expected := "b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if signature := signPayload("secret", "1700000000", []byte("{}")); signature != expected {
+		t.Errorf("Expected %s. Got %s instead", expected, signature)
+	}
+}